@@ -0,0 +1,9 @@
+// Package api holds the OpenAPI specification of the HTTP API, embedded in the binary.
+package api
+
+import _ "embed"
+
+// Spec is the OpenAPI 3 document in YAML
+//
+//go:embed openapi.yaml
+var Spec []byte
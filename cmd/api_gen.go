@@ -0,0 +1,145 @@
+// Code generated by apigen from ../api/openapi.yaml. DO NOT EDIT.
+
+package main
+
+import "net/http"
+
+// apiServer has a handler for every operation of the API spec
+type apiServer interface {
+	// StreamEvents - GET /api/v1/events: Server-sent events about changes to notes the user can see
+	StreamEvents(w http.ResponseWriter, r *http.Request)
+	// StreamEventsWS - GET /api/v1/events/ws: WebSocket with the same events as /events
+	StreamEventsWS(w http.ResponseWriter, r *http.Request)
+	// ExportNotes - GET /api/v1/export: Download every note of the user as a ZIP archive
+	ExportNotes(w http.ResponseWriter, r *http.Request)
+	// CreateImport - POST /api/v1/import: Import notes from a ZIP, Google Keep or Evernote file
+	CreateImport(w http.ResponseWriter, r *http.Request)
+	// GetImport - GET /api/v1/imports/{id}: Progress of an import
+	GetImport(w http.ResponseWriter, r *http.Request)
+	// GetJob - GET /api/v1/jobs/{id}: Status of a background job started by the user
+	GetJob(w http.ResponseWriter, r *http.Request)
+	// GetNotes - GET /api/v1/notes: List the notes of the user
+	GetNotes(w http.ResponseWriter, r *http.Request)
+	// CreateNote - POST /api/v1/notes: Create a note
+	CreateNote(w http.ResponseWriter, r *http.Request)
+	// GetNoteByID - GET /api/v1/notes/{id}: Get a note
+	GetNoteByID(w http.ResponseWriter, r *http.Request)
+	// UpdateNote - PUT /api/v1/notes/{id}: Replace the title, content and pin status of a note
+	UpdateNote(w http.ResponseWriter, r *http.Request)
+	// DeleteNote - DELETE /api/v1/notes/{id}: Delete a note and its attachments
+	DeleteNote(w http.ResponseWriter, r *http.Request)
+	// DeleteFile - DELETE /api/v1/notes/{id}/delete-file: Remove an attachment from a note
+	DeleteFile(w http.ResponseWriter, r *http.Request)
+	// PatchNoteItem - PATCH /api/v1/notes/{id}/items/{itemId}: Check, uncheck or edit a checklist item
+	PatchNoteItem(w http.ResponseWriter, r *http.Request)
+	// GetShareLinks - GET /api/v1/notes/{id}/links: List the public links of a note, owner only
+	GetShareLinks(w http.ResponseWriter, r *http.Request)
+	// CreateShareLink - POST /api/v1/notes/{id}/links: Create a public read-only link to a note
+	CreateShareLink(w http.ResponseWriter, r *http.Request)
+	// RevokeShareLink - DELETE /api/v1/notes/{id}/links/{linkId}: Revoke a public link
+	RevokeShareLink(w http.ResponseWriter, r *http.Request)
+	// LockNote - PUT /api/v1/notes/{id}/lock: Lock a note with content encrypted by the client, or unlock it
+	LockNote(w http.ResponseWriter, r *http.Request)
+	// SetReminder - PUT /api/v1/notes/{id}/reminder: Set or clear the reminder of a note, owner only
+	SetReminder(w http.ResponseWriter, r *http.Request)
+	// GetNoteShares - GET /api/v1/notes/{id}/shares: List the users a note is shared with, owner only
+	GetNoteShares(w http.ResponseWriter, r *http.Request)
+	// ShareNote - POST /api/v1/notes/{id}/shares: Share a note with a user or change their role
+	ShareNote(w http.ResponseWriter, r *http.Request)
+	// RevokeShare - DELETE /api/v1/notes/{id}/shares/{userId}: Revoke a share, or leave a note shared with the user
+	RevokeShare(w http.ResponseWriter, r *http.Request)
+	// TogglePinNote - PUT /api/v1/notes/{id}/toggle-pin: Pin or unpin a note
+	TogglePinNote(w http.ResponseWriter, r *http.Request)
+	// UploadFile - POST /api/v1/notes/{id}/upload-file: Attach a file to a note
+	UploadFile(w http.ResponseWriter, r *http.Request)
+	// GetOpenAPI - GET /api/v1/openapi.json: This specification
+	GetOpenAPI(w http.ResponseWriter, r *http.Request)
+	// GetSettings - GET /api/v1/settings: Get the settings of the user
+	GetSettings(w http.ResponseWriter, r *http.Request)
+	// UpdateSettings - PUT /api/v1/settings: Replace the settings of the user
+	UpdateSettings(w http.ResponseWriter, r *http.Request)
+	// SyncNotes - POST /api/v1/sync: Apply offline changes and fetch the changes since a cursor
+	SyncNotes(w http.ResponseWriter, r *http.Request)
+	// GetOpenTasks - GET /api/v1/tasks: List the unchecked checklist items of the notes the user can see
+	GetOpenTasks(w http.ResponseWriter, r *http.Request)
+	// GetTemplates - GET /api/v1/templates: List the built-in templates and the user's own
+	GetTemplates(w http.ResponseWriter, r *http.Request)
+	// CreateTemplate - POST /api/v1/templates: Create a template
+	CreateTemplate(w http.ResponseWriter, r *http.Request)
+	// GetTemplate - GET /api/v1/templates/{id}: Get a template
+	GetTemplate(w http.ResponseWriter, r *http.Request)
+	// UpdateTemplate - PUT /api/v1/templates/{id}: Replace a template of the user, built-in templates can't be changed
+	UpdateTemplate(w http.ResponseWriter, r *http.Request)
+	// DeleteTemplate - DELETE /api/v1/templates/{id}: Delete a template of the user
+	DeleteTemplate(w http.ResponseWriter, r *http.Request)
+	// DownloadBlob - GET /blobs/{bucket}/{key}: Download a stored file through a signed link
+	DownloadBlob(w http.ResponseWriter, r *http.Request)
+	// HeadBlob - HEAD /blobs/{bucket}/{key}: Check a signed file link without downloading the file
+	HeadBlob(w http.ResponseWriter, r *http.Request)
+	// Healthz - GET /healthz: Liveness probe
+	Healthz(w http.ResponseWriter, r *http.Request)
+	// Readyz - GET /readyz: Readiness probe, checks Postgres and blob storage
+	Readyz(w http.ResponseWriter, r *http.Request)
+	// ViewSharedNote - GET /s/{token}: Public page of a note shared by link
+	ViewSharedNote(w http.ResponseWriter, r *http.Request)
+	// ViewSharedNoteWithPassword - POST /s/{token}: Submit the password of a protected link
+	ViewSharedNoteWithPassword(w http.ResponseWriter, r *http.Request)
+}
+
+// apiOperation - represent an operation of the API spec and how it is served
+type apiOperation struct {
+	method      string
+	path        string
+	operationID string
+	// rateClass is the rate limit class of the route, empty for none
+	rateClass string
+	// auth requires Telegram init data, queryAuth also accepts it in the initData parameter
+	auth      bool
+	queryAuth bool
+	handler   http.HandlerFunc
+}
+
+// apiOperations returns the operations of the API spec served by s
+func apiOperations(s apiServer) []apiOperation {
+	return []apiOperation{
+		{method: "GET", path: "/api/v1/events", operationID: "streamEvents", rateClass: "reads", auth: true, queryAuth: true, handler: s.StreamEvents},
+		{method: "GET", path: "/api/v1/events/ws", operationID: "streamEventsWS", rateClass: "reads", auth: true, queryAuth: true, handler: s.StreamEventsWS},
+		{method: "GET", path: "/api/v1/export", operationID: "exportNotes", rateClass: "reads", auth: true, queryAuth: false, handler: s.ExportNotes},
+		{method: "POST", path: "/api/v1/import", operationID: "createImport", rateClass: "uploads", auth: true, queryAuth: false, handler: s.CreateImport},
+		{method: "GET", path: "/api/v1/imports/{id}", operationID: "getImport", rateClass: "reads", auth: true, queryAuth: false, handler: s.GetImport},
+		{method: "GET", path: "/api/v1/jobs/{id}", operationID: "getJob", rateClass: "reads", auth: true, queryAuth: false, handler: s.GetJob},
+		{method: "GET", path: "/api/v1/notes", operationID: "getNotes", rateClass: "reads", auth: true, queryAuth: false, handler: s.GetNotes},
+		{method: "POST", path: "/api/v1/notes", operationID: "createNote", rateClass: "writes", auth: true, queryAuth: false, handler: s.CreateNote},
+		{method: "GET", path: "/api/v1/notes/{id}", operationID: "getNoteByID", rateClass: "reads", auth: true, queryAuth: false, handler: s.GetNoteByID},
+		{method: "PUT", path: "/api/v1/notes/{id}", operationID: "updateNote", rateClass: "writes", auth: true, queryAuth: false, handler: s.UpdateNote},
+		{method: "DELETE", path: "/api/v1/notes/{id}", operationID: "deleteNote", rateClass: "writes", auth: true, queryAuth: false, handler: s.DeleteNote},
+		{method: "DELETE", path: "/api/v1/notes/{id}/delete-file", operationID: "deleteFile", rateClass: "writes", auth: true, queryAuth: false, handler: s.DeleteFile},
+		{method: "PATCH", path: "/api/v1/notes/{id}/items/{itemId}", operationID: "patchNoteItem", rateClass: "writes", auth: true, queryAuth: false, handler: s.PatchNoteItem},
+		{method: "GET", path: "/api/v1/notes/{id}/links", operationID: "getShareLinks", rateClass: "reads", auth: true, queryAuth: false, handler: s.GetShareLinks},
+		{method: "POST", path: "/api/v1/notes/{id}/links", operationID: "createShareLink", rateClass: "writes", auth: true, queryAuth: false, handler: s.CreateShareLink},
+		{method: "DELETE", path: "/api/v1/notes/{id}/links/{linkId}", operationID: "revokeShareLink", rateClass: "writes", auth: true, queryAuth: false, handler: s.RevokeShareLink},
+		{method: "PUT", path: "/api/v1/notes/{id}/lock", operationID: "lockNote", rateClass: "writes", auth: true, queryAuth: false, handler: s.LockNote},
+		{method: "PUT", path: "/api/v1/notes/{id}/reminder", operationID: "setReminder", rateClass: "writes", auth: true, queryAuth: false, handler: s.SetReminder},
+		{method: "GET", path: "/api/v1/notes/{id}/shares", operationID: "getNoteShares", rateClass: "reads", auth: true, queryAuth: false, handler: s.GetNoteShares},
+		{method: "POST", path: "/api/v1/notes/{id}/shares", operationID: "shareNote", rateClass: "writes", auth: true, queryAuth: false, handler: s.ShareNote},
+		{method: "DELETE", path: "/api/v1/notes/{id}/shares/{userId}", operationID: "revokeShare", rateClass: "writes", auth: true, queryAuth: false, handler: s.RevokeShare},
+		{method: "PUT", path: "/api/v1/notes/{id}/toggle-pin", operationID: "togglePinNote", rateClass: "writes", auth: true, queryAuth: false, handler: s.TogglePinNote},
+		{method: "POST", path: "/api/v1/notes/{id}/upload-file", operationID: "uploadFile", rateClass: "uploads", auth: true, queryAuth: false, handler: s.UploadFile},
+		{method: "GET", path: "/api/v1/openapi.json", operationID: "getOpenAPI", rateClass: "", auth: false, queryAuth: false, handler: s.GetOpenAPI},
+		{method: "GET", path: "/api/v1/settings", operationID: "getSettings", rateClass: "reads", auth: true, queryAuth: false, handler: s.GetSettings},
+		{method: "PUT", path: "/api/v1/settings", operationID: "updateSettings", rateClass: "writes", auth: true, queryAuth: false, handler: s.UpdateSettings},
+		{method: "POST", path: "/api/v1/sync", operationID: "syncNotes", rateClass: "writes", auth: true, queryAuth: false, handler: s.SyncNotes},
+		{method: "GET", path: "/api/v1/tasks", operationID: "getOpenTasks", rateClass: "reads", auth: true, queryAuth: false, handler: s.GetOpenTasks},
+		{method: "GET", path: "/api/v1/templates", operationID: "getTemplates", rateClass: "reads", auth: true, queryAuth: false, handler: s.GetTemplates},
+		{method: "POST", path: "/api/v1/templates", operationID: "createTemplate", rateClass: "writes", auth: true, queryAuth: false, handler: s.CreateTemplate},
+		{method: "GET", path: "/api/v1/templates/{id}", operationID: "getTemplate", rateClass: "reads", auth: true, queryAuth: false, handler: s.GetTemplate},
+		{method: "PUT", path: "/api/v1/templates/{id}", operationID: "updateTemplate", rateClass: "writes", auth: true, queryAuth: false, handler: s.UpdateTemplate},
+		{method: "DELETE", path: "/api/v1/templates/{id}", operationID: "deleteTemplate", rateClass: "writes", auth: true, queryAuth: false, handler: s.DeleteTemplate},
+		{method: "GET", path: "/blobs/{bucket}/{key}", operationID: "downloadBlob", rateClass: "reads", auth: false, queryAuth: false, handler: s.DownloadBlob},
+		{method: "HEAD", path: "/blobs/{bucket}/{key}", operationID: "headBlob", rateClass: "reads", auth: false, queryAuth: false, handler: s.HeadBlob},
+		{method: "GET", path: "/healthz", operationID: "healthz", rateClass: "", auth: false, queryAuth: false, handler: s.Healthz},
+		{method: "GET", path: "/readyz", operationID: "readyz", rateClass: "", auth: false, queryAuth: false, handler: s.Readyz},
+		{method: "GET", path: "/s/{token}", operationID: "viewSharedNote", rateClass: "reads", auth: false, queryAuth: false, handler: s.ViewSharedNote},
+		{method: "POST", path: "/s/{token}", operationID: "viewSharedNoteWithPassword", rateClass: "writes", auth: false, queryAuth: false, handler: s.ViewSharedNoteWithPassword},
+	}
+}
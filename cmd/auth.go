@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Telegram Mini App clients send their init data as "Authorization: tma <initData>"
+const (
+	authScheme     = "tma "
+	initDataMaxAge = 24 * time.Hour
+)
+
+type ctxKey int
+
+const (
+	userIDKey ctxKey = iota
+	requestInfoKey
+)
+
+// requireAuth verifies the Telegram init data of the request and
+// puts the authenticated user ID into the request context
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := authenticate(r)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Rejected unauthenticated request", "path", r.URL.Path, "error", err)
+			writeError(w, newAPIError(http.StatusUnauthorized, codeUnauthorized, "Missing or invalid Telegram init data"))
+			return
+		}
+
+		if info := requestInfoFromContext(r.Context()); info != nil {
+			info.userID = userID
+		}
+		ctx := context.WithValue(r.Context(), userIDKey, userID)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// allowQueryAuth accepts the init data in the "initData" query parameter for clients that
+// can't set headers, like EventSource and browser WebSockets. It must wrap requireAuth.
+func allowQueryAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if initData := r.URL.Query().Get("initData"); initData != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", authScheme+initData)
+		}
+		next(w, r)
+	}
+}
+
+// userIDFromContext returns the user ID stored by requireAuth
+func userIDFromContext(ctx context.Context) int {
+	userID, _ := ctx.Value(userIDKey).(int)
+	return userID
+}
+
+func authenticate(r *http.Request) (int, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, authScheme) {
+		return 0, fmt.Errorf("missing init data")
+	}
+	initData := strings.TrimPrefix(header, authScheme)
+
+	isVerified, err := VerifyTelegramAuth(initData)
+	if err != nil {
+		return 0, err
+	}
+	if !isVerified {
+		return 0, fmt.Errorf("invalid init data hash")
+	}
+
+	dataMap, err := parseInitData(initData)
+	if err != nil {
+		return 0, err
+	}
+
+	authDate, err := strconv.ParseInt(dataMap["auth_date"], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid auth_date: %w", err)
+	}
+	if time.Since(time.Unix(authDate, 0)) > initDataMaxAge {
+		return 0, fmt.Errorf("init data expired")
+	}
+
+	var user struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(dataMap["user"]), &user); err != nil {
+		return 0, fmt.Errorf("invalid user: %w", err)
+	}
+	if user.ID == 0 {
+		return 0, fmt.Errorf("user not found")
+	}
+
+	return user.ID, nil
+}
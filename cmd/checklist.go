@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Checklist items are the "- [ ] text" lines of a note's Markdown content. The content is
+// the source of truth: note_items mirrors it after every write, matching items to the rows
+// they had before so their IDs survive edits. An item may end with "due:YYYY-MM-DD".
+
+const (
+	maxItemTextLength = 1000
+	maxOpenTasks      = 500
+	dueDateLayout     = "2006-01-02"
+	itemsIndexBatch   = 200
+)
+
+var (
+	checklistLine = regexp.MustCompile(`^(\s*[-*+] )\[([ xX])\] (.*)$`)
+	dueDateToken  = regexp.MustCompile(`(?:^|\s+)due:(\d{4}-\d{2}-\d{2})\s*$`)
+)
+
+// ChecklistItem - represent a checklist item of a note
+type ChecklistItem struct {
+	ID       int64  `json:"id"`
+	NoteID   int    `json:"noteId"`
+	Text     string `json:"text"`
+	Checked  bool   `json:"checked"`
+	Position int    `json:"position"`
+	// DueDate is a date without time, YYYY-MM-DD
+	DueDate *string `json:"dueDate"`
+}
+
+// OpenTask - represent an unchecked item with the note it is on
+type OpenTask struct {
+	ChecklistItem
+	NoteTitle string `json:"noteTitle"`
+}
+
+// checklistEntry - represent a checklist line of the content
+type checklistEntry struct {
+	line   int
+	prefix string
+	item   ChecklistItem
+}
+
+// parseChecklist finds the checklist items of Markdown content, skipping code blocks
+func parseChecklist(content string) []checklistEntry {
+	var entries []checklistEntry
+	inCode := false
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCode = !inCode
+			continue
+		}
+		m := checklistLine.FindStringSubmatch(line)
+		if inCode || m == nil {
+			continue
+		}
+
+		item := ChecklistItem{Checked: m[2] != " ", Position: len(entries), Text: m[3]}
+		if due := dueDateToken.FindStringSubmatchIndex(item.Text); due != nil {
+			if _, err := time.Parse(dueDateLayout, item.Text[due[2]:due[3]]); err == nil {
+				date := item.Text[due[2]:due[3]]
+				item.DueDate = &date
+				item.Text = item.Text[:due[0]]
+			}
+		}
+		entries = append(entries, checklistEntry{line: i, prefix: m[1], item: item})
+	}
+	return entries
+}
+
+// formatChecklistLine writes an item back as a Markdown line
+func formatChecklistLine(prefix string, item ChecklistItem) string {
+	mark := " "
+	if item.Checked {
+		mark = "x"
+	}
+	line := prefix + "[" + mark + "] " + item.Text
+	if item.DueDate != nil {
+		line += " due:" + *item.DueDate
+	}
+	return line
+}
+
+// replaceLine replaces one line of content, keeping a Windows line ending
+func replaceLine(content string, index int, line string) string {
+	lines := strings.Split(content, "\n")
+	if strings.HasSuffix(lines[index], "\r") {
+		line += "\r"
+	}
+	lines[index] = line
+	return strings.Join(lines, "\n")
+}
+
+// loadNoteItems returns the checklist items of a note in order
+func loadNoteItems(ctx context.Context, noteID int) ([]ChecklistItem, error) {
+	return queryNoteItems(ctx, db, noteID)
+}
+
+func queryNoteItems(ctx context.Context, q querier, noteID int) ([]ChecklistItem, error) {
+	rows, err := q.QueryContext(ctx,
+		"SELECT id, note_id, text, checked, position, due_date, data_key_id FROM note_items WHERE note_id = $1 ORDER BY position", noteID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var items []ChecklistItem
+	var keyIDs []*int64
+	for rows.Next() {
+		var item ChecklistItem
+		var keyID *int64
+		if item, keyID, err = scanChecklistItem(rows); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		items = append(items, item)
+		keyIDs = append(keyIDs, keyID)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	// Decrypt after closing the rows, a transaction runs one query at a time
+	for i := range items {
+		if err := openItemText(ctx, &items[i], keyIDs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// scanChecklistItem reads id, note_id, text, checked, position, due_date and data_key_id
+func scanChecklistItem(row rowScanner, extra ...any) (ChecklistItem, *int64, error) {
+	var item ChecklistItem
+	var due sql.NullTime
+	var keyID *int64
+	dest := []any{&item.ID, &item.NoteID, &item.Text, &item.Checked, &item.Position, &due, &keyID}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return item, nil, err
+	}
+	if due.Valid {
+		date := due.Time.Format(dueDateLayout)
+		item.DueDate = &date
+	}
+	return item, keyID, nil
+}
+
+func openItemText(ctx context.Context, item *ChecklistItem, keyID *int64) error {
+	if keyID == nil {
+		return nil
+	}
+	k, err := dataKeyByID(ctx, *keyID)
+	if err != nil {
+		return fmt.Errorf("item %d: %w", item.ID, err)
+	}
+	if item.Text, err = k.openField("note_items.text", item.ID, item.Text); err != nil {
+		return fmt.Errorf("item %d: %w", item.ID, err)
+	}
+	return nil
+}
+
+// indexNoteItems brings the checklist rows of a note in step with its content. It runs
+// after every write of the content and reads the note itself, so concurrent writes end
+// with the rows of the last one. Failures are logged, the next write catches up.
+func indexNoteItems(ctx context.Context, noteID int) {
+	if err := reindexNoteItems(ctx, noteID); err != nil {
+		slog.ErrorContext(ctx, "Error indexing checklist items", "note_id", noteID, "error", err)
+	}
+}
+
+// reindexNoteItems reconciles the checklist rows of a note, a missing note is not an error
+func reindexNoteItems(ctx context.Context, noteID int) error {
+	err := withNoteLocked(ctx, noteID, func(tx *sql.Tx, n Note) error {
+		_, err := reconcileNoteItems(ctx, tx, n)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+// withNoteLocked runs fn in a transaction holding the row lock of the note, or returns sql.ErrNoRows
+func withNoteLocked(ctx context.Context, noteID int, fn func(tx *sql.Tx, n Note) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	n, err := scanNote(ctx, tx.QueryRowContext(ctx, "SELECT "+noteColumns+" FROM notes WHERE id = $1 FOR UPDATE", noteID))
+	if err != nil {
+		return err
+	}
+	if err := fn(tx, n); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// reconcileNoteItems rewrites the checklist rows of a note from its content and returns
+// the items in order, with the IDs matchNoteItems gives them. Locked notes have no items,
+// the server can't read them.
+func reconcileNoteItems(ctx context.Context, tx *sql.Tx, n Note) ([]checklistEntry, error) {
+	var entries []checklistEntry
+	if !n.IsLocked {
+		entries = parseChecklist(n.Content)
+	}
+	old, err := queryNoteItems(ctx, tx, n.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range matchNoteItems(entries, old) {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM note_items WHERE id = $1", item.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := userDataKey(ctx, n.UserID)
+	if err != nil {
+		return nil, err
+	}
+	oldByID := make(map[int64]ChecklistItem, len(old))
+	for _, item := range old {
+		oldByID[item.ID] = item
+	}
+	for i := range entries {
+		item := &entries[i].item
+		item.NoteID = n.ID
+		if prev, ok := oldByID[item.ID]; ok && sameItem(prev, *item) {
+			continue
+		}
+
+		// New items get their ID first, the sealed text authenticates it
+		isNew := item.ID == 0
+		if isNew {
+			if item.ID, err = nextRowID(ctx, tx, "note_items"); err != nil {
+				return nil, err
+			}
+		}
+		text, keyID := item.Text, (*int64)(nil)
+		if key != nil {
+			if text, err = key.sealField("note_items.text", item.ID, item.Text); err != nil {
+				return nil, err
+			}
+			keyID = &key.id
+		}
+		if isNew {
+			_, err = tx.ExecContext(ctx,
+				"INSERT INTO note_items (id, note_id, position, text, checked, due_date, data_key_id) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+				item.ID, n.ID, item.Position, text, item.Checked, item.DueDate, keyID,
+			)
+		} else {
+			_, err = tx.ExecContext(ctx,
+				"UPDATE note_items SET position = $1, text = $2, checked = $3, due_date = $4, data_key_id = $5 WHERE id = $6",
+				item.Position, text, item.Checked, item.DueDate, keyID, item.ID,
+			)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// matchNoteItems gives the entries the IDs of the old items they continue and returns the
+// old items no entry continues. An entry takes the ID of an old item with the same text,
+// or failing that of the old item at its position, so toggling, editing and reordering
+// keep IDs. Entries left with ID 0 are new.
+func matchNoteItems(entries []checklistEntry, old []ChecklistItem) []ChecklistItem {
+	used := make([]bool, len(old))
+	match := func(same func(ChecklistItem, ChecklistItem) bool) {
+		for i := range entries {
+			if entries[i].item.ID != 0 {
+				continue
+			}
+			for j := range old {
+				if !used[j] && same(old[j], entries[i].item) {
+					entries[i].item.ID, used[j] = old[j].ID, true
+					break
+				}
+			}
+		}
+	}
+	match(func(o, e ChecklistItem) bool { return o.Text == e.Text })
+	match(func(o, e ChecklistItem) bool { return o.Position == e.Position })
+
+	var removed []ChecklistItem
+	for j, item := range old {
+		if !used[j] {
+			removed = append(removed, item)
+		}
+	}
+	return removed
+}
+
+func sameItem(a, b ChecklistItem) bool {
+	sameDue := (a.DueDate == nil) == (b.DueDate == nil) && (a.DueDate == nil || *a.DueDate == *b.DueDate)
+	return a.Text == b.Text && a.Checked == b.Checked && a.Position == b.Position && sameDue
+}
+
+// Toggle or edit one checklist item. The line of the item in the content is rewritten,
+// so clients showing the Markdown and clients showing items stay in agreement.
+func patchNoteItem(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	itemID, err := pathID(r, "itemId")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	slog.DebugContext(ctx, "Updating checklist item", "note_id", id, "item_id", itemID)
+
+	userID := userIDFromContext(ctx)
+	role, ok := authorizeNote(ctx, w, id, userID, roleEditor)
+	if !ok {
+		return
+	}
+
+	// Fields left out stay as they are, an empty dueDate clears it
+	var body struct {
+		Text    *string `json:"text"`
+		Checked *bool   `json:"checked"`
+		DueDate *string `json:"dueDate"`
+	}
+	if err := decodeJSON(w, r, &body); err != nil {
+		slog.WarnContext(ctx, "Error decoding checklist item request", "error", err)
+		writeError(w, err)
+		return
+	}
+	var fields []FieldError
+	if body.Text != nil {
+		*body.Text = strings.TrimSpace(*body.Text)
+		if *body.Text == "" || strings.ContainsAny(*body.Text, "\r\n") || utf8.RuneCountInString(*body.Text) > maxItemTextLength {
+			fields = append(fields, FieldError{Field: "text", Message: fmt.Sprintf("Text must be a single line of 1 to %d characters", maxItemTextLength)})
+		} else if dueDateToken.MatchString(*body.Text) {
+			fields = append(fields, FieldError{Field: "text", Message: "Set the due date with dueDate, not in the text"})
+		}
+	}
+	if body.DueDate != nil && *body.DueDate != "" {
+		if _, err := time.Parse(dueDateLayout, *body.DueDate); err != nil {
+			fields = append(fields, FieldError{Field: "dueDate", Message: "Due date must be a date like 2026-10-18, or empty to clear it"})
+		}
+	}
+	if len(fields) > 0 {
+		writeError(w, validationError(fields...))
+		return
+	}
+
+	var version int64
+	err = withNoteLocked(ctx, id, func(tx *sql.Tx, n Note) error {
+		if n.IsLocked {
+			return noteLockedError("Items of locked notes are edited in the content, the server can't read it")
+		}
+		// Index first, the rows may lag behind the content after a failed write
+		entries, err := reconcileNoteItems(ctx, tx, n)
+		if err != nil {
+			return err
+		}
+		var entry *checklistEntry
+		for i := range entries {
+			if entries[i].item.ID == int64(itemID) {
+				entry = &entries[i]
+			}
+		}
+		if entry == nil {
+			return notFoundError(codeItemNotFound, "Checklist item not found")
+		}
+
+		if body.Text != nil {
+			entry.item.Text = *body.Text
+		}
+		if body.Checked != nil {
+			entry.item.Checked = *body.Checked
+		}
+		if body.DueDate != nil {
+			entry.item.DueDate = body.DueDate
+			if *body.DueDate == "" {
+				entry.item.DueDate = nil
+			}
+		}
+		n.Content = replaceLine(n.Content, entry.line, formatChecklistLine(entry.prefix, entry.item))
+		if err := validateNote(n); err != nil {
+			return err
+		}
+
+		key, err := userDataKey(ctx, n.UserID)
+		if err != nil {
+			return err
+		}
+		title, content, keyID, err := sealNoteText(key, n.ID, n.Title, n.Content)
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRowContext(ctx,
+			"UPDATE notes SET title = $1, content = $2, data_key_id = $3, last_modified = $4, version = version + 1 WHERE id = $5 RETURNING version",
+			title, content, keyID, time.Now(), id,
+		).Scan(&version)
+		if err != nil {
+			return err
+		}
+		_, err = reconcileNoteItems(ctx, tx, n)
+		return err
+	})
+	if err == sql.ErrNoRows {
+		writeError(w, notFoundError(codeNoteNotFound, "Note not found"))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating checklist item", "note_id", id, "item_id", itemID, "error", err)
+		writeError(w, err)
+		return
+	}
+	publishNoteEvent(ctx, eventNoteUpdated, id, version, userID, nil)
+	slog.InfoContext(ctx, "Updated checklist item", "note_id", id, "item_id", itemID, "version", version)
+
+	respondWithNote(w, r, http.StatusOK, id, role)
+}
+
+// List the unchecked items of every note the user owns or that is shared with them,
+// the ones due soonest first. dueBefore=YYYY-MM-DD keeps the items due before that day.
+func getOpenTasks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := userIDFromContext(ctx)
+
+	var dueBefore *string
+	if v := r.URL.Query().Get("dueBefore"); v != "" {
+		if _, err := time.Parse(dueDateLayout, v); err != nil {
+			writeError(w, validationError(FieldError{Field: "dueBefore", Message: "dueBefore must be a date like 2026-10-18"}))
+			return
+		}
+		dueBefore = &v
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT i.id, i.note_id, i.text, i.checked, i.position, i.due_date, i.data_key_id, n.title, n.data_key_id
+		FROM note_items i JOIN notes n ON n.id = i.note_id
+		WHERE NOT i.checked AND NOT n.is_locked
+		  AND (n.user_id = $1 OR EXISTS (SELECT 1 FROM note_shares s WHERE s.note_id = n.id AND s.grantee_user_id = $1))
+		  AND ($2::date IS NULL OR i.due_date < $2::date)
+		ORDER BY i.due_date NULLS LAST, n.last_modified DESC, i.position
+		LIMIT $3`,
+		userID, dueBefore, maxOpenTasks,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error querying open tasks", "error", err)
+		writeError(w, err)
+		return
+	}
+	defer func() { _ = rows.Close() }()
+
+	tasks := []OpenTask{}
+	var itemKeys, titleKeys []*int64
+	for rows.Next() {
+		var t OpenTask
+		var itemKey, titleKey *int64
+		if t.ChecklistItem, itemKey, err = scanChecklistItem(rows, &t.NoteTitle, &titleKey); err != nil {
+			slog.ErrorContext(ctx, "Error scanning open task", "error", err)
+			writeError(w, err)
+			return
+		}
+		tasks = append(tasks, t)
+		itemKeys, titleKeys = append(itemKeys, itemKey), append(titleKeys, titleKey)
+	}
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(ctx, "Error querying open tasks", "error", err)
+		writeError(w, err)
+		return
+	}
+
+	for i := range tasks {
+		err := openItemText(ctx, &tasks[i].ChecklistItem, itemKeys[i])
+		if err == nil && titleKeys[i] != nil {
+			var k *dataKey
+			if k, err = dataKeyByID(ctx, *titleKeys[i]); err == nil {
+				tasks[i].NoteTitle, err = k.openField("notes.title", int64(tasks[i].NoteID), tasks[i].NoteTitle)
+			}
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Error decrypting open task", "item_id", tasks[i].ID, "error", err)
+			writeError(w, err)
+			return
+		}
+	}
+
+	writeJSON(ctx, w, http.StatusOK, tasks)
+}
+
+// indexNoteItemsPayload - represent where the indexing of existing notes goes on from
+type indexNoteItemsPayload struct {
+	AfterID int `json:"afterId"`
+}
+
+// handleIndexNoteItemsJob indexes the checklists of a batch of notes written before items
+// existed, then queues the next batch
+func handleIndexNoteItemsJob(ctx context.Context, _ *Job, p indexNoteItemsPayload) error {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM notes WHERE id > $1 ORDER BY id LIMIT $2", p.AfterID, itemsIndexBatch)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := reindexNoteItems(ctx, id); err != nil {
+			return fmt.Errorf("indexing note %d: %w", id, err)
+		}
+	}
+	if len(ids) < itemsIndexBatch {
+		slog.InfoContext(ctx, "Indexed checklist items of existing notes")
+		return nil
+	}
+	_, err = enqueueJob(ctx, jobTypeIndexNoteItems, nil, indexNoteItemsPayload{AfterID: ids[len(ids)-1]})
+	return err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestParseChecklist(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []checklistEntry
+	}{
+		{name: "no items", content: "Groceries\n\nmilk, bread"},
+		{
+			name:    "markers and checks",
+			content: "Groceries\n- [ ] milk\n* [x] bread\n+ [X] eggs",
+			want: []checklistEntry{
+				{line: 1, prefix: "- ", item: ChecklistItem{Text: "milk", Position: 0}},
+				{line: 2, prefix: "* ", item: ChecklistItem{Text: "bread", Checked: true, Position: 1}},
+				{line: 3, prefix: "+ ", item: ChecklistItem{Text: "eggs", Checked: true, Position: 2}},
+			},
+		},
+		{
+			name:    "nested and windows line endings",
+			content: "- [ ] trip\r\n    - [x] tickets\r\n",
+			want: []checklistEntry{
+				{line: 0, prefix: "- ", item: ChecklistItem{Text: "trip", Position: 0}},
+				{line: 1, prefix: "    - ", item: ChecklistItem{Text: "tickets", Checked: true, Position: 1}},
+			},
+		},
+		{
+			name:    "due dates",
+			content: "- [ ] taxes due:2026-04-30\n- [ ] due:2026-02-30\n- [ ] talk about due:2026-05-01 later",
+			want: []checklistEntry{
+				{line: 0, prefix: "- ", item: ChecklistItem{Text: "taxes", Position: 0, DueDate: ptr("2026-04-30")}},
+				{line: 1, prefix: "- ", item: ChecklistItem{Text: "due:2026-02-30", Position: 1}},
+				{line: 2, prefix: "- ", item: ChecklistItem{Text: "talk about due:2026-05-01 later", Position: 2}},
+			},
+		},
+		{
+			name:    "code blocks are skipped",
+			content: "```\n- [ ] not an item\n```\n- [ ] item",
+			want: []checklistEntry{
+				{line: 3, prefix: "- ", item: ChecklistItem{Text: "item", Position: 0}},
+			},
+		},
+		{name: "not checklists", content: "-[ ] tight\n- [] empty\n- [y] other\n1. [ ] numbered"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseChecklist(tt.content); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseChecklist() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatChecklistLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		item   ChecklistItem
+		want   string
+	}{
+		{name: "open", prefix: "- ", item: ChecklistItem{Text: "milk"}, want: "- [ ] milk"},
+		{name: "checked", prefix: "  * ", item: ChecklistItem{Text: "bread", Checked: true}, want: "  * [x] bread"},
+		{name: "due date", prefix: "- ", item: ChecklistItem{Text: "taxes", DueDate: ptr("2026-04-30")}, want: "- [ ] taxes due:2026-04-30"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := formatChecklistLine(tt.prefix, tt.item)
+			if line != tt.want {
+				t.Fatalf("formatChecklistLine() = %q, want %q", line, tt.want)
+			}
+			// A formatted line parses back to the same item
+			entries := parseChecklist(line)
+			if len(entries) != 1 || entries[0].prefix != tt.prefix || !sameItem(entries[0].item, tt.item) {
+				t.Errorf("parseChecklist(%q) = %+v", line, entries)
+			}
+		})
+	}
+}
+
+func TestReplaceLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		index   int
+		want    string
+	}{
+		{name: "unix", content: "a\n- [ ] milk\nb", index: 1, want: "a\n- [x] milk\nb"},
+		{name: "windows", content: "a\r\n- [ ] milk\r\nb", index: 1, want: "a\r\n- [x] milk\r\nb"},
+		{name: "last line", content: "a\n- [ ] milk", index: 1, want: "a\n- [x] milk"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replaceLine(tt.content, tt.index, "- [x] milk"); got != tt.want {
+				t.Errorf("replaceLine() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchNoteItems(t *testing.T) {
+	old := []ChecklistItem{
+		{ID: 11, Text: "milk", Position: 0},
+		{ID: 12, Text: "bread", Position: 1},
+		{ID: 13, Text: "eggs", Position: 2},
+	}
+
+	tests := []struct {
+		name        string
+		content     string
+		wantIDs     []int64
+		wantRemoved []int64
+	}{
+		{name: "unchanged", content: "- [ ] milk\n- [ ] bread\n- [ ] eggs", wantIDs: []int64{11, 12, 13}},
+		{name: "toggled", content: "- [x] milk\n- [ ] bread\n- [x] eggs", wantIDs: []int64{11, 12, 13}},
+		{name: "reordered", content: "- [ ] eggs\n- [ ] milk\n- [ ] bread", wantIDs: []int64{13, 11, 12}},
+		{name: "edited in place", content: "- [ ] oat milk\n- [ ] bread\n- [ ] eggs", wantIDs: []int64{11, 12, 13}},
+		{name: "inserted", content: "- [ ] milk\n- [ ] butter\n- [ ] bread\n- [ ] eggs", wantIDs: []int64{11, 0, 12, 13}},
+		{name: "removed", content: "- [ ] milk\n- [ ] eggs", wantIDs: []int64{11, 13}, wantRemoved: []int64{12}},
+		{name: "due date added", content: "- [ ] milk due:2026-10-20\n- [ ] bread\n- [ ] eggs", wantIDs: []int64{11, 12, 13}},
+		{name: "cleared", content: "Groceries", wantRemoved: []int64{11, 12, 13}},
+		{
+			name:    "duplicates keep one id each",
+			content: "- [ ] milk\n- [ ] milk\n- [ ] bread\n- [ ] eggs",
+			wantIDs: []int64{11, 0, 12, 13},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := parseChecklist(tt.content)
+			removed := matchNoteItems(entries, old)
+
+			var ids, removedIDs []int64
+			for _, e := range entries {
+				ids = append(ids, e.item.ID)
+			}
+			for _, item := range removed {
+				removedIDs = append(removedIDs, item.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("IDs = %v, want %v", ids, tt.wantIDs)
+			}
+			if !reflect.DeepEqual(removedIDs, tt.wantRemoved) {
+				t.Errorf("removed = %v, want %v", removedIDs, tt.wantRemoved)
+			}
+		})
+	}
+}
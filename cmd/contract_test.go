@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gorilla/websocket"
+)
+
+// contract serves requests with the API router and checks each request and response
+// against the spec, so that the handlers and openapi.yaml can't drift apart
+type contract struct {
+	t       *testing.T
+	doc     *openapi3.T
+	spec    routers.Router
+	handler http.Handler
+	// covered holds the operations that served a request
+	covered map[string]bool
+}
+
+func newContract(t *testing.T) *contract {
+	t.Helper()
+	t.Setenv("TG_BOT_TOKEN", testBotToken)
+
+	doc, err := loadAPISpec(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newNoteServer(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter, err := newRateLimiter(newMemoryRateLimitStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRouter(doc, limiter, server, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &contract{t: t, doc: doc, spec: spec, handler: r, covered: map[string]bool{}}
+}
+
+// useMemoryBlobs keeps attachments in memory for the rest of the test
+func useMemoryBlobs(t *testing.T) {
+	t.Helper()
+	store, err := newMemoryBlobStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EnsureBucket(context.Background(), noteFilesBucket); err != nil {
+		t.Fatal(err)
+	}
+
+	prevBlobs, prevLinks := blobs, blobLinks
+	blobs, blobLinks = store, store.urlSigner()
+	t.Cleanup(func() { blobs, blobLinks = prevBlobs, prevLinks })
+}
+
+// do serves the request and fails the test unless the operation is documented, the
+// request matches the spec, and the response has status want and matches the spec
+func (c *contract) do(req *http.Request, want int) *httptest.ResponseRecorder {
+	c.t.Helper()
+
+	route, pathParams, err := c.spec.FindRoute(req)
+	if err != nil {
+		c.t.Fatalf("%s %s is not in the API spec: %v", req.Method, req.URL.Path, err)
+	}
+
+	// The request body is read for validation and again by the handler
+	var body []byte
+	if req.Body != nil {
+		if body, err = io.ReadAll(req.Body); err != nil {
+			c.t.Fatal(err)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	input := &openapi3filter.RequestValidationInput{
+		Request:    req,
+		PathParams: pathParams,
+		Route:      route,
+		Options: &openapi3filter.Options{
+			AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			ExcludeRequestBody: isMultipart(req),
+		},
+	}
+	if err := openapi3filter.ValidateRequest(req.Context(), input); err != nil {
+		c.t.Fatalf("%s: request does not match the API spec: %v", route.Operation.OperationID, err)
+	}
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	rec := httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, req)
+	c.covered[route.Operation.OperationID] = true
+
+	if rec.Code != want {
+		c.t.Fatalf("%s: got status %d, want %d: %s", route.Operation.OperationID, rec.Code, want, rec.Body.String())
+	}
+
+	// Only JSON bodies are checked against their schema, files and streams are not
+	mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	err = openapi3filter.ValidateResponse(req.Context(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 rec.Code,
+		Header:                 rec.Header(),
+		Body:                   io.NopCloser(bytes.NewReader(rec.Body.Bytes())),
+		Options: &openapi3filter.Options{
+			IncludeResponseStatus: true,
+			ExcludeResponseBody:   mediaType != "application/json",
+		},
+	})
+	if err != nil {
+		c.t.Fatalf("%s: response does not match the API spec: %v", route.Operation.OperationID, err)
+	}
+	return rec
+}
+
+// sampleBodies are valid request bodies of the operations that need one
+var sampleBodies = map[string]string{
+	"createNote":      `{"title": "Groceries", "content": "- [ ] milk\n- [x] bread"}`,
+	"updateNote":      `{"title": "Groceries", "content": "- [ ] milk\n- [x] bread\n- [ ] eggs"}`,
+	"togglePinNote":   `{"isPinned": true}`,
+	"lockNote":        `{"isLocked": false, "content": "- [ ] milk"}`,
+	"patchNoteItem":   `{"checked": true}`,
+	"deleteFile":      `{"attachmentId": 1}`,
+	"setReminder":     `{"remindAt": "2030-01-01T09:00:00Z", "recurrence": "daily"}`,
+	"shareNote":       `{"userId": 1, "role": "viewer"}`,
+	"createShareLink": `{"password": "open sesame", "maxViews": 5}`,
+	"createTemplate":  `{"name": "Standup", "title": "Standup {{date}}", "content": "- [ ] yesterday"}`,
+	"updateTemplate":  `{"name": "Standup", "title": "Standup {{weekday}}", "content": "- [ ] today"}`,
+	"syncNotes":       `{"cursor": 0, "changes": []}`,
+	"updateSettings":  `{"timezone": "Europe/Berlin"}`,
+}
+
+// sampleRequest builds a request of the operation that matches the spec
+func sampleRequest(t *testing.T, operationID, method, path string) *http.Request {
+	t.Helper()
+	switch operationID {
+	case "uploadFile":
+		return multipartRequest(t, path, map[string]string{}, "receipt.txt", "paid")
+	case "createImport":
+		return multipartRequest(t, path, map[string]string{"source": "zip"}, "notes.zip", "not a zip")
+	case "viewSharedNoteWithPassword":
+		req := httptest.NewRequest(method, path, strings.NewReader("password=open+sesame"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+
+	body, ok := sampleBodies[operationID]
+	if !ok {
+		return httptest.NewRequest(method, path, nil)
+	}
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// multipartRequest posts a form with the given fields and a file in the "file" field
+func multipartRequest(t *testing.T, path string, fields map[string]string, fileName, data string) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, value := range fields {
+		if err := mw.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw, err := mw.CreateFormFile("file", fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(fw, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", path, &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// operations returns the IDs of the operations in the spec matching keep
+func (c *contract) operations(keep func(*openapi3.Operation) bool) []string {
+	var ids []string
+	for _, item := range c.doc.Paths.Map() {
+		for _, op := range item.Operations() {
+			if keep(op) {
+				ids = append(ids, op.OperationID)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// requireCoverage fails the test unless every operation of the spec served a request
+func (c *contract) requireCoverage() {
+	c.t.Helper()
+	for _, id := range c.operations(func(*openapi3.Operation) bool { return true }) {
+		if !c.covered[id] {
+			c.t.Errorf("%s was not exercised", id)
+		}
+	}
+}
+
+func TestAPIOperationsMatchSpec(t *testing.T) {
+	c := newContract(t)
+
+	got := map[string]apiOperation{}
+	for _, op := range apiOperations(&noteServer{}) {
+		got[op.operationID] = op
+	}
+	for path, item := range c.doc.Paths.Map() {
+		for method, op := range item.Operations() {
+			served, ok := got[op.OperationID]
+			if !ok {
+				t.Errorf("%s has no handler, run go generate", op.OperationID)
+				continue
+			}
+			if served.method != method || served.path != path {
+				t.Errorf("%s is served at %s %s, documented at %s %s, run go generate",
+					op.OperationID, served.method, served.path, method, path)
+			}
+			delete(got, op.OperationID)
+		}
+	}
+	for id := range got {
+		t.Errorf("%s is served but not documented, run go generate", id)
+	}
+}
+
+// TestContractWithoutDatabase runs what needs no database: the public operations that
+// don't read notes, and every authenticated operation without init data
+func TestContractWithoutDatabase(t *testing.T) {
+	c := newContract(t)
+	useMemoryBlobs(t)
+
+	// Nothing listens on port 1, so the readiness check finds Postgres down
+	unreachable, err := sql.Open("postgres", "host=127.0.0.1 port=1 connect_timeout=1 sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevDB := db
+	db = unreachable
+	t.Cleanup(func() {
+		db = prevDB
+		_ = unreachable.Close()
+	})
+
+	c.do(httptest.NewRequest("GET", "/healthz", nil), http.StatusOK)
+	c.do(httptest.NewRequest("GET", "/readyz", nil), http.StatusServiceUnavailable)
+	c.do(httptest.NewRequest("GET", apiPrefix+"/openapi.json", nil), http.StatusOK)
+
+	ctx := context.Background()
+	if err := blobs.Put(ctx, noteFilesBucket, "1/receipt.txt", strings.NewReader("paid"), 4); err != nil {
+		t.Fatal(err)
+	}
+	link, err := blobs.URL(ctx, noteFilesBucket, "1/receipt.txt", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := c.do(httptest.NewRequest("GET", link, nil), http.StatusOK); rec.Body.String() != "paid" {
+		t.Errorf("downloadBlob returned %q, want %q", rec.Body.String(), "paid")
+	}
+	c.do(httptest.NewRequest("HEAD", link, nil), http.StatusOK)
+	forged := strings.Replace(link, "signature=", "signature=0", 1)
+	c.do(httptest.NewRequest("GET", forged, nil), http.StatusForbidden)
+	c.do(httptest.NewRequest("HEAD", forged, nil), http.StatusForbidden)
+
+	// The path parameters are valid, the handlers never run
+	params := strings.NewReplacer("{id}", "1", "{itemId}", "1", "{userId}", "1", "{linkId}", "1")
+	for path, item := range c.doc.Paths.Map() {
+		for method, op := range item.Operations() {
+			if op.Security != nil && len(*op.Security) == 0 {
+				continue
+			}
+			t.Run(op.OperationID, func(t *testing.T) {
+				c.t = t
+				c.do(sampleRequest(t, op.OperationID, method, params.Replace(path)), http.StatusUnauthorized)
+			})
+		}
+	}
+	c.t = t
+}
+
+// authorize signs fresh init data of the user into the request
+func authorize(req *http.Request, userID int) *http.Request {
+	values := url.Values{
+		"auth_date": {strconv.FormatInt(time.Now().Unix(), 10)},
+		"user":      {fmt.Sprintf(`{"id":%d,"first_name":"Test"}`, userID)},
+	}
+	req.Header.Set("Authorization", authScheme+signInitData(values, testBotToken))
+	return req
+}
+
+// decodeBody decodes the JSON body of a response
+func decodeBody[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decoding %s: %v", rec.Body.String(), err)
+	}
+	return v
+}
+
+// TestContractWithDatabase exercises every operation of the spec against the Postgres
+// database in TEST_PG_DSN, which it migrates. It is skipped without one.
+func TestContractWithDatabase(t *testing.T) {
+	dsn := os.Getenv("TEST_PG_DSN")
+	if dsn == "" {
+		t.Skip("TEST_PG_DSN is not set")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	testDB, err := openDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevDB := db
+	db = testDB
+	t.Cleanup(func() {
+		db = prevDB
+		_ = testDB.Close()
+	})
+	if err := migrateOnStartup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := listenNoteEvents(ctx, dsn); err != nil {
+		t.Fatal(err)
+	}
+	useMemoryBlobs(t)
+	c := newContract(t)
+
+	const owner, friend = 279058397, 279058398
+	as := func(userID int, operationID, method, path string) *http.Request {
+		return authorize(sampleRequest(t, operationID, method, path), userID)
+	}
+
+	c.do(httptest.NewRequest("GET", "/healthz", nil), http.StatusOK)
+	c.do(httptest.NewRequest("GET", "/readyz", nil), http.StatusOK)
+	c.do(httptest.NewRequest("GET", apiPrefix+"/openapi.json", nil), http.StatusOK)
+
+	// Settings, templates are expanded in the saved timezone
+	c.do(as(owner, "getSettings", "GET", apiPrefix+"/settings"), http.StatusOK)
+	c.do(as(owner, "updateSettings", "PUT", apiPrefix+"/settings"), http.StatusOK)
+
+	// Templates
+	c.do(as(owner, "getTemplates", "GET", apiPrefix+"/templates"), http.StatusOK)
+	tmpl := decodeBody[Template](t, c.do(as(owner, "createTemplate", "POST", apiPrefix+"/templates"), http.StatusCreated))
+	tmplPath := fmt.Sprintf("%s/templates/%d", apiPrefix, tmpl.ID)
+	c.do(as(owner, "getTemplate", "GET", tmplPath), http.StatusOK)
+	c.do(as(owner, "updateTemplate", "PUT", tmplPath), http.StatusOK)
+	fromTemplate := fmt.Sprintf("%s/notes?templateId=%d&timezone=Europe%%2FBerlin", apiPrefix, tmpl.ID)
+	c.do(as(owner, "createNote", "POST", fromTemplate), http.StatusCreated)
+	c.do(as(owner, "createNote", "POST", fmt.Sprintf("%s/notes?templateId=%d", apiPrefix, tmpl.ID)), http.StatusCreated)
+	c.do(as(owner, "deleteTemplate", "DELETE", tmplPath), http.StatusNoContent)
+	c.do(as(owner, "getTemplate", "GET", tmplPath), http.StatusNotFound)
+
+	// Notes and their checklist
+	note := decodeBody[Note](t, c.do(as(owner, "createNote", "POST", apiPrefix+"/notes"), http.StatusCreated))
+	notePath := fmt.Sprintf("%s/notes/%d", apiPrefix, note.ID)
+	c.do(as(owner, "getNotes", "GET", apiPrefix+"/notes"), http.StatusOK)
+	c.do(as(owner, "getNoteByID", "GET", notePath), http.StatusOK)
+	note = decodeBody[Note](t, c.do(as(owner, "updateNote", "PUT", notePath), http.StatusOK))
+	if len(note.Items) == 0 {
+		t.Fatalf("updated note has no checklist items: %+v", note)
+	}
+	c.do(as(owner, "patchNoteItem", "PATCH", fmt.Sprintf("%s/items/%d", notePath, note.Items[0].ID)), http.StatusOK)
+	c.do(as(owner, "getOpenTasks", "GET", apiPrefix+"/tasks"), http.StatusOK)
+	c.do(as(owner, "togglePinNote", "PUT", notePath+"/toggle-pin"), http.StatusOK)
+	c.do(as(owner, "setReminder", "PUT", notePath+"/reminder"), http.StatusOK)
+	c.do(as(owner, "lockNote", "PUT", notePath+"/lock"), http.StatusOK)
+	c.do(as(friend, "getNoteByID", "GET", notePath), http.StatusNotFound)
+
+	// Attachments
+	file := decodeBody[File](t, c.do(as(owner, "uploadFile", "POST", notePath+"/upload-file"), http.StatusCreated))
+	c.do(httptest.NewRequest("GET", file.URL, nil), http.StatusOK)
+	c.do(httptest.NewRequest("HEAD", file.URL, nil), http.StatusOK)
+	deleteFile := authorize(httptest.NewRequest("DELETE", notePath+"/delete-file",
+		strings.NewReader(fmt.Sprintf(`{"attachmentId": %d}`, file.ID))), owner)
+	deleteFile.Header.Set("Content-Type", "application/json")
+	c.do(deleteFile, http.StatusNoContent)
+
+	// Sharing with a user
+	share := authorize(httptest.NewRequest("POST", notePath+"/shares",
+		strings.NewReader(fmt.Sprintf(`{"userId": %d, "role": "editor"}`, friend))), owner)
+	share.Header.Set("Content-Type", "application/json")
+	c.do(share, http.StatusCreated)
+	c.do(as(owner, "getNoteShares", "GET", notePath+"/shares"), http.StatusOK)
+	c.do(as(friend, "getNotes", "GET", apiPrefix+"/notes?shared=true"), http.StatusOK)
+	c.do(as(friend, "deleteNote", "DELETE", notePath), http.StatusForbidden)
+	c.do(as(owner, "revokeShare", "DELETE", fmt.Sprintf("%s/shares/%d", notePath, friend)), http.StatusNoContent)
+
+	// Share links
+	link := decodeBody[ShareLink](t, c.do(as(owner, "createShareLink", "POST", notePath+"/links"), http.StatusCreated))
+	c.do(as(owner, "getShareLinks", "GET", notePath+"/links"), http.StatusOK)
+	c.do(sampleRequest(t, "viewSharedNote", "GET", "/s/"+link.Token), http.StatusUnauthorized)
+	c.do(sampleRequest(t, "viewSharedNoteWithPassword", "POST", "/s/"+link.Token), http.StatusOK)
+	c.do(as(owner, "revokeShareLink", "DELETE", fmt.Sprintf("%s/links/%d", notePath, link.ID)), http.StatusNoContent)
+	c.do(sampleRequest(t, "viewSharedNote", "GET", "/s/"+link.Token), http.StatusNotFound)
+
+	// Sync, export and import
+	c.do(as(owner, "syncNotes", "POST", apiPrefix+"/sync"), http.StatusOK)
+	if rec := c.do(as(owner, "exportNotes", "GET", apiPrefix+"/export"), http.StatusOK); rec.Header().Get("Content-Type") != "application/zip" {
+		t.Errorf("exportNotes Content-Type = %q, want application/zip", rec.Header().Get("Content-Type"))
+	}
+	imp := decodeBody[Import](t, c.do(as(owner, "createImport", "POST", apiPrefix+"/import"), http.StatusAccepted))
+	c.do(as(owner, "getImport", "GET", fmt.Sprintf("%s/imports/%d", apiPrefix, imp.ID)), http.StatusOK)
+	if imp.JobID == nil {
+		t.Fatalf("import %d has no job", imp.ID)
+	}
+	c.do(as(owner, "getJob", "GET", fmt.Sprintf("%s/jobs/%d", apiPrefix, *imp.JobID)), http.StatusOK)
+	c.do(as(friend, "getJob", "GET", fmt.Sprintf("%s/jobs/%d", apiPrefix, *imp.JobID)), http.StatusNotFound)
+
+	// Events, the stream ends with the request
+	streamCtx, stopStream := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer stopStream()
+	events := as(owner, "streamEvents", "GET", apiPrefix+"/events").WithContext(streamCtx)
+	if rec := c.do(events, http.StatusOK); !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/event-stream") {
+		t.Errorf("streamEvents Content-Type = %q, want text/event-stream", rec.Header().Get("Content-Type"))
+	}
+	c.doWebSocket(owner)
+
+	c.do(as(owner, "deleteNote", "DELETE", notePath), http.StatusNoContent)
+	c.do(as(owner, "getNoteByID", "GET", notePath), http.StatusNotFound)
+
+	c.requireCoverage()
+}
+
+// doWebSocket opens the events WebSocket with init data in the query, which a recorder
+// can't do, and checks the request and the 101 response against the spec
+func (c *contract) doWebSocket(userID int) {
+	c.t.Helper()
+	srv := httptest.NewServer(c.handler)
+	defer srv.Close()
+
+	initData := authorize(httptest.NewRequest("GET", "/", nil), userID).Header.Get("Authorization")
+	path := apiPrefix + "/events/ws?initData=" + url.QueryEscape(strings.TrimPrefix(initData, authScheme))
+
+	req := httptest.NewRequest("GET", path, nil)
+	route, pathParams, err := c.spec.FindRoute(req)
+	if err != nil {
+		c.t.Fatalf("GET %s is not in the API spec: %v", path, err)
+	}
+	input := &openapi3filter.RequestValidationInput{
+		Request:    req,
+		PathParams: pathParams,
+		Route:      route,
+		Options:    &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc},
+	}
+	if err := openapi3filter.ValidateRequest(req.Context(), input); err != nil {
+		c.t.Fatalf("%s: request does not match the API spec: %v", route.Operation.OperationID, err)
+	}
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+path, nil)
+	if err != nil {
+		c.t.Fatalf("%s: %v", route.Operation.OperationID, err)
+	}
+	_ = conn.Close()
+	c.covered[route.Operation.OperationID] = true
+
+	err = openapi3filter.ValidateResponse(req.Context(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 resp.StatusCode,
+		Header:                 resp.Header,
+		Body:                   io.NopCloser(strings.NewReader("")),
+		Options: &openapi3filter.Options{
+			IncludeResponseStatus: true,
+			ExcludeResponseBody:   true,
+		},
+	})
+	if err != nil {
+		c.t.Fatalf("%s: response does not match the API spec: %v", route.Operation.OperationID, err)
+	}
+}
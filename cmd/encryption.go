@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Notes and attachments are encrypted with envelope encryption. Every user gets a random
+// data key, stored in data_keys wrapped by a master key from ENCRYPTION_KEYS. Encrypted rows
+// record the data key that sealed them in data_key_id, so rotating a master key only
+// re-wraps the data keys and never touches the notes. Rows without a data key are plaintext,
+// either written before encryption was turned on or while it is off.
+
+const (
+	dataKeySize = 32
+
+	// Attachments are sealed in chunks, so they stream without being held in memory
+	fileChunkSize   = 64 << 10
+	fileNonceSize   = 8
+	fileOverhead    = 16
+	sealedChunkSize = fileChunkSize + fileOverhead
+)
+
+var (
+	// masterKeys is nil when encryption is off
+	masterKeys *keyring
+	dataKeys   = &dataKeyCache{byID: map[int64]*dataKey{}, byUser: map[int]*dataKey{}}
+
+	errEncryptionOff = errors.New("data is encrypted but ENCRYPTION_KEYS is not set")
+)
+
+// keyring holds the master keys. New data keys are wrapped by the current one,
+// the others are kept to unwrap data keys until they are rotated.
+type keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// loadKeyring reads the master keys from ENCRYPTION_KEYS, a comma-separated list of
+// <id>:<base64 of 32 bytes>. ENCRYPTION_KEY_ID picks the current key, the first one by default.
+// It returns nil when ENCRYPTION_KEYS is not set.
+func loadKeyring() (*keyring, error) {
+	v := os.Getenv("ENCRYPTION_KEYS")
+	if v == "" {
+		return nil, nil
+	}
+
+	kr := &keyring{keys: map[string]cipher.AEAD{}}
+	for _, entry := range strings.Split(v, ",") {
+		id, encoded, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found || id == "" {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS: want <id>:<base64 key>, got %q", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != dataKeySize {
+			return nil, fmt.Errorf("ENCRYPTION_KEYS: key %q must be %d bytes of base64", id, dataKeySize)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[id] = aead
+		if kr.current == "" {
+			kr.current = id
+		}
+	}
+
+	if id := os.Getenv("ENCRYPTION_KEY_ID"); id != "" {
+		if _, ok := kr.keys[id]; !ok {
+			return nil, fmt.Errorf("ENCRYPTION_KEY_ID %q is not in ENCRYPTION_KEYS", id)
+		}
+		kr.current = id
+	}
+	return kr, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrap encrypts a data key with the current master key
+func (kr *keyring) wrap(userID int, key []byte) (string, []byte, error) {
+	sealed, err := seal(kr.keys[kr.current], key, dataKeyAAD(userID))
+	return kr.current, sealed, err
+}
+
+// unwrap decrypts a data key wrapped by the master key masterKeyID
+func (kr *keyring) unwrap(masterKeyID string, userID int, wrapped []byte) ([]byte, error) {
+	aead, ok := kr.keys[masterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %q is not in ENCRYPTION_KEYS", masterKeyID)
+	}
+	return open(aead, wrapped, dataKeyAAD(userID))
+}
+
+// A wrapped key only unwraps for the user it was made for
+func dataKeyAAD(userID int) []byte {
+	return []byte(fmt.Sprintf("data key of user %d", userID))
+}
+
+// seal encrypts with a random nonce in front of the ciphertext
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+}
+
+// dataKey - represent the unwrapped data key of a user
+type dataKey struct {
+	id     int64
+	userID int
+	aead   cipher.AEAD
+}
+
+// dataKeyCache keeps unwrapped data keys, they never change once created
+type dataKeyCache struct {
+	mu     sync.RWMutex
+	byID   map[int64]*dataKey
+	byUser map[int]*dataKey
+}
+
+func (c *dataKeyCache) add(k *dataKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byID[k.id] = k
+	c.byUser[k.userID] = k
+}
+
+// userDataKey returns the data key of the user, creating it on first use.
+// It returns nil when encryption is off.
+func userDataKey(ctx context.Context, userID int) (*dataKey, error) {
+	if masterKeys == nil {
+		return nil, nil
+	}
+	dataKeys.mu.RLock()
+	k := dataKeys.byUser[userID]
+	dataKeys.mu.RUnlock()
+	if k != nil {
+		return k, nil
+	}
+
+	k, err := loadDataKey(ctx, "user_id", userID)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return k, err
+	}
+
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	masterKeyID, wrapped, err := masterKeys.wrap(userID, key)
+	if err != nil {
+		return nil, err
+	}
+	// Two requests may create the key at once, the loser uses the winner's key
+	_, err = db.ExecContext(ctx,
+		"INSERT INTO data_keys (user_id, master_key_id, wrapped_key) VALUES ($1, $2, $3) ON CONFLICT (user_id) DO NOTHING",
+		userID, masterKeyID, wrapped,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return loadDataKey(ctx, "user_id", userID)
+}
+
+// dataKeyByID returns the data key that sealed a row
+func dataKeyByID(ctx context.Context, id int64) (*dataKey, error) {
+	dataKeys.mu.RLock()
+	k := dataKeys.byID[id]
+	dataKeys.mu.RUnlock()
+	if k != nil {
+		return k, nil
+	}
+	if masterKeys == nil {
+		return nil, errEncryptionOff
+	}
+	return loadDataKey(ctx, "id", id)
+}
+
+func loadDataKey(ctx context.Context, column string, value any) (*dataKey, error) {
+	k := &dataKey{}
+	var masterKeyID string
+	var wrapped []byte
+	err := db.QueryRowContext(ctx,
+		"SELECT id, user_id, master_key_id, wrapped_key FROM data_keys WHERE "+column+" = $1", value,
+	).Scan(&k.id, &k.userID, &masterKeyID, &wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := masterKeys.unwrap(masterKeyID, k.userID, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key %d: %w", k.id, err)
+	}
+	if k.aead, err = newAEAD(key); err != nil {
+		return nil, err
+	}
+	dataKeys.add(k)
+	return k, nil
+}
+
+// noteDataKey returns the data key of the note's owner, nil when encryption is off.
+// Shared notes stay sealed with the owner's key whoever edits them.
+func noteDataKey(ctx context.Context, noteID int) (*dataKey, error) {
+	if masterKeys == nil {
+		return nil, nil
+	}
+	var ownerID int
+	if err := db.QueryRowContext(ctx, "SELECT user_id FROM notes WHERE id = $1", noteID).Scan(&ownerID); err != nil {
+		return nil, err
+	}
+	return userDataKey(ctx, ownerID)
+}
+
+// rowFieldPrefix marks fields sealed with their row ID authenticated. Fields sealed before
+// only authenticate their column, encrypt-notes seals them again.
+const rowFieldPrefix = "v2:"
+
+// fieldAAD authenticates the column and row of a sealed field
+func fieldAAD(column string, rowID int64) []byte {
+	return []byte(fmt.Sprintf("%s %d", column, rowID))
+}
+
+// sealField encrypts a text column of row rowID. The column name and row ID are
+// authenticated, so a sealed title can't be passed off as content or moved to another note.
+func (k *dataKey) sealField(column string, rowID int64, plaintext string) (string, error) {
+	sealed, err := seal(k.aead, []byte(plaintext), fieldAAD(column, rowID))
+	if err != nil {
+		return "", err
+	}
+	return rowFieldPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (k *dataKey) openField(column string, rowID int64, value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, rowFieldPrefix)
+	aad := fieldAAD(column, rowID)
+	if !ok {
+		aad = []byte(column)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("decoding %s: %w", column, err)
+	}
+	plaintext, err := open(k.aead, sealed, aad)
+	if err != nil {
+		return "", fmt.Errorf("decrypting %s: %w", column, err)
+	}
+	return string(plaintext), nil
+}
+
+// nextRowID reserves the ID of a row about to be inserted into table, so its fields can
+// be sealed with it
+func nextRowID(ctx context.Context, q querier, table string) (int64, error) {
+	var id int64
+	err := q.QueryRowContext(ctx, "SELECT nextval(pg_get_serial_sequence($1, 'id'))", table).Scan(&id)
+	return id, err
+}
+
+// sealNoteText encrypts the title and content of note noteID with k and returns them with
+// the ID to store in data_key_id. A nil key leaves them as they are.
+func sealNoteText(k *dataKey, noteID int, title, content string) (string, string, *int64, error) {
+	if k == nil {
+		return title, content, nil, nil
+	}
+	sealedTitle, err := k.sealField("notes.title", int64(noteID), title)
+	if err != nil {
+		return "", "", nil, err
+	}
+	sealedContent, err := k.sealField("notes.content", int64(noteID), content)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return sealedTitle, sealedContent, &k.id, nil
+}
+
+// openNote decrypts the title and content of a note read with the data key keyID
+func openNote(ctx context.Context, n *Note, keyID *int64) error {
+	if keyID == nil {
+		return nil
+	}
+	k, err := dataKeyByID(ctx, *keyID)
+	if err != nil {
+		return fmt.Errorf("note %d: %w", n.ID, err)
+	}
+	if n.Title, err = k.openField("notes.title", int64(n.ID), n.Title); err != nil {
+		return fmt.Errorf("note %d: %w", n.ID, err)
+	}
+	if n.Content, err = k.openField("notes.content", int64(n.ID), n.Content); err != nil {
+		return fmt.Errorf("note %d: %w", n.ID, err)
+	}
+	return nil
+}
+
+// Sealed attachments start with a random nonce prefix, followed by chunks of up to
+// fileChunkSize bytes, each sealed with the prefix and the chunk number as nonce. The
+// object name and whether the chunk is the last one are authenticated, so chunks can't
+// be moved between objects, reordered or cut off.
+
+// sealedSize returns the stored size of an attachment of size bytes
+func sealedSize(size int64) int64 {
+	chunks := (size + fileChunkSize - 1) / fileChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return fileNonceSize + size + chunks*fileOverhead
+}
+
+// openedSize returns the size of an attachment stored in sealed bytes
+func openedSize(sealed int64) int64 {
+	body := sealed - fileNonceSize
+	full, rest := body/sealedChunkSize, body%sealedChunkSize
+	if rest == 0 {
+		return full * fileChunkSize
+	}
+	return full*fileChunkSize + rest - fileOverhead
+}
+
+func chunkAAD(object string, final bool) []byte {
+	flag := byte(0)
+	if final {
+		flag = 1
+	}
+	return append([]byte(object), flag)
+}
+
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[fileNonceSize:], counter)
+	return nonce
+}
+
+// chunkReader reads a stream chunk by chunk, reading one byte ahead to tell the last chunk
+type chunkReader struct {
+	src     io.Reader
+	ahead   []byte
+	size    int
+	out     []byte
+	done    bool
+	counter uint32
+}
+
+// next returns the next chunk of up to size bytes and whether it is the last one
+func (c *chunkReader) next() ([]byte, bool, error) {
+	chunk := make([]byte, c.size+1)
+	n := copy(chunk, c.ahead)
+	m, err := io.ReadFull(c.src, chunk[n:])
+	n += m
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		c.ahead = nil
+		return chunk[:n], true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	c.ahead = chunk[c.size:]
+	return chunk[:c.size], false, nil
+}
+
+func (c *chunkReader) read(p []byte, fill func() error) (int, error) {
+	for len(c.out) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+type sealingReader struct {
+	chunkReader
+	aead   cipher.AEAD
+	object string
+	prefix []byte
+}
+
+// sealReader encrypts an attachment stored as object while it is read
+func (k *dataKey) sealReader(r io.Reader, object string) (io.Reader, error) {
+	prefix := make([]byte, fileNonceSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	s := &sealingReader{chunkReader: chunkReader{src: r, size: fileChunkSize}, aead: k.aead, object: object, prefix: prefix}
+	s.out = append([]byte(nil), prefix...)
+	return s, nil
+}
+
+func (s *sealingReader) Read(p []byte) (int, error) {
+	return s.read(p, func() error {
+		chunk, final, err := s.next()
+		if err != nil {
+			return err
+		}
+		s.out = s.aead.Seal(nil, chunkNonce(s.prefix, s.counter), chunk, chunkAAD(s.object, final))
+		s.counter++
+		s.done = final
+		return nil
+	})
+}
+
+type openingReader struct {
+	chunkReader
+	aead   cipher.AEAD
+	object string
+	prefix []byte
+}
+
+// openReader decrypts an attachment stored as object while it is read
+func (k *dataKey) openReader(r io.Reader, object string) io.Reader {
+	return &openingReader{chunkReader: chunkReader{src: r, size: sealedChunkSize}, aead: k.aead, object: object}
+}
+
+func (o *openingReader) Read(p []byte) (int, error) {
+	return o.read(p, func() error {
+		if o.prefix == nil {
+			o.prefix = make([]byte, fileNonceSize)
+			if _, err := io.ReadFull(o.src, o.prefix); err != nil {
+				return fmt.Errorf("reading nonce of %s: %w", o.object, err)
+			}
+		}
+		chunk, final, err := o.next()
+		if err != nil {
+			return err
+		}
+		plaintext, err := o.aead.Open(nil, chunkNonce(o.prefix, o.counter), chunk, chunkAAD(o.object, final))
+		if err != nil {
+			return fmt.Errorf("decrypting chunk %d of %s: %w", o.counter, o.object, err)
+		}
+		o.out = plaintext
+		o.counter++
+		o.done = final
+		return nil
+	})
+}
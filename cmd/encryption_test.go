@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newTestDataKey(t *testing.T) *dataKey {
+	t.Helper()
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dataKey{id: 1, userID: 279058397, aead: aead}
+}
+
+func sealBytes(t *testing.T, k *dataKey, data []byte, object string) []byte {
+	t.Helper()
+	r, err := k.sealReader(bytes.NewReader(data), object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+func TestSealReader(t *testing.T) {
+	k := newTestDataKey(t)
+
+	for _, size := range []int{0, 1, fileChunkSize - 1, fileChunkSize, fileChunkSize + 1, 3*fileChunkSize + 5} {
+		data := make([]byte, size)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+
+		sealed := sealBytes(t, k, data, "1/receipt.pdf")
+		if int64(len(sealed)) != sealedSize(int64(size)) {
+			t.Errorf("size %d: sealed %d bytes, sealedSize() = %d", size, len(sealed), sealedSize(int64(size)))
+		}
+		if got := openedSize(int64(len(sealed))); got != int64(size) {
+			t.Errorf("size %d: openedSize() = %d", size, got)
+		}
+
+		opened, err := io.ReadAll(k.openReader(bytes.NewReader(sealed), "1/receipt.pdf"))
+		if err != nil {
+			t.Fatalf("size %d: openReader() error = %v", size, err)
+		}
+		if !bytes.Equal(opened, data) {
+			t.Errorf("size %d: opened data differs", size)
+		}
+	}
+}
+
+func TestOpenReaderRejectsTampering(t *testing.T) {
+	k := newTestDataKey(t)
+	data := make([]byte, 3*fileChunkSize+5)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	sealed := sealBytes(t, k, data, "1/receipt.pdf")
+	chunk := func(i int) []byte {
+		start := fileNonceSize + i*sealedChunkSize
+		return sealed[start:min(start+sealedChunkSize, len(sealed))]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	prefix := sealed[:fileNonceSize]
+
+	flipped := bytes.Clone(sealed)
+	flipped[fileNonceSize+10] ^= 1
+
+	tests := []struct {
+		name   string
+		sealed []byte
+		object string
+	}{
+		{name: "last chunk cut off", sealed: join(prefix, chunk(0), chunk(1), chunk(2))},
+		{name: "cut inside a chunk", sealed: sealed[:len(sealed)-3]},
+		{name: "chunks reordered", sealed: join(prefix, chunk(1), chunk(0), chunk(2), chunk(3))},
+		{name: "chunk repeated", sealed: join(prefix, chunk(0), chunk(0), chunk(1), chunk(2), chunk(3))},
+		{name: "data appended", sealed: join(sealed, chunk(3))},
+		{name: "other object", sealed: sealed, object: "2/receipt.pdf"},
+		{name: "bit flipped", sealed: flipped},
+		{name: "nonce only", sealed: prefix},
+		{name: "empty", sealed: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			object := tt.object
+			if object == "" {
+				object = "1/receipt.pdf"
+			}
+			if _, err := io.ReadAll(k.openReader(bytes.NewReader(tt.sealed), object)); err == nil {
+				t.Error("openReader() accepted tampered data")
+			}
+		})
+	}
+}
+
+func TestSealField(t *testing.T) {
+	k := newTestDataKey(t)
+	sealed, err := k.sealField("notes.title", 7, "Groceries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fields sealed before the row ID was authenticated only authenticate the column
+	legacy, err := seal(k.aead, []byte("Groceries"), []byte("notes.title"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacySealed := base64.StdEncoding.EncodeToString(legacy)
+
+	tests := []struct {
+		name    string
+		key     *dataKey
+		column  string
+		rowID   int64
+		value   string
+		wantErr bool
+	}{
+		{name: "round trip", key: k, column: "notes.title", rowID: 7, value: sealed},
+		{name: "other column", key: k, column: "notes.content", rowID: 7, value: sealed, wantErr: true},
+		{name: "other row", key: k, column: "notes.title", rowID: 8, value: sealed, wantErr: true},
+		{name: "other key", key: newTestDataKey(t), column: "notes.title", rowID: 7, value: sealed, wantErr: true},
+		{name: "prefix removed", key: k, column: "notes.title", rowID: 7, value: strings.TrimPrefix(sealed, rowFieldPrefix), wantErr: true},
+		{name: "legacy", key: k, column: "notes.title", rowID: 7, value: legacySealed},
+		{name: "legacy other column", key: k, column: "notes.content", rowID: 7, value: legacySealed, wantErr: true},
+		{name: "legacy with prefix added", key: k, column: "notes.title", rowID: 7, value: rowFieldPrefix + legacySealed, wantErr: true},
+		{name: "not base64", key: k, column: "notes.title", rowID: 7, value: "Groceries", wantErr: true},
+		{name: "too short", key: k, column: "notes.title", rowID: 7, value: "AAAA", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.key.openField(tt.column, tt.rowID, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("openField() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != "Groceries" {
+				t.Errorf("openField() = %q, want %q", got, "Groceries")
+			}
+		})
+	}
+}
+
+func TestLoadBlobLinks(t *testing.T) {
+	tests := []struct {
+		name       string
+		encryption bool
+		secret     string
+		wantErr    bool
+	}{
+		{name: "plaintext without secret"},
+		{name: "plaintext with secret", secret: "s3cret"},
+		{name: "encrypted with secret", encryption: true, secret: "s3cret"},
+		{name: "encrypted without secret", encryption: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("STORAGE_URL_SECRET", tt.secret)
+			prev := masterKeys
+			t.Cleanup(func() { masterKeys = prev })
+			masterKeys = nil
+			if tt.encryption {
+				masterKeys = &keyring{}
+			}
+
+			signer, err := loadBlobLinks()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadBlobLinks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			link, err := url.Parse(signer.url(noteFilesBucket, "1/receipt.pdf", nil, noteFileURLTTL))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.secret != "" && !newBlobURLSigner([]byte(tt.secret)).verify(noteFilesBucket, "1/receipt.pdf", link.Query()) {
+				t.Errorf("link %q is not signed with STORAGE_URL_SECRET", link)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Default limit of JSON request bodies, a note at the content limit fits well within it
+const maxJSONBodySize = 2 << 20
+
+// Error codes returned to API clients
+const (
+	codeInvalidJSON       = "invalid_json"
+	codeInvalidID         = "invalid_id"
+	codeInvalidRequest    = "invalid_request"
+	codeValidationFailed  = "validation_failed"
+	codePayloadTooLarge   = "payload_too_large"
+	codeUnauthorized      = "unauthorized"
+	codeForbidden         = "forbidden"
+	codeNoteNotFound      = "note_not_found"
+	codeNoteLocked        = "note_locked"
+	codeFileNotFound      = "file_not_found"
+	codeItemNotFound      = "item_not_found"
+	codeShareNotFound     = "share_not_found"
+	codeShareLinkNotFound = "share_link_not_found"
+	codeTemplateNotFound  = "template_not_found"
+	codeImportNotFound    = "import_not_found"
+	codeJobNotFound       = "job_not_found"
+	codeConflict          = "conflict"
+	codeRateLimited       = "rate_limited"
+	codeInternal          = "internal_error"
+)
+
+// APIError - represent an error returned to API clients as {"error": {...}}
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// FieldError - represent a payload field that failed validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func newAPIError(status int, code, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+func notFoundError(code, message string) *APIError {
+	return newAPIError(http.StatusNotFound, code, message)
+}
+
+// validationError reports invalid payload fields with 422
+func validationError(fields ...FieldError) *APIError {
+	return &APIError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    codeValidationFailed,
+		Message: "Request validation failed",
+		Details: fields,
+	}
+}
+
+// writeError writes err as a JSON error envelope. Errors that are not API errors are
+// reported without their message, which may hold database or storage details, so
+// handlers log them first.
+func writeError(w http.ResponseWriter, err error) {
+	apiErr := toAPIError(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.Status)
+	body := struct {
+		Error *APIError `json:"error"`
+	}{apiErr}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("Error encoding error response", "error", err)
+	}
+}
+
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newAPIError(http.StatusRequestEntityTooLarge, codePayloadTooLarge,
+			fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit))
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Name() {
+		case "unique_violation", "foreign_key_violation", "serialization_failure":
+			return newAPIError(http.StatusConflict, codeConflict, "The request conflicts with the current state, retry it")
+		case "string_data_right_truncation", "check_violation", "not_null_violation":
+			return newAPIError(http.StatusUnprocessableEntity, codeValidationFailed, "Request validation failed")
+		case "invalid_text_representation":
+			return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid value in request")
+		}
+	}
+
+	return newAPIError(http.StatusInternalServerError, codeInternal, "Internal server error")
+}
+
+// decodeJSON decodes a request body of at most maxJSONBodySize into v
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodySize)).Decode(v); err != nil {
+		return invalidJSON(err)
+	}
+	return nil
+}
+
+// invalidJSON reports a body that failed to decode with 400, or 413 when it is too large
+func invalidJSON(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return err
+	}
+	return newAPIError(http.StatusBadRequest, codeInvalidJSON, "Invalid JSON body: "+err.Error())
+}
+
+// invalidForm reports a multipart form that failed to parse with 400, or 413 when it is too large
+func invalidForm(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return err
+	}
+	return newAPIError(http.StatusBadRequest, codeInvalidRequest, "Invalid form: "+err.Error())
+}
+
+// pathID returns a numeric route variable, like the note ID of /notes/{id}
+func pathID(r *http.Request, name string) (int, error) {
+	v := mux.Vars(r)[name]
+	id, err := strconv.Atoi(v)
+	if err != nil || id <= 0 {
+		return 0, &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    codeInvalidID,
+			Message: fmt.Sprintf("Invalid %s %q, expected a positive integer", name, v),
+		}
+	}
+	return id, nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+)
+
+const (
+	noteEventsChannel = "note_events"
+
+	eventHeartbeatInterval = 25 * time.Second
+	eventSubscriberBuffer  = 32
+	wsWriteTimeout         = 10 * time.Second
+	wsPongTimeout          = 60 * time.Second
+)
+
+// Note event types
+const (
+	eventNoteCreated       = "created"
+	eventNoteUpdated       = "updated"
+	eventNoteDeleted       = "deleted"
+	eventNotePinned        = "pinned"
+	eventAttachmentChanged = "attachment-changed"
+)
+
+// NoteEvent - represent a change of a note pushed to clients
+type NoteEvent struct {
+	Type    string    `json:"type"`
+	NoteID  int       `json:"noteId"`
+	Version int64     `json:"version"`
+	ActorID int       `json:"actorId"`
+	At      time.Time `json:"at"`
+}
+
+// noteNotification is the NOTIFY payload, it carries the users who may see the event
+type noteNotification struct {
+	NoteEvent
+	Audience []int `json:"audience"`
+}
+
+// eventHub fans out notifications received from Postgres to the subscribers of this instance
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[int]map[chan NoteEvent]struct{}
+
+	// done is closed when the server shuts down, streams end so that it can drain
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var events = &eventHub{
+	subscribers: make(map[int]map[chan NoteEvent]struct{}),
+	done:        make(chan struct{}),
+}
+
+// shutdown ends every stream, clients reconnect to another instance
+func (h *eventHub) shutdown() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+func (h *eventHub) subscribe(userID int) chan NoteEvent {
+	ch := make(chan NoteEvent, eventSubscriberBuffer)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[chan NoteEvent]struct{})
+	}
+	h.subscribers[userID][ch] = struct{}{}
+	return ch
+}
+
+func (h *eventHub) unsubscribe(userID int, ch chan NoteEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers[userID], ch)
+	if len(h.subscribers[userID]) == 0 {
+		delete(h.subscribers, userID)
+	}
+}
+
+func (h *eventHub) dispatch(n noteNotification) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, userID := range n.Audience {
+		for ch := range h.subscribers[userID] {
+			select {
+			case ch <- n.NoteEvent:
+			default:
+				// Slow consumer, drop the event rather than block everyone else
+				slog.Warn("Dropping event for slow subscriber", "type", n.Type, "note_id", n.NoteID, "recipient_id", userID)
+			}
+		}
+	}
+}
+
+// listenNoteEvents receives note events from every server instance through LISTEN/NOTIFY
+func listenNoteEvents(ctx context.Context, dsn string) error {
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.Warn("Note events listener error", "event", ev, "error", err)
+		}
+	})
+	if err := listener.Listen(noteEventsChannel); err != nil {
+		_ = listener.Close()
+		return err
+	}
+
+	go func() {
+		defer func() { _ = listener.Close() }()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case notification := <-listener.Notify:
+				// nil is sent after the connection has been re-established
+				if notification == nil {
+					continue
+				}
+				var n noteNotification
+				if err := json.Unmarshal([]byte(notification.Extra), &n); err != nil {
+					slog.Error("Error decoding note event notification", "error", err)
+					continue
+				}
+				events.dispatch(n)
+			}
+		}
+	}()
+	return nil
+}
+
+// noteAudience returns the owner of a note and the users it is shared with
+func noteAudience(ctx context.Context, noteID any) ([]int, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT user_id FROM notes WHERE id = $1
+		UNION
+		SELECT grantee_user_id FROM note_shares WHERE note_id = $1`, noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var audience []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		audience = append(audience, userID)
+	}
+	return audience, rows.Err()
+}
+
+// publishNoteEvent notifies everyone who can see the note. A nil audience is looked up,
+// callers deleting a note must collect it beforehand. Failures are only logged, the
+// change itself has already been made.
+func publishNoteEvent(ctx context.Context, eventType string, noteID int, version int64, actorID int, audience []int) {
+	// The change is made, publish it even if the client has gone away
+	ctx = context.WithoutCancel(ctx)
+	if audience == nil {
+		var err error
+		if audience, err = noteAudience(ctx, noteID); err != nil {
+			slog.Error("Error looking up note audience", "note_id", noteID, "error", err)
+			return
+		}
+	}
+
+	payload, err := json.Marshal(noteNotification{
+		NoteEvent: NoteEvent{Type: eventType, NoteID: noteID, Version: version, ActorID: actorID, At: time.Now()},
+		Audience:  audience,
+	})
+	if err != nil {
+		slog.Error("Error encoding note event", "type", eventType, "note_id", noteID, "error", err)
+		return
+	}
+
+	if _, err := db.ExecContext(ctx, "SELECT pg_notify($1, $2)", noteEventsChannel, string(payload)); err != nil {
+		slog.Error("Error publishing note event", "type", eventType, "note_id", noteID, "error", err)
+	}
+}
+
+// bumpNoteVersion increments the version of a note after a change outside the notes row
+func bumpNoteVersion(ctx context.Context, noteID any) (int64, error) {
+	var version int64
+	err := db.QueryRowContext(ctx, "UPDATE notes SET version = version + 1 WHERE id = $1 RETURNING version", noteID).Scan(&version)
+	return version, err
+}
+
+// Stream note events of the authenticated user as Server-Sent Events
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r.Context())
+
+	// Streams outlive the server write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		slog.ErrorContext(r.Context(), "Streaming is not supported", "error", err)
+		writeError(w, newAPIError(http.StatusInternalServerError, codeInternal, "Streaming unsupported"))
+		return
+	}
+
+	ch := events.subscribe(userID)
+	defer events.unsubscribe(userID, ch)
+	slog.InfoContext(r.Context(), "Subscribed to events", "transport", "sse")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprint(w, "retry: 5000\n\n")
+	_ = rc.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			slog.InfoContext(r.Context(), "Unsubscribed from events", "transport", "sse")
+			return
+		case <-events.done:
+			return
+		case <-heartbeat.C:
+			_, err := fmt.Fprint(w, ": ping\n\n")
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		case ev := <-ch:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error encoding event", "error", err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			if err == nil {
+				err = rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Clients authenticate with init data rather than cookies, so cross-origin
+// WebSocket connections can't ride on someone else's session
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// Stream note events of the authenticated user over a WebSocket
+func streamEventsWS(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r.Context())
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Error upgrading connection", "error", err)
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	ch := events.subscribe(userID)
+	defer events.unsubscribe(userID, ch)
+	slog.InfoContext(r.Context(), "Subscribed to events", "transport", "websocket")
+
+	// The read loop only handles control frames and notices when the client goes away
+	closed := make(chan struct{})
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-closed:
+			slog.InfoContext(r.Context(), "Unsubscribed from events", "transport", "websocket")
+			return
+		case <-events.done:
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+			_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout))
+			return
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		case ev := <-ch:
+			_ = conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteJSON(ev); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const exportFormatVersion = 1
+
+var unsafeFileNameChars = regexp.MustCompile(`[^\p{L}\p{N}._-]+`)
+
+// ExportManifest - represent the manifest.json of an export archive
+type ExportManifest struct {
+	Version    int                  `json:"version"`
+	ExportedAt time.Time            `json:"exportedAt"`
+	UserID     int                  `json:"userId"`
+	Notes      []ExportManifestNote `json:"notes"`
+}
+
+// ExportManifestNote - represent a note in the export manifest
+type ExportManifestNote struct {
+	ID           int                        `json:"id"`
+	Title        string                     `json:"title"`
+	Path         string                     `json:"path"`
+	LastModified time.Time                  `json:"lastModified"`
+	Attachments  []ExportManifestAttachment `json:"attachments"`
+	// Locked notes can't be rendered as Markdown, their file holds the ciphertext
+	// and encryption metadata as JSON
+	Locked bool `json:"locked,omitempty"`
+}
+
+// ExportManifestAttachment - represent an attachment in the export manifest
+type ExportManifestAttachment struct {
+	ID       int    `json:"id"`
+	FileName string `json:"filename"`
+	Path     string `json:"path"`
+	Size     int    `json:"size"`
+	// Missing is set when the file is gone from storage
+	Missing bool `json:"missing,omitempty"`
+	// Encryption is set for attachments of locked notes, which are exported encrypted
+	Encryption *FileEncryption `json:"encryption,omitempty"`
+}
+
+// Export all notes of the user with their attachments as a ZIP archive
+func exportNotes(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r.Context())
+	slog.InfoContext(r.Context(), "Exporting notes")
+
+	// Large exports outlive the server write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		slog.WarnContext(r.Context(), "Error clearing write deadline", "error", err)
+	}
+
+	// The archive is produced in a goroutine and streamed as it is written,
+	// so it is never held in memory
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeExport(r.Context(), pw, userID))
+	}()
+	defer func() { _ = pr.Close() }()
+
+	filename := fmt.Sprintf("notes-%s.zip", time.Now().Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("Cache-Control", "no-store")
+
+	n, err := io.Copy(w, pr)
+	if err != nil {
+		// Headers are already sent, all we can do is cut the archive short
+		slog.ErrorContext(r.Context(), "Error streaming export", "bytes", n, "error", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Exported notes", "bytes", n)
+}
+
+// writeExport writes the ZIP archive of all notes owned by the user
+func writeExport(ctx context.Context, out io.Writer, userID int) error {
+	rows, err := db.QueryContext(ctx, "SELECT "+noteColumns+" FROM notes WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		return err
+	}
+	var notes []Note
+	for rows.Next() {
+		n, err := scanNote(ctx, rows)
+		if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		notes = append(notes, n)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(out)
+	manifest := ExportManifest{
+		Version:    exportFormatVersion,
+		ExportedAt: time.Now().UTC(),
+		UserID:     userID,
+		Notes:      make([]ExportManifestNote, 0, len(notes)),
+	}
+
+	for _, n := range notes {
+		files, err := loadNoteFiles(ctx, n.ID)
+		if err != nil {
+			return err
+		}
+		entry, err := exportNote(ctx, zw, n, files)
+		if err != nil {
+			return err
+		}
+		manifest.Notes = append(manifest.Notes, entry)
+	}
+
+	mw, err := zw.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: manifest.ExportedAt})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// exportNote writes the Markdown file of a note and its attachments
+func exportNote(ctx context.Context, zw *zip.Writer, n Note, files []File) (ExportManifestNote, error) {
+	entry := ExportManifestNote{
+		ID:           n.ID,
+		Title:        n.Title,
+		Path:         fmt.Sprintf("notes/%d-%s.md", n.ID, safeFileName(n.Title, "note")),
+		LastModified: n.LastModified,
+		Attachments:  []ExportManifestAttachment{},
+		Locked:       n.IsLocked,
+	}
+	if n.IsLocked {
+		entry.Path = fmt.Sprintf("notes/%d-%s.locked.json", n.ID, safeFileName(n.Title, "note"))
+	}
+
+	nw, err := zw.CreateHeader(&zip.FileHeader{Name: entry.Path, Method: zip.Deflate, Modified: n.LastModified})
+	if err != nil {
+		return entry, err
+	}
+	if n.IsLocked {
+		err = writeLockedNote(nw, n)
+	} else {
+		_, err = io.WriteString(nw, noteMarkdown(n))
+	}
+	if err != nil {
+		return entry, err
+	}
+
+	for _, f := range files {
+		name := f.FileName
+		if f.Extension != "" {
+			name += "." + f.Extension
+		}
+		attachment := ExportManifestAttachment{
+			ID:         f.ID,
+			FileName:   name,
+			Path:       path.Join("attachments", fmt.Sprint(n.ID), fmt.Sprintf("%d-%s", f.ID, safeFileName(name, "file"))),
+			Size:       f.Size,
+			Encryption: f.Encryption,
+		}
+
+		found, err := exportAttachment(ctx, zw, attachment.Path, noteFileObjectName(n.ID, f.FileName, f.Extension), f.KeyID)
+		if err != nil {
+			return entry, err
+		}
+		attachment.Missing = !found
+		entry.Attachments = append(entry.Attachments, attachment)
+	}
+
+	return entry, nil
+}
+
+// exportAttachment copies an object from storage into the archive. It reports false
+// when the object doesn't exist, a broken attachment shouldn't fail the whole export.
+// Encrypted attachments are decrypted with the data key keyID.
+func exportAttachment(ctx context.Context, zw *zip.Writer, name, objectName string, keyID *int64) (bool, error) {
+	var key *dataKey
+	if keyID != nil {
+		var err error
+		if key, err = dataKeyByID(ctx, *keyID); err != nil {
+			return false, err
+		}
+	}
+
+	obj, info, err := blobs.Get(ctx, noteFilesBucket, objectName)
+	if errors.Is(err, errBlobNotFound) {
+		slog.WarnContext(ctx, "Attachment is missing from storage", "object", objectName)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = obj.Close() }()
+
+	// Attachments are mostly already compressed media, store them as is
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: info.ModTime})
+	if err != nil {
+		return false, err
+	}
+	var body io.Reader = obj
+	if key != nil {
+		body = key.openReader(obj, objectName)
+	}
+	if _, err := io.Copy(fw, body); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// writeLockedNote writes a locked note as the client stored it, for the client to decrypt
+func writeLockedNote(w io.Writer, n Note) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Title      string          `json:"title"`
+		Content    string          `json:"content"`
+		Encryption *NoteEncryption `json:"encryption"`
+	}{n.Title, n.Content, n.Encryption})
+}
+
+// noteMarkdown renders a note as Markdown with YAML front matter
+func noteMarkdown(n Note) string {
+	var b strings.Builder
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "id: %d\n", n.ID)
+	fmt.Fprintf(&b, "title: %s\n", yamlString(n.Title))
+	fmt.Fprintf(&b, "pinned: %t\n", n.IsPinned)
+	fmt.Fprintf(&b, "last_modified: %s\n", n.LastModified.UTC().Format(time.RFC3339))
+	// Notes have no tags yet, the key is kept so the format doesn't change when they do
+	b.WriteString("tags: []\n")
+	b.WriteString("---\n\n")
+	b.WriteString(n.Content)
+	if !strings.HasSuffix(n.Content, "\n") {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// yamlString quotes a string for YAML. JSON strings are valid YAML double-quoted scalars.
+func yamlString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// safeFileName turns arbitrary text into a portable file name
+func safeFileName(s, fallback string) string {
+	s = strings.Trim(unsafeFileNameChars.ReplaceAllString(s, "-"), "-.")
+	if r := []rune(s); len(r) > 60 {
+		s = strings.TrimRight(string(r[:60]), "-.")
+	}
+	if s == "" {
+		return fallback
+	}
+	return s
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/TG-Note-App/note-be/frontend"
+)
+
+const defaultFrontendDir = "./frontend/dist"
+
+// frontendFS returns the built frontend: embedded in the binary when built with the
+// embedfrontend tag, otherwise read from FRONTEND_DIR
+func frontendFS() (fs.FS, error) {
+	if frontend.Embedded {
+		slog.Info("Serving embedded frontend")
+		return fs.Sub(frontend.Dist, "dist")
+	}
+
+	dir := os.Getenv("FRONTEND_DIR")
+	if dir == "" {
+		dir = defaultFrontendDir
+	}
+	slog.Info("Serving frontend from disk", "dir", dir)
+	return os.DirFS(dir), nil
+}
+
+// frontendHandler serves the single-page app. Files are served as they are, any other
+// path gets index.html so client-side routes survive a refresh. Directories are never listed.
+func frontendHandler(fsys fs.FS) http.Handler {
+	files := http.FileServerFS(fsys)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		info, err := fs.Stat(fsys, name)
+		if name == "" || err != nil || info.IsDir() {
+			// A missing file, unlike a route, is a real 404
+			if path.Ext(name) != "" {
+				http.NotFound(w, r)
+				return
+			}
+			serveIndex(w, r, fsys)
+			return
+		}
+
+		// Vite puts content-hashed files in assets/, a new build changes their names
+		if strings.HasPrefix(name, "assets/") {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// serveIndex serves index.html, revalidated on every load so a deploy is picked up at once
+func serveIndex(w http.ResponseWriter, r *http.Request, fsys fs.FS) {
+	data, err := fs.ReadFile(fsys, "index.html")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error reading frontend index", "error", err)
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if _, err := w.Write(data); err != nil {
+		slog.WarnContext(r.Context(), "Error writing frontend index", "error", err)
+	}
+}
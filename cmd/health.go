@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const readinessTimeout = 2 * time.Second
+
+// shuttingDown is set once the server starts draining, so it stops reporting ready
+var shuttingDown atomic.Bool
+
+// Readiness - represent the result of the readiness checks
+type Readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Liveness probe: the process is up and serving requests
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(r.Context(), w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readiness probe: Postgres answers and the attachments bucket is reachable.
+// Failures are logged, the response only says which dependency is down.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	res := Readiness{Status: "ok", Checks: map[string]string{"postgres": "ok", "storage": "ok"}}
+	if shuttingDown.Load() {
+		res.Status = "shutting down"
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		slog.WarnContext(ctx, "Readiness check failed", "check", "postgres", "error", err)
+		res.Status = "unavailable"
+		res.Checks["postgres"] = "unavailable"
+	}
+
+	exists, err := blobs.BucketExists(ctx, noteFilesBucket)
+	switch {
+	case err != nil:
+		slog.WarnContext(ctx, "Readiness check failed", "check", "storage", "error", err)
+		res.Status = "unavailable"
+		res.Checks["storage"] = "unavailable"
+	case !exists:
+		slog.WarnContext(ctx, "Readiness check failed", "check", "storage", "bucket", noteFilesBucket)
+		res.Status = "unavailable"
+		res.Checks["storage"] = "bucket missing"
+	}
+
+	status := http.StatusOK
+	if res.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(ctx, w, status, res)
+}
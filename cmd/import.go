@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	importsBucket = "note-imports"
+	maxImportSize = 200 << 20
+	// Largest file of an import archive once unpacked, an attachment can't be larger anyway
+	maxImportEntrySize = maxUploadSize
+	// Largest note file of an import archive: a note at maxContentLength in any script or
+	// a locked note at maxLockedContentLength, with room for its front matter or metadata
+	maxImportNoteSize = max(4*maxContentLength, maxLockedContentLength) + 64<<10
+	// Most files and unpacked bytes an import archive may hold
+	maxImportEntries      = 10_000
+	maxImportUnpackedSize = 2 << 30
+)
+
+// Import sources, as detected from the uploaded file
+const (
+	importSourceZip  = "zip"
+	importSourceKeep = "keep"
+	importSourceEnex = "enex"
+)
+
+// Import statuses
+const (
+	importPending = "pending"
+	importRunning = "running"
+	importDone    = "done"
+	importFailed  = "failed"
+)
+
+// Import - represent an import of notes from an uploaded file
+type Import struct {
+	ID         int        `json:"id"`
+	Source     string     `json:"source"`
+	FileName   string     `json:"filename"`
+	Status     string     `json:"status"`
+	JobID      *int64     `json:"jobId"`
+	Total      int        `json:"total"`
+	Processed  int        `json:"processed"`
+	Created    int        `json:"created"`
+	Skipped    int        `json:"skipped"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+}
+
+// importedNote - represent a note read from an import file
+type importedNote struct {
+	// source and sourceID identify the note in its original app, they make imports idempotent
+	source       string
+	sourceID     string
+	title        string
+	content      string
+	isPinned     bool
+	lastModified time.Time
+	isLocked     bool
+	encryption   *NoteEncryption
+	attachments  []importedFile
+	// skipReason is set for notes that are counted but not imported, like ones too large to read
+	skipReason string
+}
+
+// importedFile - represent an attachment read from an import file, loaded on demand
+type importedFile struct {
+	name string
+	data func() ([]byte, error)
+	// encryption is set for attachments of locked notes, which stay encrypted
+	encryption *FileEncryption
+}
+
+func importObjectName(importID int) string {
+	return strconv.Itoa(importID)
+}
+
+// Upload a file to import notes from. The import runs in the background, its progress is reported by getImport.
+func createImport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := userIDFromContext(ctx)
+	slog.DebugContext(ctx, "Starting import")
+
+	extendUploadDeadlines(w, r)
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		slog.WarnContext(ctx, "Error parsing multipart form", "error", err)
+		writeError(w, invalidForm(err))
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		slog.WarnContext(ctx, "Error getting file from form", "error", err)
+		writeError(w, invalidForm(err))
+		return
+	}
+	defer func() { _ = file.Close() }()
+
+	source := r.FormValue("source")
+	if source == "" {
+		source = detectImportSource(header.Filename)
+	}
+	if source != importSourceZip && source != importSourceKeep && source != importSourceEnex {
+		writeError(w, validationError(FieldError{Field: "source", Message: "Unsupported import file, expected .zip, Google Keep .json or Evernote .enex"}))
+		return
+	}
+
+	imp := Import{Source: source, FileName: header.Filename, Status: importPending}
+	err = db.QueryRowContext(ctx,
+		"INSERT INTO imports (user_id, source, file_name) VALUES ($1, $2, $3) RETURNING id, created_at",
+		userID, source, header.Filename,
+	).Scan(&imp.ID, &imp.CreatedAt)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error saving import", "error", err)
+		writeError(w, err)
+		return
+	}
+
+	// Keep the upload in storage so any server instance can process it
+	if err := blobs.EnsureBucket(ctx, importsBucket); err != nil {
+		slog.ErrorContext(ctx, "Error preparing imports bucket", "error", err)
+		writeError(w, err)
+		return
+	}
+	if err := blobs.Put(ctx, importsBucket, importObjectName(imp.ID), file, header.Size); err != nil {
+		slog.ErrorContext(ctx, "Error uploading import file", "import_id", imp.ID, "error", err)
+		failImport(ctx, imp.ID, err)
+		writeError(w, err)
+		return
+	}
+
+	jobID, err := enqueueJob(ctx, jobTypeImport, &userID, importJobPayload{ImportID: imp.ID})
+	if err == nil {
+		imp.JobID = &jobID
+		_, err = db.ExecContext(ctx, "UPDATE imports SET job_id = $1 WHERE id = $2", jobID, imp.ID)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error queueing import job", "import_id", imp.ID, "error", err)
+		failImport(ctx, imp.ID, err)
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf(apiPrefix+"/imports/%d", imp.ID))
+	writeJSON(ctx, w, http.StatusAccepted, imp)
+	slog.InfoContext(ctx, "Queued import", "import_id", imp.ID, "source", source, "filename", header.Filename)
+}
+
+// Get the progress of an import
+func getImport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	userID := userIDFromContext(ctx)
+
+	var imp Import
+	err = db.QueryRowContext(ctx, `
+		SELECT id, source, file_name, status, job_id, total, processed, created, skipped, error, created_at, started_at, finished_at
+		FROM imports WHERE id = $1 AND user_id = $2`, id, userID,
+	).Scan(&imp.ID, &imp.Source, &imp.FileName, &imp.Status, &imp.JobID, &imp.Total, &imp.Processed, &imp.Created, &imp.Skipped,
+		&imp.Error, &imp.CreatedAt, &imp.StartedAt, &imp.FinishedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, notFoundError(codeImportNotFound, "Import not found"))
+			return
+		}
+		slog.ErrorContext(ctx, "Error querying import", "import_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(ctx, w, http.StatusOK, imp)
+}
+
+func detectImportSource(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".zip":
+		return importSourceZip
+	case ".json":
+		return importSourceKeep
+	case ".enex":
+		return importSourceEnex
+	}
+	return ""
+}
+
+func failImport(ctx context.Context, importID int, cause error) {
+	_, err := db.ExecContext(context.WithoutCancel(ctx),
+		"UPDATE imports SET status = $1, error = $2, finished_at = now() WHERE id = $3",
+		importFailed, cause.Error(), importID,
+	)
+	if err != nil {
+		slog.Error("Error marking import as failed", "import_id", importID, "error", err)
+	}
+}
+
+// importJobPayload - represent the payload of an import job
+type importJobPayload struct {
+	ImportID int `json:"importId"`
+}
+
+// handleImportJob processes an uploaded import file. Notes imported by a failed attempt
+// are skipped on retry and a partly imported one is resumed, so the import is only marked
+// failed on the last one.
+func handleImportJob(ctx context.Context, job *Job, p importJobPayload) error {
+	err := processImport(ctx, p.ImportID)
+	if err == nil {
+		slog.InfoContext(ctx, "Import finished", "import_id", p.ImportID)
+		return nil
+	}
+
+	if job.Attempts >= job.MaxAttempts {
+		failImport(ctx, p.ImportID, err)
+	} else if _, dbErr := db.ExecContext(ctx, "UPDATE imports SET status = $1, error = $2 WHERE id = $3", importPending, err.Error(), p.ImportID); dbErr != nil {
+		slog.ErrorContext(ctx, "Error recording import failure", "import_id", p.ImportID, "error", dbErr)
+	}
+	return err
+}
+
+func processImport(ctx context.Context, importID int) error {
+	var userID int
+	var source string
+	err := db.QueryRowContext(ctx,
+		"UPDATE imports SET status = $1, error = '', started_at = COALESCE(started_at, now()) WHERE id = $2 RETURNING user_id, source",
+		importRunning, importID,
+	).Scan(&userID, &source)
+	if err != nil {
+		return err
+	}
+
+	// Archives need random access, so the upload is copied to a temporary file
+	tmp, err := os.CreateTemp("", "note-import-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	obj, _, err := blobs.Get(ctx, importsBucket, importObjectName(importID))
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(tmp, obj)
+	_ = obj.Close()
+	if err != nil {
+		return fmt.Errorf("downloading import file: %w", err)
+	}
+
+	notes, err := parseImport(source, tmp, size)
+	if err != nil {
+		return fmt.Errorf("reading import file: %w", err)
+	}
+
+	if _, err := db.ExecContext(ctx, "UPDATE imports SET total = $1 WHERE id = $2", len(notes), importID); err != nil {
+		return err
+	}
+
+	var created, skipped int
+	for i, n := range notes {
+		isNew, err := importNote(ctx, userID, n)
+		if err != nil {
+			return fmt.Errorf("importing %q: %w", n.title, err)
+		}
+		if isNew {
+			created++
+		} else {
+			skipped++
+		}
+
+		_, err = db.ExecContext(ctx,
+			"UPDATE imports SET processed = $1, created = $2, skipped = $3 WHERE id = $4",
+			i+1, created, skipped, importID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, "UPDATE imports SET status = $1, finished_at = now() WHERE id = $2", importDone, importID); err != nil {
+		return err
+	}
+
+	if err := blobs.Remove(ctx, importsBucket, importObjectName(importID)); err != nil {
+		slog.WarnContext(ctx, "Error removing import file", "import_id", importID, "error", err)
+	}
+	return nil
+}
+
+// importNote creates a note and its attachments unless the same source note was imported before.
+// It reports whether a note was created. The note is recorded as imported before its
+// attachments are saved and marked complete after the last one, so a retry after a failed
+// attachment resumes the note instead of skipping it or importing it twice.
+func importNote(ctx context.Context, userID int, in importedNote) (bool, error) {
+	if reason := importSkipReason(in); reason != "" {
+		slog.InfoContext(ctx, "Skipping imported note", "title", in.title, "reason", reason)
+		return false, nil
+	}
+
+	var noteID int
+	var complete bool
+	err := db.QueryRowContext(ctx,
+		"SELECT note_id, complete FROM import_sources WHERE user_id = $1 AND source = $2 AND source_id = $3",
+		userID, in.source, in.sourceID,
+	).Scan(&noteID, &complete)
+	switch {
+	case err == nil && complete:
+		return false, nil
+	case err == sql.ErrNoRows:
+		var created bool
+		if noteID, created, err = insertImportedNote(ctx, userID, in); err != nil || !created {
+			return false, err
+		}
+		indexNoteItems(ctx, noteID)
+	case err != nil:
+		return false, err
+	}
+
+	// Attachments are saved in order and each one is committed on its own,
+	// so the ones already on the note came from an earlier attempt
+	var saved int
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM note_files WHERE note_id = $1", noteID).Scan(&saved); err != nil {
+		return false, err
+	}
+	for _, f := range in.attachments[min(saved, len(in.attachments)):] {
+		data, err := f.data()
+		if err != nil {
+			return false, fmt.Errorf("reading attachment %s: %w", f.name, err)
+		}
+		if _, err := saveNoteFile(ctx, noteID, f.name, bytes.NewReader(data), int64(len(data)), f.encryption); err != nil {
+			return false, err
+		}
+	}
+
+	var version int64
+	err = db.QueryRowContext(ctx, `
+		UPDATE import_sources SET complete = true WHERE user_id = $1 AND source = $2 AND source_id = $3
+		RETURNING (SELECT version FROM notes WHERE id = $4)`,
+		userID, in.source, in.sourceID, noteID,
+	).Scan(&version)
+	if err != nil {
+		return false, err
+	}
+
+	publishNoteEvent(ctx, eventNoteCreated, noteID, version, userID, []int{userID})
+	return true, nil
+}
+
+// importSkipReason tells why an imported note is counted as skipped instead of created.
+// Imported notes are held to the same limits as the ones clients send.
+func importSkipReason(in importedNote) string {
+	if in.skipReason != "" {
+		return in.skipReason
+	}
+	var apiErr *APIError
+	if err := validateNote(Note{Title: in.title, Content: in.content, IsLocked: in.isLocked, Encryption: in.encryption}); errors.As(err, &apiErr) {
+		var reasons []string
+		for _, f := range apiErr.Details.([]FieldError) {
+			reasons = append(reasons, f.Message)
+		}
+		return strings.Join(reasons, "; ")
+	}
+	return ""
+}
+
+// insertImportedNote creates the note of an import along with its import_sources row.
+// It reports false if a concurrent import of the same source note got there first.
+func insertImportedNote(ctx context.Context, userID int, in importedNote) (int, bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	noteID, _, err := insertNote(ctx, tx, Note{
+		UserID:       userID,
+		Title:        in.title,
+		Content:      in.content,
+		IsPinned:     in.isPinned,
+		LastModified: in.lastModified,
+		IsLocked:     in.isLocked,
+		Encryption:   in.encryption,
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO import_sources (user_id, source, source_id, note_id, complete) VALUES ($1, $2, $3, $4, false) ON CONFLICT DO NOTHING",
+		userID, in.source, in.sourceID, noteID,
+	)
+	if err != nil {
+		return 0, false, err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return 0, false, nil
+	}
+	return noteID, true, tx.Commit()
+}
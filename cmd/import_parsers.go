@@ -0,0 +1,465 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sources recorded for idempotency, one per original note format
+const (
+	noteSourceMarkdown = "markdown"
+	noteSourceKeep     = "keep"
+	noteSourceEnex     = "enex"
+)
+
+// parseImport reads the notes of an import file of the given source
+func parseImport(source string, r io.ReaderAt, size int64) ([]importedNote, error) {
+	switch source {
+	case importSourceZip:
+		return parseZipImport(r, size)
+	case importSourceKeep:
+		note, ok, err := parseKeepNote(io.NewSectionReader(r, 0, size), "", nil)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return []importedNote{note}, nil
+	case importSourceEnex:
+		return parseEnex(io.NewSectionReader(r, 0, size))
+	}
+	return nil, fmt.Errorf("unknown import source %q", source)
+}
+
+// contentSourceID derives a stable ID for notes whose format has none
+func contentSourceID(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// openZipFile opens an archive entry, refusing entries that unpack to more than
+// maxImportEntrySize so a small archive can't expand into gigabytes
+func openZipFile(f *zip.File) (io.ReadCloser, error) {
+	if f.UncompressedSize64 > maxImportEntrySize {
+		return nil, fmt.Errorf("%s: larger than %d bytes", f.Name, maxImportEntrySize)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	// The size in the header is not to be trusted, reads stop just past the limit
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, maxImportEntrySize+1), rc}, nil
+}
+
+func zipFileData(f *zip.File) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		rc, err := openZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = rc.Close() }()
+		data, err := io.ReadAll(rc)
+		if err == nil && len(data) > maxImportEntrySize {
+			err = fmt.Errorf("%s: larger than %d bytes", f.Name, maxImportEntrySize)
+		}
+		return data, err
+	}
+}
+
+// parseZipImport reads a ZIP of Markdown notes, like the ones produced by exportNotes,
+// and Google Keep notes from a Takeout archive
+func parseZipImport(r io.ReaderAt, size int64) ([]importedNote, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	// The declared sizes are enforced while reading, so the whole archive is checked up front
+	if len(zr.File) > maxImportEntries {
+		return nil, fmt.Errorf("more than %d files", maxImportEntries)
+	}
+	var unpacked uint64
+	for _, f := range zr.File {
+		if f.UncompressedSize64 > maxImportUnpackedSize-unpacked {
+			return nil, fmt.Errorf("larger than %d bytes once unpacked", maxImportUnpackedSize)
+		}
+		unpacked += f.UncompressedSize64
+	}
+
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	// Original attachment names, encryption metadata and the IDs of locked notes are only
+	// kept in the manifest of our own exports
+	attachments := make(map[string]ExportManifestAttachment)
+	manifestNotes := make(map[string]ExportManifestNote)
+	if f, ok := files["manifest.json"]; ok {
+		var manifest ExportManifest
+		data, err := zipFileData(f)()
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("manifest.json: %w", err)
+		}
+		for _, n := range manifest.Notes {
+			manifestNotes[n.Path] = n
+			for _, a := range n.Attachments {
+				attachments[a.Path] = a
+			}
+		}
+	}
+
+	var notes []importedNote
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		ext := strings.ToLower(path.Ext(f.Name))
+		if strings.HasSuffix(strings.ToLower(f.Name), lockedNoteSuffix) {
+			ext = lockedNoteSuffix
+		}
+		isNote := ext == ".md" || ext == ".markdown" || ext == lockedNoteSuffix || ext == ".json" && f.Name != "manifest.json"
+		if isNote && f.UncompressedSize64 > maxImportNoteSize {
+			base := path.Base(f.Name)
+			notes = append(notes, importedNote{
+				title:      base[:len(base)-len(ext)],
+				skipReason: fmt.Sprintf("larger than %d bytes", maxImportNoteSize),
+			})
+			continue
+		}
+
+		switch ext {
+		case ".md", ".markdown":
+			data, err := zipFileData(f)()
+			if err != nil {
+				return nil, err
+			}
+			note := parseMarkdownNote(f.Name, string(data))
+			note.attachments = markdownAttachments(zr.File, note.sourceID, attachments, false)
+			notes = append(notes, note)
+		case lockedNoteSuffix:
+			data, err := zipFileData(f)()
+			if err != nil {
+				return nil, err
+			}
+			entry, inManifest := manifestNotes[f.Name]
+			note := parseLockedNote(f.Name, data, entry, inManifest)
+			note.attachments = markdownAttachments(zr.File, note.sourceID, attachments, true)
+			notes = append(notes, note)
+		case ".json":
+			if f.Name == "manifest.json" {
+				continue
+			}
+			rc, err := openZipFile(f)
+			if err != nil {
+				return nil, err
+			}
+			// Archives may hold unrelated JSON files, only Keep notes are imported
+			note, ok, err := parseKeepNote(rc, path.Dir(f.Name), files)
+			_ = rc.Close()
+			if err == nil && ok {
+				notes = append(notes, note)
+			}
+		}
+	}
+	return notes, nil
+}
+
+// markdownAttachments returns the files exported under attachments/<note id>/. Attachments
+// of locked notes are only imported with their encryption metadata, and only for locked notes.
+func markdownAttachments(files []*zip.File, noteID string, manifest map[string]ExportManifestAttachment, locked bool) []importedFile {
+	if noteID == "" {
+		return nil
+	}
+
+	prefix := "attachments/" + noteID + "/"
+	var attachments []importedFile
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name, prefix) || f.FileInfo().IsDir() {
+			continue
+		}
+		a, ok := manifest[f.Name]
+		if !ok {
+			a.FileName = path.Base(f.Name)
+		}
+		if a.Encryption != nil && len(validateCipherParams("encryption", a.Encryption.Algorithm, a.Encryption.Nonce, a.Encryption.MAC)) > 0 {
+			a.Encryption = nil
+		}
+		if (a.Encryption != nil) != locked {
+			continue
+		}
+		attachments = append(attachments, importedFile{name: a.FileName, data: zipFileData(f), encryption: a.Encryption})
+	}
+	return attachments
+}
+
+// lockedNoteSuffix ends the file name of locked notes in our own exports
+const lockedNoteSuffix = ".locked.json"
+
+// parseLockedNote reads a locked note written by writeLockedNote. The content stays
+// encrypted for the client. The manifest entry gives the note ID, which its attachments
+// are exported under, so locked notes share the source of Markdown notes.
+func parseLockedNote(name string, data []byte, entry ExportManifestNote, inManifest bool) importedNote {
+	note := importedNote{
+		source:   noteSourceMarkdown,
+		title:    strings.TrimSuffix(path.Base(name), lockedNoteSuffix),
+		isLocked: true,
+	}
+
+	var locked struct {
+		Title      string          `json:"title"`
+		Content    string          `json:"content"`
+		Encryption *NoteEncryption `json:"encryption"`
+	}
+	if err := json.Unmarshal(data, &locked); err != nil {
+		note.skipReason = fmt.Sprintf("reading locked note: %v", err)
+		return note
+	}
+	note.title, note.content, note.encryption = locked.Title, locked.Content, locked.Encryption
+
+	note.sourceID = contentSourceID(note.title, note.content)
+	if inManifest {
+		note.sourceID = strconv.Itoa(entry.ID)
+		note.lastModified = entry.LastModified
+	}
+	return note
+}
+
+// parseMarkdownNote reads a Markdown file with optional YAML front matter
+func parseMarkdownNote(name, data string) importedNote {
+	note := importedNote{
+		source: noteSourceMarkdown,
+		title:  strings.TrimSuffix(path.Base(name), path.Ext(name)),
+	}
+
+	body := data
+	if rest, ok := strings.CutPrefix(data, "---\n"); ok {
+		if end := strings.Index(rest, "\n---\n"); end >= 0 {
+			applyFrontMatter(&note, rest[:end])
+			body = strings.TrimPrefix(rest[end+len("\n---\n"):], "\n")
+		}
+	}
+	note.content = strings.TrimSuffix(body, "\n")
+
+	if note.sourceID == "" {
+		note.sourceID = contentSourceID(note.title, note.content)
+	}
+	return note
+}
+
+// applyFrontMatter reads the keys written by noteMarkdown, anything else is ignored
+func applyFrontMatter(note *importedNote, frontMatter string) {
+	scanner := bufio.NewScanner(strings.NewReader(frontMatter))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = yamlScalar(value)
+
+		switch strings.TrimSpace(key) {
+		case "id":
+			note.sourceID = value
+		case "title":
+			note.title = value
+		case "pinned":
+			note.isPinned, _ = strconv.ParseBool(value)
+		case "last_modified":
+			if t, err := time.Parse(time.RFC3339, value); err == nil {
+				note.lastModified = t
+			}
+		}
+	}
+}
+
+// yamlScalar unquotes a single-line YAML scalar
+func yamlScalar(value string) string {
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(value, `"`):
+		var s string
+		if err := json.Unmarshal([]byte(value), &s); err == nil {
+			return s
+		}
+	case strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") && len(value) >= 2:
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	}
+	return value
+}
+
+// keepNote - represent a note in a Google Keep Takeout export
+type keepNote struct {
+	Title                   string `json:"title"`
+	TextContent             string `json:"textContent"`
+	IsPinned                bool   `json:"isPinned"`
+	IsTrashed               bool   `json:"isTrashed"`
+	UserEditedTimestampUsec int64  `json:"userEditedTimestampUsec"`
+	CreatedTimestampUsec    int64  `json:"createdTimestampUsec"`
+	ListContent             []struct {
+		Text      string `json:"text"`
+		IsChecked bool   `json:"isChecked"`
+	} `json:"listContent"`
+	Attachments []struct {
+		FilePath string `json:"filePath"`
+	} `json:"attachments"`
+}
+
+// parseKeepNote reads a Google Keep note. Attachments are looked up next to the note
+// in the archive, they are missing when a single JSON file is imported.
+// It reports false for JSON files that aren't Keep notes and for trashed notes.
+func parseKeepNote(r io.Reader, dir string, files map[string]*zip.File) (importedNote, bool, error) {
+	var kn keepNote
+	if err := json.NewDecoder(r).Decode(&kn); err != nil {
+		return importedNote{}, false, err
+	}
+	if kn.CreatedTimestampUsec == 0 || kn.IsTrashed {
+		return importedNote{}, false, nil
+	}
+
+	content := kn.TextContent
+	if len(kn.ListContent) > 0 {
+		var b strings.Builder
+		for _, item := range kn.ListContent {
+			mark := " "
+			if item.IsChecked {
+				mark = "x"
+			}
+			fmt.Fprintf(&b, "- [%s] %s\n", mark, item.Text)
+		}
+		content = strings.TrimSuffix(b.String(), "\n")
+	}
+
+	note := importedNote{
+		source:   noteSourceKeep,
+		sourceID: contentSourceID(strconv.FormatInt(kn.CreatedTimestampUsec, 10), kn.Title),
+		title:    kn.Title,
+		content:  content,
+		isPinned: kn.IsPinned,
+	}
+	if kn.UserEditedTimestampUsec != 0 {
+		note.lastModified = time.UnixMicro(kn.UserEditedTimestampUsec)
+	}
+	for _, a := range kn.Attachments {
+		if f, ok := files[path.Join(dir, a.FilePath)]; ok {
+			note.attachments = append(note.attachments, importedFile{name: a.FilePath, data: zipFileData(f)})
+		}
+	}
+	return note, true, nil
+}
+
+// enexNote - represent a note in an Evernote export
+type enexNote struct {
+	Title     string         `xml:"title"`
+	Content   string         `xml:"content"`
+	Created   string         `xml:"created"`
+	Updated   string         `xml:"updated"`
+	Resources []enexResource `xml:"resource"`
+}
+
+// enexResource - represent an attachment in an Evernote export
+type enexResource struct {
+	Data     string `xml:"data"`
+	Mime     string `xml:"mime"`
+	FileName string `xml:"resource-attributes>file-name"`
+}
+
+const enexTimeLayout = "20060102T150405Z"
+
+// parseEnex reads an Evernote ENEX export note by note
+func parseEnex(r io.Reader) ([]importedNote, error) {
+	dec := xml.NewDecoder(r)
+	// ENEX files declare a DOCTYPE and may contain HTML entities
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+
+	var notes []importedNote
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return notes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "note" {
+			continue
+		}
+		var en enexNote
+		if err := dec.DecodeElement(&en, &start); err != nil {
+			return nil, err
+		}
+		notes = append(notes, enexImportedNote(en))
+	}
+}
+
+func enexImportedNote(en enexNote) importedNote {
+	note := importedNote{
+		source:   noteSourceEnex,
+		sourceID: contentSourceID(en.Created, en.Title),
+		title:    en.Title,
+		content:  enmlToText(en.Content),
+	}
+	if t, err := time.Parse(enexTimeLayout, en.Updated); err == nil {
+		note.lastModified = t
+	} else if t, err := time.Parse(enexTimeLayout, en.Created); err == nil {
+		note.lastModified = t
+	}
+
+	for i, res := range en.Resources {
+		name := res.FileName
+		if name == "" {
+			name = fmt.Sprintf("attachment-%d", i+1)
+			if exts, _ := mime.ExtensionsByType(res.Mime); len(exts) > 0 {
+				name += exts[0]
+			}
+		}
+		data := res.Data
+		note.attachments = append(note.attachments, importedFile{
+			name: name,
+			data: func() ([]byte, error) {
+				return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+			},
+		})
+	}
+	return note
+}
+
+var (
+	enmlCheckedTodo = regexp.MustCompile(`(?i)<en-todo[^>]*checked="true"[^>]*/?>`)
+	enmlTodo        = regexp.MustCompile(`(?i)<en-todo[^>]*/?>`)
+	enmlLineBreak   = regexp.MustCompile(`(?i)<br\s*/?>|</(div|p|li|h[1-6]|tr)>`)
+	enmlTag         = regexp.MustCompile(`<[^>]*>`)
+	extraNewlines   = regexp.MustCompile(`\n{3,}`)
+)
+
+// enmlToText flattens Evernote markup to plain text, keeping to-dos as Markdown checkboxes
+func enmlToText(enml string) string {
+	s := enmlCheckedTodo.ReplaceAllString(enml, "- [x] ")
+	s = enmlTodo.ReplaceAllString(s, "- [ ] ")
+	s = enmlLineBreak.ReplaceAllString(s, "\n")
+	s = enmlTag.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = extraNewlines.ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// buildZip writes an archive with the given entries, each filled by its writer
+func buildZip(t *testing.T, entries map[string]func(io.Writer) error) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, write := range entries {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := write(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func writeString(s string) func(io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := io.WriteString(w, s)
+		return err
+	}
+}
+
+func TestParseZipImport(t *testing.T) {
+	r := buildZip(t, map[string]func(io.Writer) error{
+		"Groceries.md":               writeString("---\nid: \"42\"\ntitle: \"Groceries\"\npinned: true\n---\n\n- [ ] milk\n"),
+		"attachments/42/receipt.txt": writeString("paid"),
+		"notes.json":                 writeString(`{"unrelated": true}`),
+	})
+
+	notes, err := parseZipImport(r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 {
+		t.Fatalf("got %d notes, want 1", len(notes))
+	}
+	n := notes[0]
+	if n.sourceID != "42" || n.title != "Groceries" || !n.isPinned || n.content != "- [ ] milk" {
+		t.Errorf("got note %+v", n)
+	}
+	if len(n.attachments) != 1 || n.attachments[0].name != "receipt.txt" {
+		t.Fatalf("got attachments %+v", n.attachments)
+	}
+	data, err := n.attachments[0].data()
+	if err != nil || string(data) != "paid" {
+		t.Errorf("attachment data = %q, %v", data, err)
+	}
+}
+
+func TestParseZipImportRejectsOversizedEntries(t *testing.T) {
+	// Zeros compress to almost nothing, which is what makes a zip bomb
+	r := buildZip(t, map[string]func(io.Writer) error{
+		"Bomb.md": writeString("---\nid: \"42\"\n---\n"),
+		"attachments/42/bomb.bin": func(w io.Writer) error {
+			_, err := io.CopyN(w, zeroReader{}, maxImportEntrySize+1)
+			return err
+		},
+	})
+
+	notes, err := parseZipImport(r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 1 || len(notes[0].attachments) != 1 {
+		t.Fatalf("got notes %+v", notes)
+	}
+	if _, err := notes[0].attachments[0].data(); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Fatalf("attachment data() error = %v, want an entry size error", err)
+	}
+}
+
+// rawEntry is an archive entry whose header declares size bytes, whatever its data
+type rawEntry struct {
+	name string
+	size uint64
+}
+
+// buildRawZip writes an archive of small stored entries with the given declared sizes
+func buildRawZip(t *testing.T, entries []rawEntry) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.CreateRaw(&zip.FileHeader{
+			Name:               e.name,
+			Method:             zip.Store,
+			CompressedSize64:   1,
+			UncompressedSize64: e.size,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestParseZipImportLimits(t *testing.T) {
+	many := make([]rawEntry, maxImportEntries+1)
+	for i := range many {
+		many[i] = rawEntry{name: fmt.Sprintf("attachments/1/%d.txt", i), size: 1}
+	}
+
+	tests := []struct {
+		name    string
+		entries []rawEntry
+		wantErr string
+	}{
+		{name: "too many files", entries: many, wantErr: "more than"},
+		{
+			name: "too large once unpacked",
+			entries: []rawEntry{
+				{name: "attachments/1/a.bin", size: maxImportUnpackedSize / 2},
+				{name: "attachments/1/b.bin", size: maxImportUnpackedSize/2 + 1},
+			},
+			wantErr: "once unpacked",
+		},
+		{
+			name:    "size overflows",
+			entries: []rawEntry{{name: "attachments/1/a.bin", size: 1}, {name: "attachments/1/b.bin", size: math.MaxUint64}},
+			wantErr: "once unpacked",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := buildRawZip(t, tt.entries)
+			_, err := parseZipImport(r, r.Size())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("parseZipImport() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseZipImportSkipsOversizedNotes(t *testing.T) {
+	// The entries can't be read, so the notes must be skipped before reading them
+	r := buildRawZip(t, []rawEntry{
+		{name: "Huge.md", size: maxImportNoteSize + 1},
+		{name: "Keep/Huge.json", size: maxImportNoteSize + 1},
+	})
+	notes, err := parseZipImport(r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 {
+		t.Fatalf("got %d notes, want 2", len(notes))
+	}
+	for _, n := range notes {
+		if n.title != "Huge" || n.skipReason == "" {
+			t.Errorf("got note %+v, want a skipped note", n)
+		}
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestParseZipImportLockedNotes(t *testing.T) {
+	mac := lockedMACPrefix + base64.StdEncoding.EncodeToString(make([]byte, 32))
+	nonce := base64.StdEncoding.EncodeToString(make([]byte, 12))
+	locked := Note{
+		ID:      7,
+		Title:   "Diary",
+		Content: base64.StdEncoding.EncodeToString([]byte("ciphertext")),
+		Encryption: &NoteEncryption{
+			Version:   lockedEncryptionVersion,
+			Algorithm: lockedAlgAESGCM,
+			KDF:       NoteKDF{Name: lockedKDFPBKDF2, Iterations: minPBKDF2Iterations},
+			Salt:      base64.StdEncoding.EncodeToString(make([]byte, minLockedSaltSize)),
+			Nonce:     nonce,
+			MAC:       mac,
+		},
+	}
+	fileEncryption := &FileEncryption{Algorithm: lockedAlgAESGCM, Nonce: nonce, MAC: mac}
+	manifest, err := json.Marshal(ExportManifest{Notes: []ExportManifestNote{{
+		ID:     7,
+		Path:   "notes/7-Diary.locked.json",
+		Locked: true,
+		Attachments: []ExportManifestAttachment{
+			{Path: "attachments/7/1-photo.jpg", FileName: "photo.jpg", Encryption: fileEncryption},
+			{Path: "attachments/7/2-notes.txt", FileName: "notes.txt"},
+		},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := buildZip(t, map[string]func(io.Writer) error{
+		"manifest.json":              writeString(string(manifest)),
+		"notes/7-Diary.locked.json":  func(w io.Writer) error { return writeLockedNote(w, locked) },
+		"notes/8-Other.locked.json":  func(w io.Writer) error { return writeLockedNote(w, locked) },
+		"notes/9-Broken.locked.json": writeString("{"),
+		"attachments/7/1-photo.jpg":  writeString("sealed"),
+		// A plaintext file can't be an attachment of a locked note
+		"attachments/7/2-notes.txt": writeString("plain"),
+	})
+	notes, err := parseZipImport(r, r.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byKey := make(map[string]importedNote)
+	for _, n := range notes {
+		byKey[n.sourceID+" "+n.title] = n
+	}
+	if len(notes) != 3 {
+		t.Fatalf("got %d notes, want 3", len(notes))
+	}
+
+	n, ok := byKey["7 Diary"]
+	if !ok {
+		t.Fatalf("locked note from the manifest is missing from %+v", notes)
+	}
+	if !n.isLocked || n.content != locked.Content || !reflect.DeepEqual(n.encryption, locked.Encryption) {
+		t.Errorf("got note %+v", n)
+	}
+	if reason := importSkipReason(n); reason != "" {
+		t.Errorf("importSkipReason() = %q", reason)
+	}
+	if len(n.attachments) != 1 || n.attachments[0].name != "photo.jpg" || !reflect.DeepEqual(n.attachments[0].encryption, fileEncryption) {
+		t.Errorf("got attachments %+v", n.attachments)
+	}
+
+	// Without a manifest entry the note is identified by its content
+	other, ok := byKey[contentSourceID(locked.Title, locked.Content)+" Diary"]
+	if !ok || !other.isLocked || len(other.attachments) != 0 {
+		t.Errorf("got notes %+v, want the locked note outside the manifest", notes)
+	}
+
+	broken, ok := byKey[" 9-Broken"]
+	if !ok || broken.skipReason == "" {
+		t.Errorf("got notes %+v, want the broken locked note skipped", notes)
+	}
+}
+
+func TestImportSkipReason(t *testing.T) {
+	tests := []struct {
+		name     string
+		note     importedNote
+		wantSkip bool
+	}{
+		{name: "valid", note: importedNote{title: "Groceries", content: "- [ ] milk"}},
+		{name: "content only", note: importedNote{content: "milk"}},
+		{name: "marked by the parser", note: importedNote{title: "Huge", skipReason: "too large"}, wantSkip: true},
+		{name: "empty", note: importedNote{title: " ", content: "\n"}, wantSkip: true},
+		{name: "long title", note: importedNote{title: strings.Repeat("t", maxTitleLength+1)}, wantSkip: true},
+		{name: "long content", note: importedNote{title: "a", content: strings.Repeat("ж", maxContentLength+1)}, wantSkip: true},
+		{name: "content at the limit", note: importedNote{title: "a", content: strings.Repeat("ж", maxContentLength)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reason := importSkipReason(tt.note); (reason != "") != tt.wantSkip {
+				t.Errorf("importSkipReason() = %q, wantSkip %v", reason, tt.wantSkip)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	jobPollInterval   = time.Second
+	jobLease          = 10 * time.Minute
+	jobBaseBackoff    = 10 * time.Second
+	jobMaxBackoff     = time.Hour
+	jobDefaultWorkers = 2
+)
+
+// Job types
+const (
+	jobTypeImport         = "import"
+	jobTypePurgeBlobs     = "purge-blobs"
+	jobTypeIndexNoteItems = "index-note-items"
+)
+
+// Job statuses. A job that keeps failing ends up dead and is no longer retried.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobDead      = "dead"
+)
+
+// Job - represent a unit of background work
+type Job struct {
+	ID          int64           `json:"id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"-"`
+	UserID      *int            `json:"-"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"maxAttempts"`
+	RunAt       time.Time       `json:"runAt"`
+	LastError   string          `json:"lastError,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	FinishedAt  *time.Time      `json:"finishedAt"`
+}
+
+// jobHandler runs a job. Returning an error schedules a retry until the job runs out of attempts.
+type jobHandler func(ctx context.Context, job *Job) error
+
+var (
+	jobHandlersMu sync.RWMutex
+	jobHandlers   = make(map[string]jobHandler)
+)
+
+// registerJobHandler makes a job type runnable by the workers
+func registerJobHandler(jobType string, h jobHandler) {
+	jobHandlersMu.Lock()
+	defer jobHandlersMu.Unlock()
+	jobHandlers[jobType] = h
+}
+
+// registerJobHandlers registers every job type of the application
+func registerJobHandlers() {
+	registerJobHandler(jobTypeImport, typedJob(handleImportJob))
+	registerJobHandler(jobTypePurgeBlobs, typedJob(handlePurgeBlobsJob))
+	registerJobHandler(jobTypeIndexNoteItems, typedJob(handleIndexNoteItemsJob))
+}
+
+// typedJob adapts a handler taking a decoded payload
+func typedJob[T any](fn func(ctx context.Context, job *Job, payload T) error) jobHandler {
+	return func(ctx context.Context, job *Job) error {
+		var payload T
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return fmt.Errorf("decoding %s payload: %w", job.Type, err)
+		}
+		return fn(ctx, job, payload)
+	}
+}
+
+// enqueueJob adds a job to the queue. userID, when set, lets the user read the job status.
+func enqueueJob(ctx context.Context, jobType string, userID *int, payload any) (int64, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = db.QueryRowContext(ctx,
+		"INSERT INTO jobs (type, payload, user_id) VALUES ($1, $2, $3) RETURNING id",
+		jobType, data, userID,
+	).Scan(&id)
+	return id, err
+}
+
+// jobBackoff returns the delay before retrying a job that failed the given number of times
+func jobBackoff(attempts int) time.Duration {
+	backoff := jobBaseBackoff
+	for i := 1; i < attempts && backoff < jobMaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, jobMaxBackoff)
+	// Jitter keeps jobs that failed together from retrying together
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// jobWorkerCount returns the number of in-process workers from JOB_WORKERS
+func jobWorkerCount() int {
+	if v := os.Getenv("JOB_WORKERS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
+		}
+		slog.Warn("Invalid JOB_WORKERS, using the default", "value", v, "default", jobDefaultWorkers)
+	}
+	return jobDefaultWorkers
+}
+
+// runWorker is the "worker" subcommand: it processes background jobs until interrupted
+func runWorker() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	n := max(jobWorkerCount(), 1)
+	slog.Info("Worker started", "workers", n)
+	runJobWorkers(ctx, n)
+	slog.Info("Worker stopped")
+}
+
+// runJobWorkers processes jobs with n workers until ctx is done
+func runJobWorkers(ctx context.Context, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runJobWorker(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func runJobWorker(ctx context.Context) {
+	for {
+		job, err := claimJob(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Error claiming job", "error", err)
+		}
+		if job != nil {
+			runJob(ctx, job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// claimJob takes the next due job. SKIP LOCKED lets many workers poll the queue
+// without blocking each other, and the lease gives jobs of crashed workers back
+// until they run out of attempts.
+func claimJob(ctx context.Context) (*Job, error) {
+	if err := buryExpiredJobs(ctx); err != nil {
+		return nil, err
+	}
+
+	var job Job
+	err := db.QueryRowContext(ctx, `
+		UPDATE jobs SET status = 'running', attempts = attempts + 1, locked_until = now() + $1 * interval '1 second'
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE (status = 'queued' AND run_at <= now())
+			   OR (status = 'running' AND locked_until < now() AND attempts < max_attempts)
+			ORDER BY run_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, type, payload, user_id, status, attempts, max_attempts, run_at, created_at`,
+		jobLease.Seconds(),
+	).Scan(&job.ID, &job.Type, &job.Payload, &job.UserID, &job.Status, &job.Attempts, &job.MaxAttempts, &job.RunAt, &job.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// buryExpiredJobs marks dead the jobs whose last attempt never finished. A job that
+// takes its worker down with it, out of memory for one, would otherwise run forever.
+func buryExpiredJobs(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE jobs SET status = $1, locked_until = NULL, last_error = 'the worker stopped during the last attempt', finished_at = now()
+		WHERE status = $2 AND locked_until < now() AND attempts >= max_attempts
+		RETURNING id, type, attempts`,
+		jobDead, jobRunning,
+	)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var id int64
+		var jobType string
+		var attempts int
+		if err := rows.Scan(&id, &jobType, &attempts); err != nil {
+			return err
+		}
+		jobsProcessed.WithLabelValues(jobType, jobDead).Inc()
+		slog.Error("Job failed for good, its worker stopped", "job_id", id, "type", jobType, "attempts", attempts)
+	}
+	return rows.Err()
+}
+
+func runJob(ctx context.Context, job *Job) {
+	jobHandlersMu.RLock()
+	h, ok := jobHandlers[job.Type]
+	jobHandlersMu.RUnlock()
+
+	ctx, span := tracer.Start(ctx, "job "+job.Type, trace.WithNewRoot(), trace.WithAttributes(
+		attribute.Int64("job.id", job.ID),
+		attribute.Int("job.attempt", job.Attempts),
+	))
+	var err error
+	if !ok {
+		err = fmt.Errorf("no handler for job type %q", job.Type)
+	} else {
+		// A job in progress is allowed to finish when the worker stops, the lease
+		// hands it to another worker if the process exits first
+		jobCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jobLease)
+		err = runJobHandler(jobCtx, h, job)
+		cancel()
+	}
+	endSpan(span, err)
+
+	// Record the outcome even when the worker is shutting down
+	ctx = context.WithoutCancel(ctx)
+
+	// The outcome only counts for the attempt that is still running, a worker whose lease
+	// expired meanwhile must not overwrite what a newer attempt recorded
+	if err == nil {
+		jobsProcessed.WithLabelValues(job.Type, jobSucceeded).Inc()
+		err = finishJob(ctx, job, "UPDATE jobs SET status = $1, locked_until = NULL, last_error = '', finished_at = now() WHERE id = $2 AND attempts = $3 AND status = $4",
+			jobSucceeded, job.ID, job.Attempts, jobRunning)
+		if err != nil {
+			slog.Error("Error completing job", "job_id", job.ID, "error", err)
+		}
+		return
+	}
+
+	if job.Attempts >= job.MaxAttempts {
+		jobsProcessed.WithLabelValues(job.Type, jobDead).Inc()
+		slog.Error("Job failed for good", "job_id", job.ID, "type", job.Type, "attempts", job.Attempts, "error", err)
+		err = finishJob(ctx, job, "UPDATE jobs SET status = $1, locked_until = NULL, last_error = $2, finished_at = now() WHERE id = $3 AND attempts = $4 AND status = $5",
+			jobDead, err.Error(), job.ID, job.Attempts, jobRunning)
+	} else {
+		jobsProcessed.WithLabelValues(job.Type, "retried").Inc()
+		backoff := jobBackoff(job.Attempts)
+		slog.Warn("Job failed, retrying", "job_id", job.ID, "type", job.Type, "attempts", job.Attempts, "backoff", backoff, "error", err)
+		err = finishJob(ctx, job, "UPDATE jobs SET status = $1, locked_until = NULL, last_error = $2, run_at = $3 WHERE id = $4 AND attempts = $5 AND status = $6",
+			jobQueued, err.Error(), time.Now().Add(backoff), job.ID, job.Attempts, jobRunning)
+	}
+	if err != nil {
+		slog.Error("Error recording job failure", "job_id", job.ID, "error", err)
+	}
+}
+
+// finishJob records the outcome of an attempt, unless another worker took the job over
+func finishJob(ctx context.Context, job *Job, query string, args ...any) error {
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		slog.Warn("Job was taken over by another worker, dropping the outcome", "job_id", job.ID, "attempt", job.Attempts)
+	}
+	return nil
+}
+
+// runJobHandler turns handler panics into job failures so one bad job can't kill the worker
+func runJobHandler(ctx context.Context, h jobHandler, job *Job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return h(ctx, job)
+}
+
+// Get the status of a background job started by the user
+func getJob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	userID := userIDFromContext(ctx)
+
+	var job Job
+	err = db.QueryRowContext(ctx, `
+		SELECT id, type, status, attempts, max_attempts, run_at, last_error, created_at, finished_at
+		FROM jobs WHERE id = $1 AND user_id = $2`, id, userID,
+	).Scan(&job.ID, &job.Type, &job.Status, &job.Attempts, &job.MaxAttempts, &job.RunAt, &job.LastError, &job.CreatedAt, &job.FinishedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			writeError(w, notFoundError(codeJobNotFound, "Job not found"))
+			return
+		}
+		slog.ErrorContext(ctx, "Error querying job", "job_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+	job.LastError = publicJobError(job)
+
+	writeJSON(ctx, w, http.StatusOK, job)
+}
+
+// publicJobError describes the last failure of a job to its user. The recorded error may
+// hold SQL or storage details, it stays in the logs and the jobs table.
+func publicJobError(job Job) string {
+	switch {
+	case job.LastError == "":
+		return ""
+	case job.Status == jobDead:
+		return "The job failed and won't be retried"
+	}
+	return "The last attempt failed, the job will be retried"
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestJobBackoff(t *testing.T) {
+	for attempts := 1; attempts <= 20; attempts++ {
+		want := min(jobBaseBackoff<<(attempts-1), jobMaxBackoff)
+		for i := 0; i < 50; i++ {
+			got := jobBackoff(attempts)
+			if got < want/2 || got > want {
+				t.Fatalf("jobBackoff(%d) = %v, want within [%v, %v]", attempts, got, want/2, want)
+			}
+		}
+	}
+}
+
+func TestPublicJobError(t *testing.T) {
+	tests := []struct {
+		name string
+		job  Job
+		want string
+	}{
+		{name: "no error", job: Job{Status: jobSucceeded}},
+		{name: "retrying", job: Job{Status: jobQueued, LastError: `pq: relation "notes" does not exist`}, want: "The last attempt failed, the job will be retried"},
+		{name: "dead", job: Job{Status: jobDead, LastError: "uploading file: dial tcp 10.0.0.5:9000: connect: connection refused"}, want: "The job failed and won't be retried"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := publicJobError(tt.job); got != tt.want {
+				t.Errorf("publicJobError() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+)
+
+// keysBatchSize is how many rows the key commands change per query
+const keysBatchSize = 100
+
+// runKeys runs a key management command given on the command line:
+// rotate re-wraps every data key with the current master key, status counts the data keys
+// per master key and the notes left in plaintext, and encrypt-notes encrypts those notes and
+// seals again the fields sealed before their row ID was authenticated
+func runKeys(args []string) {
+	if len(args) != 1 {
+		fatal("Invalid keys command", errors.New("usage: note-be keys rotate|status|encrypt-notes"))
+	}
+	if masterKeys == nil {
+		fatal("Invalid keys command", errors.New("ENCRYPTION_KEYS is not set"))
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "rotate":
+		count, err := rotateDataKeys(ctx)
+		if err != nil {
+			fatal("Error rotating data keys", err)
+		}
+		slog.Info("Rotated data keys", "master_key_id", masterKeys.current, "count", count)
+	case "status":
+		if err := printKeyStatus(ctx); err != nil {
+			fatal("Error reading key status", err)
+		}
+	case "encrypt-notes":
+		count, err := encryptPlaintextNotes(ctx)
+		if err != nil {
+			fatal("Error encrypting notes", err)
+		}
+		slog.Info("Encrypted notes", "count", count)
+		if count, err = resealNotes(ctx); err != nil {
+			fatal("Error sealing notes again", err)
+		}
+		slog.Info("Sealed notes again", "count", count)
+		if count, err = resealNoteItems(ctx); err != nil {
+			fatal("Error sealing checklist items again", err)
+		}
+		slog.Info("Sealed checklist items again", "count", count)
+	default:
+		fatal("Invalid keys command", fmt.Errorf("unknown command %q, expected rotate, status or encrypt-notes", args[0]))
+	}
+}
+
+// rotateDataKeys re-wraps the data keys wrapped by an older master key. The data keys
+// themselves don't change, so notes and files stay as they are. Once it finishes the old
+// master key can be dropped from ENCRYPTION_KEYS.
+func rotateDataKeys(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		rows, err := db.QueryContext(ctx,
+			"SELECT id, user_id, master_key_id, wrapped_key FROM data_keys WHERE master_key_id <> $1 ORDER BY id LIMIT $2",
+			masterKeys.current, keysBatchSize,
+		)
+		if err != nil {
+			return total, err
+		}
+		type wrappedKey struct {
+			id          int64
+			userID      int
+			masterKeyID string
+			wrapped     []byte
+		}
+		var batch []wrappedKey
+		for rows.Next() {
+			var k wrappedKey
+			if err := rows.Scan(&k.id, &k.userID, &k.masterKeyID, &k.wrapped); err != nil {
+				_ = rows.Close()
+				return total, err
+			}
+			batch = append(batch, k)
+		}
+		if err := rows.Close(); err != nil {
+			return total, err
+		}
+		if len(batch) == 0 {
+			return total, nil
+		}
+
+		for _, k := range batch {
+			key, err := masterKeys.unwrap(k.masterKeyID, k.userID, k.wrapped)
+			if err != nil {
+				return total, fmt.Errorf("unwrapping data key %d: %w", k.id, err)
+			}
+			masterKeyID, wrapped, err := masterKeys.wrap(k.userID, key)
+			if err != nil {
+				return total, err
+			}
+			_, err = db.ExecContext(ctx,
+				"UPDATE data_keys SET master_key_id = $1, wrapped_key = $2, rewrapped_at = now() WHERE id = $3",
+				masterKeyID, wrapped, k.id,
+			)
+			if err != nil {
+				return total, err
+			}
+			total++
+		}
+		slog.Info("Rotated batch of data keys", "count", total)
+	}
+}
+
+// printKeyStatus writes how many data keys each master key wraps and how many notes are not encrypted
+func printKeyStatus(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, "SELECT master_key_id, count(*) FROM data_keys GROUP BY master_key_id ORDER BY master_key_id")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "MASTER KEY\tDATA KEYS\tCURRENT\tCONFIGURED")
+	for rows.Next() {
+		var masterKeyID string
+		var count int
+		if err := rows.Scan(&masterKeyID, &count); err != nil {
+			return err
+		}
+		_, configured := masterKeys.keys[masterKeyID]
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%t\t%t\n", masterKeyID, count, masterKeyID == masterKeys.current, configured)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_ = tw.Flush()
+
+	var notes, files, oldNotes, oldItems int
+	err = db.QueryRowContext(ctx, `
+		SELECT (SELECT count(*) FROM notes WHERE data_key_id IS NULL),
+		       (SELECT count(*) FROM note_files WHERE data_key_id IS NULL),
+		       (SELECT count(*) FROM notes WHERE data_key_id IS NOT NULL AND content NOT LIKE $1),
+		       (SELECT count(*) FROM note_items WHERE data_key_id IS NOT NULL AND text NOT LIKE $1)`,
+		rowFieldPrefix+"%",
+	).Scan(&notes, &files, &oldNotes, &oldItems)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nPlaintext notes: %d\nPlaintext files: %d\n", notes, files)
+	fmt.Printf("Notes sealed without their ID: %d\nChecklist items sealed without their ID: %d\n", oldNotes, oldItems)
+	return nil
+}
+
+// encryptPlaintextNotes encrypts the notes written before encryption was turned on.
+// A note edited meanwhile is skipped, running the command again picks it up if the edit
+// left it in plaintext. Attachments stay as they are, new uploads are encrypted.
+func encryptPlaintextNotes(ctx context.Context) (int, error) {
+	total := 0
+	afterID := 0
+	for {
+		rows, err := db.QueryContext(ctx,
+			"SELECT id, user_id, title, content, version FROM notes WHERE data_key_id IS NULL AND id > $1 ORDER BY id LIMIT $2",
+			afterID, keysBatchSize,
+		)
+		if err != nil {
+			return total, err
+		}
+		var batch []Note
+		for rows.Next() {
+			var n Note
+			if err := rows.Scan(&n.ID, &n.UserID, &n.Title, &n.Content, &n.Version); err != nil {
+				_ = rows.Close()
+				return total, err
+			}
+			batch = append(batch, n)
+		}
+		if err := rows.Close(); err != nil {
+			return total, err
+		}
+		if len(batch) == 0 {
+			return total, nil
+		}
+
+		for _, n := range batch {
+			afterID = n.ID
+			key, err := userDataKey(ctx, n.UserID)
+			if err != nil {
+				return total, err
+			}
+			title, content, keyID, err := sealNoteText(key, n.ID, n.Title, n.Content)
+			if err != nil {
+				return total, err
+			}
+			// The version stays, clients already have the plaintext
+			result, err := db.ExecContext(ctx,
+				"UPDATE notes SET title = $1, content = $2, data_key_id = $3 WHERE id = $4 AND version = $5 AND data_key_id IS NULL",
+				title, content, keyID, n.ID, n.Version,
+			)
+			if err != nil {
+				return total, err
+			}
+			if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+				total++
+			}
+		}
+		slog.Info("Encrypted batch of notes", "count", total)
+	}
+}
+
+// resealNotes seals again the title and content of the notes sealed before the note ID was
+// authenticated. Like encryptPlaintextNotes, it skips a note edited meanwhile, the edit
+// sealed it with its ID.
+func resealNotes(ctx context.Context) (int, error) {
+	total := 0
+	afterID := 0
+	for {
+		rows, err := db.QueryContext(ctx,
+			"SELECT id, title, content, version, data_key_id FROM notes WHERE data_key_id IS NOT NULL AND content NOT LIKE $1 AND id > $2 ORDER BY id LIMIT $3",
+			rowFieldPrefix+"%", afterID, keysBatchSize,
+		)
+		if err != nil {
+			return total, err
+		}
+		type sealedNote struct {
+			Note
+			keyID int64
+		}
+		var batch []sealedNote
+		for rows.Next() {
+			var n sealedNote
+			if err := rows.Scan(&n.ID, &n.Title, &n.Content, &n.Version, &n.keyID); err != nil {
+				_ = rows.Close()
+				return total, err
+			}
+			batch = append(batch, n)
+		}
+		if err := rows.Close(); err != nil {
+			return total, err
+		}
+		if len(batch) == 0 {
+			return total, nil
+		}
+
+		for _, n := range batch {
+			afterID = n.ID
+			if err := openNote(ctx, &n.Note, &n.keyID); err != nil {
+				return total, err
+			}
+			key, err := dataKeyByID(ctx, n.keyID)
+			if err != nil {
+				return total, err
+			}
+			title, content, _, err := sealNoteText(key, n.ID, n.Title, n.Content)
+			if err != nil {
+				return total, err
+			}
+			// The version stays, the text didn't change
+			result, err := db.ExecContext(ctx,
+				"UPDATE notes SET title = $1, content = $2 WHERE id = $3 AND version = $4 AND data_key_id = $5",
+				title, content, n.ID, n.Version, n.keyID,
+			)
+			if err != nil {
+				return total, err
+			}
+			if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+				total++
+			}
+		}
+		slog.Info("Sealed batch of notes again", "count", total)
+	}
+}
+
+// resealNoteItems seals again the text of the checklist items sealed before the item ID
+// was authenticated. An item written meanwhile is skipped, the write sealed it with its ID.
+func resealNoteItems(ctx context.Context) (int, error) {
+	total := 0
+	var afterID int64
+	for {
+		rows, err := db.QueryContext(ctx,
+			"SELECT id, text, data_key_id FROM note_items WHERE data_key_id IS NOT NULL AND text NOT LIKE $1 AND id > $2 ORDER BY id LIMIT $3",
+			rowFieldPrefix+"%", afterID, keysBatchSize,
+		)
+		if err != nil {
+			return total, err
+		}
+		type sealedItem struct {
+			id     int64
+			sealed string
+			keyID  int64
+		}
+		var batch []sealedItem
+		for rows.Next() {
+			var item sealedItem
+			if err := rows.Scan(&item.id, &item.sealed, &item.keyID); err != nil {
+				_ = rows.Close()
+				return total, err
+			}
+			batch = append(batch, item)
+		}
+		if err := rows.Close(); err != nil {
+			return total, err
+		}
+		if len(batch) == 0 {
+			return total, nil
+		}
+
+		for _, item := range batch {
+			afterID = item.id
+			key, err := dataKeyByID(ctx, item.keyID)
+			if err != nil {
+				return total, err
+			}
+			text, err := key.openField("note_items.text", item.id, item.sealed)
+			if err != nil {
+				return total, fmt.Errorf("item %d: %w", item.id, err)
+			}
+			if text, err = key.sealField("note_items.text", item.id, text); err != nil {
+				return total, err
+			}
+			result, err := db.ExecContext(ctx,
+				"UPDATE note_items SET text = $1 WHERE id = $2 AND text = $3",
+				text, item.id, item.sealed,
+			)
+			if err != nil {
+				return total, err
+			}
+			if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+				total++
+			}
+		}
+		slog.Info("Sealed batch of checklist items again", "count", total)
+	}
+}
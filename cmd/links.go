@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	shareLinkDefaultTTL = 7 * 24 * time.Hour
+	shareLinkMaxTTL     = 90 * 24 * time.Hour
+	shareLinkFileURLTTL = time.Hour
+	shareLinkTokenBytes = 32
+)
+
+// ShareLink - represent public read-only link to a note
+type ShareLink struct {
+	ID          int       `json:"id"`
+	NoteID      int       `json:"noteId"`
+	Token       string    `json:"token,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	MaxViews    *int      `json:"maxViews"`
+	ViewCount   int       `json:"viewCount"`
+	HasPassword bool      `json:"hasPassword"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Only a hash of the token is stored, the token itself is shown once on creation
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newShareToken() (string, error) {
+	b := make([]byte, shareLinkTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Create a public link to a note
+func createShareLink(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	noteID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	userID := userIDFromContext(ctx)
+	slog.DebugContext(ctx, "Creating share link", "note_id", noteID)
+
+	if _, ok := authorizeNote(ctx, w, noteID, userID, roleOwner); !ok {
+		return
+	}
+	// The page shows the note as the server stores it, which is ciphertext for locked notes
+	locked, err := noteIsLocked(ctx, noteID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error querying note", "note_id", noteID, "error", err)
+		writeError(w, err)
+		return
+	}
+	if locked {
+		writeError(w, noteLockedError("Locked notes can't be shared by link, the server can't read them"))
+		return
+	}
+
+	var body struct {
+		ExpiresAt *time.Time `json:"expiresAt"`
+		Password  string     `json:"password"`
+		MaxViews  *int       `json:"maxViews"`
+	}
+	if err := decodeJSON(w, r, &body); err != nil {
+		slog.WarnContext(ctx, "Error decoding share link request", "error", err)
+		writeError(w, err)
+		return
+	}
+
+	expiresAt := time.Now().Add(shareLinkDefaultTTL)
+	if body.ExpiresAt != nil {
+		expiresAt = *body.ExpiresAt
+	}
+	var fields []FieldError
+	if !expiresAt.After(time.Now()) || time.Until(expiresAt) > shareLinkMaxTTL {
+		fields = append(fields, FieldError{Field: "expiresAt", Message: "Expiry must be in the future and within 90 days"})
+	}
+	if body.MaxViews != nil && *body.MaxViews < 1 {
+		fields = append(fields, FieldError{Field: "maxViews", Message: "maxViews must be positive"})
+	}
+	// bcrypt only uses the first 72 bytes and refuses longer passwords
+	if len(body.Password) > 72 {
+		fields = append(fields, FieldError{Field: "password", Message: "Password must be at most 72 bytes"})
+	}
+	if len(fields) > 0 {
+		writeError(w, validationError(fields...))
+		return
+	}
+
+	var passwordHash *string
+	if body.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error hashing share link password", "error", err)
+			writeError(w, err)
+			return
+		}
+		h := string(hash)
+		passwordHash = &h
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error generating share link token", "error", err)
+		writeError(w, err)
+		return
+	}
+
+	link := ShareLink{
+		Token:       token,
+		URL:         "/s/" + token,
+		ExpiresAt:   expiresAt,
+		MaxViews:    body.MaxViews,
+		HasPassword: passwordHash != nil,
+	}
+	err = db.QueryRowContext(ctx,
+		"INSERT INTO share_links (note_id, token_hash, password_hash, expires_at, max_views, created_by) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, note_id, created_at",
+		noteID, hashShareToken(token), passwordHash, expiresAt, body.MaxViews, userID,
+	).Scan(&link.ID, &link.NoteID, &link.CreatedAt)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error saving share link", "note_id", noteID, "error", err)
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf(apiPrefix+"/notes/%d/links/%d", noteID, link.ID))
+	writeJSON(ctx, w, http.StatusCreated, link)
+	slog.InfoContext(ctx, "Created share link", "note_id", noteID, "link_id", link.ID)
+}
+
+// List public links of a note
+func getShareLinks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	noteID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if _, ok := authorizeNote(ctx, w, noteID, userIDFromContext(ctx), roleOwner); !ok {
+		return
+	}
+
+	rows, err := db.QueryContext(ctx,
+		"SELECT id, note_id, expires_at, max_views, view_count, password_hash IS NOT NULL, created_at FROM share_links WHERE note_id = $1 ORDER BY created_at",
+		noteID,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error querying share links", "note_id", noteID, "error", err)
+		writeError(w, err)
+		return
+	}
+	defer func() { _ = rows.Close() }()
+
+	links := []ShareLink{}
+	for rows.Next() {
+		var l ShareLink
+		if err := rows.Scan(&l.ID, &l.NoteID, &l.ExpiresAt, &l.MaxViews, &l.ViewCount, &l.HasPassword, &l.CreatedAt); err != nil {
+			slog.ErrorContext(ctx, "Error scanning share link", "error", err)
+			writeError(w, err)
+			return
+		}
+		links = append(links, l)
+	}
+
+	writeJSON(ctx, w, http.StatusOK, links)
+}
+
+// Revoke a public link of a note
+func revokeShareLink(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	noteID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	linkID, err := pathID(r, "linkId")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	slog.DebugContext(ctx, "Revoking share link", "note_id", noteID, "link_id", linkID)
+
+	if _, ok := authorizeNote(ctx, w, noteID, userIDFromContext(ctx), roleOwner); !ok {
+		return
+	}
+
+	result, err := db.ExecContext(ctx, "DELETE FROM share_links WHERE id = $1 AND note_id = $2", linkID, noteID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting share link", "note_id", noteID, "link_id", linkID, "error", err)
+		writeError(w, err)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		writeError(w, notFoundError(codeShareLinkNotFound, "Share link not found"))
+		return
+	}
+
+	slog.InfoContext(ctx, "Revoked share link", "note_id", noteID, "link_id", linkID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var sharedNoteTemplate = template.Must(template.New("shared-note").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{if .Note}}{{.Note.Title}}{{else}}Shared note{{end}}</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; max-width: 720px; margin: 2rem auto; padding: 0 1rem; color: #222; }
+.content { white-space: pre-wrap; word-wrap: break-word; line-height: 1.5; }
+.error { color: #c00; }
+ul { padding-left: 1.2rem; }
+</style>
+</head>
+<body>
+{{if .Message}}<p class="{{if .IsError}}error{{end}}">{{.Message}}</p>{{end}}
+{{if .AskPassword}}
+<form method="post">
+<label>Password <input type="password" name="password" autofocus required></label>
+<button type="submit">Open</button>
+</form>
+{{end}}
+{{with .Note}}
+<h1>{{.Title}}</h1>
+<p><small>Last modified {{.LastModified.Format "2 Jan 2006 15:04 MST"}}</small></p>
+<div class="content">{{.Content}}</div>
+{{if .Files}}
+<h2>Attachments</h2>
+<ul>
+{{range .Files}}<li><a href="{{.URL}}" rel="noopener noreferrer">{{.FileName}}{{if .Extension}}.{{.Extension}}{{end}}</a></li>
+{{end}}</ul>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+type sharedNotePage struct {
+	Note        *Note
+	Message     string
+	IsError     bool
+	AskPassword bool
+}
+
+func renderSharedNote(w http.ResponseWriter, status int, page sharedNotePage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.WriteHeader(status)
+	if err := sharedNoteTemplate.Execute(w, page); err != nil {
+		slog.Error("Error rendering shared note page", "error", err)
+	}
+}
+
+// Public read-only view of a note shared by link. GET shows the note, or a password
+// form for protected links, and POST submits the password.
+func viewSharedNote(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tokenHash := hashShareToken(mux.Vars(r)["token"])
+
+	var (
+		linkID       int
+		noteID       int
+		passwordHash sql.NullString
+		expiresAt    time.Time
+		maxViews     sql.NullInt64
+		viewCount    int
+	)
+	err := db.QueryRowContext(ctx,
+		"SELECT id, note_id, password_hash, expires_at, max_views, view_count FROM share_links WHERE token_hash = $1",
+		tokenHash,
+	).Scan(&linkID, &noteID, &passwordHash, &expiresAt, &maxViews, &viewCount)
+	if err == sql.ErrNoRows {
+		renderSharedNote(w, http.StatusNotFound, sharedNotePage{Message: "This link does not exist.", IsError: true})
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error querying share link", "error", err)
+		renderSharedNote(w, http.StatusInternalServerError, sharedNotePage{Message: "Something went wrong.", IsError: true})
+		return
+	}
+
+	if !expiresAt.After(time.Now()) || (maxViews.Valid && int64(viewCount) >= maxViews.Int64) {
+		renderSharedNote(w, http.StatusGone, sharedNotePage{Message: "This link has expired.", IsError: true})
+		return
+	}
+
+	// The note may have been locked after the link was made
+	locked, err := noteIsLocked(ctx, noteID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error querying shared note", "note_id", noteID, "error", err)
+		renderSharedNote(w, http.StatusInternalServerError, sharedNotePage{Message: "Something went wrong.", IsError: true})
+		return
+	}
+	if locked {
+		renderSharedNote(w, http.StatusConflict, sharedNotePage{Message: "This note is locked, it can only be opened in the app.", IsError: true})
+		return
+	}
+
+	if passwordHash.Valid {
+		password := ""
+		if r.Method == http.MethodPost {
+			password = r.PostFormValue("password")
+		}
+		if password == "" {
+			renderSharedNote(w, http.StatusUnauthorized, sharedNotePage{Message: "This note is protected by a password.", AskPassword: true})
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(passwordHash.String), []byte(password)) != nil {
+			renderSharedNote(w, http.StatusUnauthorized, sharedNotePage{Message: "Wrong password.", IsError: true, AskPassword: true})
+			return
+		}
+	}
+
+	// Count the view, re-checking the limits so concurrent views can't exceed them
+	result, err := db.ExecContext(ctx,
+		"UPDATE share_links SET view_count = view_count + 1 WHERE id = $1 AND expires_at > now() AND (max_views IS NULL OR view_count < max_views)",
+		linkID,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error counting share link view", "link_id", linkID, "error", err)
+		renderSharedNote(w, http.StatusInternalServerError, sharedNotePage{Message: "Something went wrong.", IsError: true})
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		renderSharedNote(w, http.StatusGone, sharedNotePage{Message: "This link has expired.", IsError: true})
+		return
+	}
+
+	note, err := scanNote(ctx, db.QueryRowContext(ctx, "SELECT "+noteColumns+" FROM notes WHERE id = $1", noteID))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error querying shared note", "note_id", noteID, "error", err)
+		renderSharedNote(w, http.StatusInternalServerError, sharedNotePage{Message: "Something went wrong.", IsError: true})
+		return
+	}
+
+	files, err := sharedNoteFiles(ctx, noteID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error loading shared note files", "note_id", noteID, "error", err)
+		renderSharedNote(w, http.StatusInternalServerError, sharedNotePage{Message: "Something went wrong.", IsError: true})
+		return
+	}
+	note.Files = files
+
+	slog.InfoContext(ctx, "Served shared note", "note_id", noteID, "link_id", linkID)
+	renderSharedNote(w, http.StatusOK, sharedNotePage{Note: &note})
+}
+
+// sharedNoteFiles lists the attachments of a note with short-lived download links
+func sharedNoteFiles(ctx context.Context, noteID int) ([]File, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, note_id, file_name, size, ext, data_key_id FROM note_files WHERE note_id = $1", noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var files []File
+	for rows.Next() {
+		var f File
+		if err := rows.Scan(&f.ID, &f.NoteID, &f.FileName, &f.Size, &f.Extension, &f.KeyID); err != nil {
+			return nil, err
+		}
+
+		objectName := noteFileObjectName(noteID, f.FileName, f.Extension)
+		f.URL, err = blobObjectURL(ctx, noteFilesBucket, objectName, f.KeyID, shareLinkFileURLTTL)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Locked notes are encrypted end to end: the client derives a key from a passphrase and
+// sends ciphertext, which the server stores and returns as is. The title stays readable,
+// it is what lists and reminders show.
+
+// Ciphertext algorithms and key derivation functions clients may use for locked notes
+const (
+	lockedAlgAESGCM    = "aes-256-gcm"
+	lockedAlgXChaCha20 = "xchacha20-poly1305"
+	lockedKDFPBKDF2    = "pbkdf2-sha256"
+	lockedKDFArgon2id  = "argon2id"
+	lockedMACPrefix    = "hmac-sha256:"
+
+	lockedEncryptionVersion = 1
+	minLockedSaltSize       = 16
+	minPBKDF2Iterations     = 100_000
+	minArgon2idMemoryKiB    = 19 * 1024
+)
+
+// lockedNonceSizes is the nonce size of each ciphertext algorithm, in bytes
+var lockedNonceSizes = map[string]int{
+	lockedAlgAESGCM:    12,
+	lockedAlgXChaCha20: 24,
+}
+
+// NoteEncryption - represent what a client needs to decrypt a locked note. Binary values
+// are standard base64. MAC is "hmac-sha256:" followed by the base64 HMAC the client computed
+// over the metadata and the ciphertext, clients check it before decrypting.
+type NoteEncryption struct {
+	Version   int     `json:"version"`
+	Algorithm string  `json:"algorithm"`
+	KDF       NoteKDF `json:"kdf"`
+	Salt      string  `json:"salt"`
+	Nonce     string  `json:"nonce"`
+	MAC       string  `json:"mac"`
+}
+
+// NoteKDF - represent the key derivation function and its cost parameters
+type NoteKDF struct {
+	Name        string `json:"name"`
+	Iterations  int    `json:"iterations"`
+	MemoryKiB   int    `json:"memoryKiB,omitempty"`
+	Parallelism int    `json:"parallelism,omitempty"`
+}
+
+// FileEncryption - represent what a client needs to decrypt an attachment uploaded as ciphertext.
+// The key is the one of the note.
+type FileEncryption struct {
+	Algorithm string `json:"algorithm"`
+	Nonce     string `json:"nonce"`
+	MAC       string `json:"mac"`
+}
+
+// noteLockedError is returned for operations that need the plaintext of a locked note
+func noteLockedError(message string) *APIError {
+	return newAPIError(http.StatusConflict, codeNoteLocked, message)
+}
+
+// validateNoteEncryption reports the invalid fields of locked note metadata
+func validateNoteEncryption(e *NoteEncryption) []FieldError {
+	var fields []FieldError
+	if e.Version != lockedEncryptionVersion {
+		fields = append(fields, FieldError{Field: "encryption.version", Message: fmt.Sprintf("Version must be %d", lockedEncryptionVersion)})
+	}
+	fields = append(fields, validateCipherParams("encryption", e.Algorithm, e.Nonce, e.MAC)...)
+
+	if n, ok := decodedLen(e.Salt); !ok || n < minLockedSaltSize {
+		fields = append(fields, FieldError{Field: "encryption.salt", Message: fmt.Sprintf("Salt must be at least %d bytes of base64", minLockedSaltSize)})
+	}
+	switch e.KDF.Name {
+	case lockedKDFPBKDF2:
+		if e.KDF.Iterations < minPBKDF2Iterations {
+			fields = append(fields, FieldError{Field: "encryption.kdf.iterations", Message: fmt.Sprintf("PBKDF2 needs at least %d iterations", minPBKDF2Iterations)})
+		}
+	case lockedKDFArgon2id:
+		if e.KDF.Iterations < 1 || e.KDF.MemoryKiB < minArgon2idMemoryKiB || e.KDF.Parallelism < 1 {
+			fields = append(fields, FieldError{Field: "encryption.kdf", Message: fmt.Sprintf("Argon2id needs at least 1 iteration, %d KiB of memory and 1 thread", minArgon2idMemoryKiB)})
+		}
+	default:
+		fields = append(fields, FieldError{Field: "encryption.kdf.name", Message: "KDF must be pbkdf2-sha256 or argon2id"})
+	}
+	return fields
+}
+
+// validateCipherParams checks the algorithm, nonce and MAC of locked note or attachment metadata
+func validateCipherParams(field, algorithm, nonce, mac string) []FieldError {
+	var fields []FieldError
+	nonceSize, ok := lockedNonceSizes[algorithm]
+	if !ok {
+		fields = append(fields, FieldError{Field: field + ".algorithm", Message: "Algorithm must be aes-256-gcm or xchacha20-poly1305"})
+	} else if n, ok := decodedLen(nonce); !ok || n != nonceSize {
+		fields = append(fields, FieldError{Field: field + ".nonce", Message: fmt.Sprintf("Nonce must be %d bytes of base64", nonceSize)})
+	}
+	if !validLockedMAC(mac) {
+		fields = append(fields, FieldError{Field: field + ".mac", Message: "MAC must be hmac-sha256: followed by 32 bytes of base64"})
+	}
+	return fields
+}
+
+func validLockedMAC(mac string) bool {
+	value, found := strings.CutPrefix(mac, lockedMACPrefix)
+	n, ok := decodedLen(value)
+	return found && ok && n == 32
+}
+
+// decodedLen returns the length of standard base64 data, and false if it isn't base64
+func decodedLen(s string) (int, bool) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return len(b), err == nil
+}
+
+// encryptionColumn returns the JSON of metadata to store in an encryption column, or nil
+func encryptionColumn[T any](e *T) (any, error) {
+	if e == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// parseFileEncryption reads the encryption form field of an attachment upload
+func parseFileEncryption(value string) (*FileEncryption, error) {
+	var e FileEncryption
+	if err := json.Unmarshal([]byte(value), &e); err != nil {
+		return nil, validationError(FieldError{Field: "encryption", Message: "Encryption must be a JSON object"})
+	}
+	if fields := validateCipherParams("encryption", e.Algorithm, e.Nonce, e.MAC); len(fields) > 0 {
+		return nil, validationError(fields...)
+	}
+	return &e, nil
+}
+
+// uploadEncryption checks the encryption form field of an upload against the lock of the note.
+// Attachments of locked notes are uploaded as ciphertext, the others as plaintext.
+func uploadEncryption(ctx context.Context, noteID int, value string) (*FileEncryption, error) {
+	locked, err := noteIsLocked(ctx, noteID)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError(codeNoteNotFound, "Note not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case locked && value == "":
+		return nil, validationError(FieldError{Field: "encryption", Message: "Attachments of a locked note are uploaded encrypted, with encryption metadata"})
+	case !locked && value != "":
+		return nil, lockStateError(false)
+	case !locked:
+		return nil, nil
+	}
+	return parseFileEncryption(value)
+}
+
+// noteIsLocked reports whether a note is locked, or returns sql.ErrNoRows
+func noteIsLocked(ctx context.Context, noteID int) (bool, error) {
+	var locked bool
+	err := db.QueryRowContext(ctx, "SELECT is_locked FROM notes WHERE id = $1", noteID).Scan(&locked)
+	return locked, err
+}
+
+// lockStateError explains why an update didn't match the lock state of the note
+func lockStateError(locked bool) *APIError {
+	if locked {
+		return noteLockedError("The note is locked, send its content encrypted with encryption metadata or unlock it first")
+	}
+	return noteLockedError("The note is not locked, lock it before sending encrypted content")
+}
+
+// Lock a note with content encrypted by the client, or unlock it with plaintext content.
+// Attachments have to be in the same state as the note, so the client deletes and
+// re-uploads them first.
+func lockNote(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	slog.DebugContext(ctx, "Changing lock of note", "note_id", id)
+
+	// Locking decides who can read the note, so it is up to the owner
+	userID := userIDFromContext(ctx)
+	role, ok := authorizeNote(ctx, w, id, userID, roleOwner)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		IsLocked   bool            `json:"isLocked"`
+		Content    string          `json:"content"`
+		Encryption *NoteEncryption `json:"encryption"`
+	}
+	if err := decodeJSON(w, r, &body); err != nil {
+		slog.WarnContext(ctx, "Error decoding lock note request", "error", err)
+		writeError(w, err)
+		return
+	}
+
+	note, err := scanNote(ctx, db.QueryRowContext(ctx, "SELECT "+noteColumns+" FROM notes WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		writeError(w, notFoundError(codeNoteNotFound, "Note not found"))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error querying note", "note_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+	note.IsLocked, note.Content, note.Encryption = body.IsLocked, body.Content, body.Encryption
+	if err := validateNote(note); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var mismatched int
+	err = db.QueryRowContext(ctx,
+		"SELECT count(*) FROM note_files WHERE note_id = $1 AND (encryption IS NOT NULL) <> $2", id, body.IsLocked,
+	).Scan(&mismatched)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error querying note files", "note_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+	if mismatched > 0 {
+		writeError(w, noteLockedError("Delete the attachments or upload them again in the new state before changing the lock"))
+		return
+	}
+
+	key, err := noteDataKey(ctx, id)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error loading data key", "note_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+	title, content, keyID, err := sealNoteText(key, id, note.Title, note.Content)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error encrypting note", "note_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+	encryption, err := encryptionColumn(note.Encryption)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var version int64
+	err = db.QueryRowContext(ctx,
+		"UPDATE notes SET title = $1, content = $2, data_key_id = $3, is_locked = $4, encryption = $5, last_modified = $6, version = version + 1 WHERE id = $7 RETURNING version",
+		title, content, keyID, note.IsLocked, encryption, time.Now(), id,
+	).Scan(&version)
+	if err == sql.ErrNoRows {
+		writeError(w, notFoundError(codeNoteNotFound, "Note not found"))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error changing lock of note", "note_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+	indexNoteItems(ctx, id)
+	publishNoteEvent(ctx, eventNoteUpdated, id, version, userID, nil)
+	slog.InfoContext(ctx, "Changed lock of note", "note_id", id, "locked", note.IsLocked)
+
+	respondWithNote(w, r, http.StatusOK, id, role)
+}
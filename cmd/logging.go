@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	redacted        = "[REDACTED]"
+)
+
+var (
+	validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+	// Presigned URLs carry credentials in their query string
+	signedURLQuery = regexp.MustCompile(`(https?://[^\s?"']+)\?[^\s"']*X-Amz-[^\s"']*`)
+	botTokenPath   = regexp.MustCompile(`bot\d+:[A-Za-z0-9_-]+`)
+)
+
+// Attribute keys whose values are never logged
+var sensitiveLogKeys = map[string]bool{
+	"authorization": true,
+	"cookie":        true,
+	"init_data":     true,
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+}
+
+// requestInfo - represent what the logs know about the current request. It is shared
+// by pointer so that values found deeper in the handler chain reach the access log.
+type requestInfo struct {
+	id     string
+	route  string
+	userID int
+}
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+// initLogger makes slog, and the standard log package through it, write JSON lines to stdout.
+// LOG_LEVEL sets the minimum level: debug, info (default), warn or error.
+func initLogger() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level = slog.LevelInfo
+	}
+
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactLogAttr,
+	})
+	slog.SetDefault(slog.New(contextLogHandler{handler}))
+}
+
+// fatal logs an error and exits, for failures the server can't start without
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// contextLogHandler adds the request ID, user ID and trace ID of the context to every record
+type contextLogHandler struct {
+	slog.Handler
+}
+
+func (h contextLogHandler) Handle(ctx context.Context, rec slog.Record) error {
+	userID := userIDFromContext(ctx)
+	if info := requestInfoFromContext(ctx); info != nil {
+		rec.AddAttrs(slog.String("request_id", info.id))
+		if userID == 0 {
+			userID = info.userID
+		}
+	}
+	if userID != 0 {
+		rec.AddAttrs(slog.Int("user_id", userID))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		rec.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextLogHandler) WithGroup(name string) slog.Handler {
+	return contextLogHandler{h.Handler.WithGroup(name)}
+}
+
+// redactLogAttr hides secrets: values of sensitive keys, signed URL queries and configured credentials
+func redactLogAttr(_ []string, a slog.Attr) slog.Attr {
+	if sensitiveLogKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redactSecrets(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, redactSecrets(err.Error()))
+		}
+	}
+	return a
+}
+
+func redactSecrets(s string) string {
+	s = signedURLQuery.ReplaceAllString(s, "$1?"+redacted)
+	s = botTokenPath.ReplaceAllString(s, "bot"+redacted)
+	for _, name := range []string{"TG_BOT_TOKEN", "MINIO_SECRET_KEY"} {
+		if secret := os.Getenv(name); len(secret) >= 8 {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	return s
+}
+
+// requestLogger gives every request an ID, taken from X-Request-ID when the client sends
+// a valid one, and writes an access log line once the request is served
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		info := &requestInfo{id: id}
+		ctx := context.WithValue(r.Context(), requestInfoKey, info)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := info.route
+		if route == "" {
+			route = "unmatched"
+		}
+		elapsed := time.Since(start)
+		observeHTTPRequest(r.Method, route, rec.status, elapsed)
+
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		} else if route == "/healthz" || route == "/readyz" {
+			// Probes run every few seconds and would drown the access log
+			level = slog.LevelDebug
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", route),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Float64("latency_ms", float64(elapsed.Microseconds())/1000),
+		}
+		// Share link paths hold the link token
+		if !strings.Contains(route, "{token}") {
+			attrs = append(attrs, slog.String("path", r.URL.Path))
+		}
+		slog.LogAttrs(ctx, level, "Request served", attrs...)
+	})
+}
+
+// recordRoute is a mux middleware that tells the access log which route served the request
+func recordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := requestInfoFromContext(r.Context()); info != nil {
+			if tmpl, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+				info.route = tmpl
+				nameRouteSpan(r, tmpl)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder records the status and size of a response. It keeps the optional
+// interfaces of the wrapped writer that streaming and WebSocket handlers rely on.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	_ = http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(s.ResponseWriter).Hijack()
+	if err == nil && s.status == 0 {
+		s.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
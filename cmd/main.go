@@ -1,25 +1,25 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/fs"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
 // Note - represent note entity
@@ -30,7 +30,24 @@ type Note struct {
 	Content      string    `json:"content"`
 	LastModified time.Time `json:"lastModified"`
 	IsPinned     bool      `json:"isPinned"`
+	Version      int64     `json:"version"`
 	Files        []File    `json:"attachments"`
+
+	// Items are the checklist lines of the content, kept by the server. Writes go to the content.
+	Items []ChecklistItem `json:"items"`
+
+	// ClientID is the ID an offline client generated for a note it created
+	ClientID *string `json:"clientId,omitempty"`
+
+	RemindAt         *time.Time `json:"remindAt"`
+	RemindRecurrence string     `json:"remindRecurrence"`
+
+	// Role of the requesting user on the note: owner, editor or viewer
+	Role string `json:"role"`
+
+	// Locked notes hold ciphertext made by the client, Encryption tells how to decrypt it
+	IsLocked   bool            `json:"isLocked"`
+	Encryption *NoteEncryption `json:"encryption,omitempty"`
 }
 
 // File - represent file entity
@@ -41,502 +58,869 @@ type File struct {
 	Size      int    `json:"size"`
 	Extension string `json:"extension"`
 	URL       string `json:"url"`
+
+	// Encryption is set for files the client uploaded as ciphertext, see NoteEncryption
+	Encryption *FileEncryption `json:"encryption,omitempty"`
+
+	// KeyID is the data key the stored file is encrypted with, nil for plaintext
+	KeyID *int64 `json:"-"`
 }
 
 var (
-	db          *sql.DB
-	minioClient *minio.Client
+	db    *sql.DB
+	blobs blobStore
 )
 
 const (
 	noteFilesBucket = "notes-files"
+	// Attachment links are saved with the file and last this long
+	noteFileURLTTL = 7 * 24 * time.Hour
+	maxUploadSize  = 100 << 20
+	// Uploads may take this long to arrive, whatever the server read timeout
+	uploadTimeout = 10 * time.Minute
+
+	defaultShutdownTimeout = 30 * time.Second
+	defaultShutdownDelay   = 5 * time.Second
+	defaultWriteTimeout    = 15 * time.Second
+
+	noteColumns = "id, user_id, title, content, last_modified, is_pin, version, client_id, remind_at, remind_recurrence, data_key_id, is_locked, encryption"
 )
 
+// rowScanner - common interface of *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// querier - common interface of *sql.DB and *sql.Tx
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// scanNote reads a row selected with noteColumns, followed by any extra columns,
+// and decrypts the title and content
+func scanNote(ctx context.Context, row rowScanner, extra ...any) (Note, error) {
+	var n Note
+	var keyID *int64
+	var encryption []byte
+	dest := []any{&n.ID, &n.UserID, &n.Title, &n.Content, &n.LastModified, &n.IsPinned, &n.Version, &n.ClientID, &n.RemindAt, &n.RemindRecurrence, &keyID, &n.IsLocked, &encryption}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return n, err
+	}
+	if encryption != nil {
+		if err := json.Unmarshal(encryption, &n.Encryption); err != nil {
+			return n, fmt.Errorf("note %d: decoding encryption: %w", n.ID, err)
+		}
+	}
+	return n, openNote(ctx, &n, keyID)
+}
+
 func main() {
-	// Load .env file
+	// Load .env file, containers get their environment from the runtime instead
 	err := godotenv.Load()
+	initLogger()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fatal("Error loading .env file", err)
+	}
+
+	shutdownTracing, err := initTracing(context.Background())
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		fatal("Error initializing tracing", err)
 	}
+	defer func() { _ = shutdownTracing(context.Background()) }()
 
-	db, err = sql.Open("postgres", os.Getenv("PG_DSN"))
+	db, err = openDB(os.Getenv("PG_DSN"))
 	if err != nil {
-		log.Fatal(err)
+		fatal("Error opening database", err)
 	}
 	defer func() { _ = db.Close() }()
 
-	// Initialize MinIO client
-	if err := initMinioClient(); err != nil {
-		log.Fatal("Error initializing MinIO client:", err)
+	// "note-be migrate up|down|status" manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+
+	if err := migrateOnStartup(context.Background()); err != nil {
+		fatal("Error migrating database", err)
 	}
 
-	r := mux.NewRouter()
+	masterKeys, err = loadKeyring()
+	if err != nil {
+		fatal("Error loading encryption keys", err)
+	}
 
-	r.HandleFunc("/notes", getNotes).Methods("GET")
-	r.HandleFunc("/notes/{id}", getNoteByID).Methods("GET")
-	r.HandleFunc("/notes", createNote).Methods("POST")
-	r.HandleFunc("/notes/{id}", updateNote).Methods("PUT")
-	r.HandleFunc("/notes/{id}", deleteNote).Methods("DELETE")
-	r.HandleFunc("/notes/{id}/toggle-pin", togglePinNote).Methods("PUT")
-	r.HandleFunc("/notes/{id}/upload-file", uploadFile).Methods("POST")
-	r.HandleFunc("/notes/{id}/delete-file", deleteFile).Methods("DELETE")
+	// "note-be keys rotate|status|encrypt-notes" manages the encryption keys and exits
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		runKeys(os.Args[2:])
+		return
+	}
 
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./frontend/dist")))
+	// Init data is signed with a key derived from the bot token, without it nothing verifies
+	if os.Getenv("TG_BOT_TOKEN") == "" {
+		fatal("Invalid configuration", errors.New("TG_BOT_TOKEN is not set"))
+	}
 
-	log.Println("Server started on :8080")
+	blobs, err = openBlobStore()
+	if err != nil {
+		fatal("Error opening blob storage", err)
+	}
 
-	// Add CORS middleware
-	corsMiddleware := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	// Create the attachments bucket up front, readiness requires it
+	if err := blobs.EnsureBucket(context.Background(), noteFilesBucket); err != nil {
+		slog.Warn("Error preparing files bucket", "error", err)
+	}
 
-			if r.Method == "OPTIONS" {
-				w.WriteHeader(http.StatusOK)
-				return
-			}
+	registerJobHandlers()
+	serveMetrics()
 
-			next.ServeHTTP(w, r)
-		})
+	// "note-be worker" only processes background jobs
+	if len(os.Args) > 1 && os.Args[1] == "worker" {
+		runWorker()
+		return
 	}
 
-	srv := &http.Server{
-		Addr:         ":8080",
-		Handler:      corsMiddleware(r),
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+	// SIGTERM or SIGINT stops the background workers and drains the server
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var background sync.WaitGroup
+
+	// Process background jobs in-process as well, unless JOB_WORKERS=0
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runJobWorkers(ctx, jobWorkerCount())
+	}()
+
+	// Deliver due reminders in the background
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runReminderScheduler(ctx)
+	}()
+
+	// Receive note changes made on any server instance
+	if err := listenNoteEvents(ctx, os.Getenv("PG_DSN")); err != nil {
+		fatal("Error listening for note events", err)
 	}
 
-	log.Fatal(srv.ListenAndServe())
-}
+	spec, err := loadAPISpec(ctx)
+	if err != nil {
+		fatal("Error loading OpenAPI spec", err)
+	}
+	server, err := newNoteServer(spec)
+	if err != nil {
+		fatal("Error encoding OpenAPI spec", err)
+	}
 
-func initMinioClient() error {
-	endpoint := os.Getenv("MINIO_ENDPOINT")
-	accessKeyID := os.Getenv("MINIO_ACCESS_KEY")
-	secretAccessKey := os.Getenv("MINIO_SECRET_KEY")
-	useSSL := false
+	limiter, err := newRateLimiter(newMemoryRateLimitStore())
+	if err != nil {
+		fatal("Error configuring rate limits", err)
+	}
 
-	client, err := minio.New(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
-		Secure: useSSL,
-	})
+	frontendFiles, err := frontendFS()
+	if err != nil {
+		fatal("Error opening frontend files", err)
+	}
+	r, err := newRouter(spec, limiter, server, frontendHandler(frontendFiles))
 	if err != nil {
-		return err
+		fatal("Error building the API routes", err)
 	}
 
-	minioClient = client
-	return nil
-}
+	cors, err := loadCORSPolicy()
+	if err != nil {
+		fatal("Error loading CORS policy", err)
+	}
 
-// Helper function to upload file to MinIO
-func uploadFileToMinio(bucketName, objectName string, fileData []byte) (string, error) {
-	// Check if bucket exists, create if it doesn't
-	exists, err := minioClient.BucketExists(context.Background(), bucketName)
+	serverTLS, err := loadServerTLS()
 	if err != nil {
-		return "", err
+		fatal("Error configuring TLS", err)
 	}
 
-	if !exists {
-		err = minioClient.MakeBucket(context.Background(), bucketName, minio.MakeBucketOptions{})
-		if err != nil {
-			return "", err
+	handler := traceHTTP(requestLogger(securityHeaders(cors.middleware(legacyAPIAlias(r)))))
+	srv := &http.Server{
+		Addr:         httpAddr(),
+		Handler:      handler,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: defaultWriteTimeout,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	// Event streams never finish on their own, end them so the drain can complete
+	srv.RegisterOnShutdown(events.shutdown)
+
+	// With TLS the server listens on HTTPS, HTTP/2 included, and the plain
+	// listener redirects to it
+	var redirectSrv *http.Server
+	if serverTLS != nil {
+		srv.Addr = serverTLS.addr
+		srv.TLSConfig = serverTLS.config
+		if serverTLS.redirectAddr != "" {
+			redirectSrv = &http.Server{
+				Addr:              serverTLS.redirectAddr,
+				Handler:           serverTLS.redirectHandler(handler),
+				ReadHeaderTimeout: 15 * time.Second,
+				IdleTimeout:       60 * time.Second,
+			}
+		}
+		if serverTLS.certs != nil {
+			go serverTLS.certs.reloadOnSIGHUP(ctx)
 		}
 	}
 
-	// Upload the file
-	log.Printf("[uploadFileToMinio] Uploading file to MinIO - bucket: %s, object: %s", bucketName, objectName)
-	reader := bytes.NewReader(fileData)
-	_, err = minioClient.PutObject(context.Background(), bucketName, objectName, reader, int64(len(fileData)), minio.PutObjectOptions{
-		ContentType: "application/octet-stream",
-	})
-	if err != nil {
-		return "", err
+	go func() {
+		slog.Info("Server started", "addr", srv.Addr, "tls", srv.TLSConfig != nil)
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("Server stopped", err)
+		}
+	}()
+	if redirectSrv != nil {
+		go func() {
+			slog.Info("Redirecting HTTP to HTTPS", "addr", redirectSrv.Addr)
+			if err := redirectSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("HTTP redirect listener stopped", err)
+			}
+		}()
 	}
 
-	// Generate presigned URL for downloading
-	// Set URL expiry to 7 days (or adjust as needed)
-	reqParams := make(url.Values)
-	presignedURL, err := minioClient.PresignedGetObject(context.Background(), bucketName, objectName, time.Hour*24*7, reqParams)
-	if err != nil {
-		return "", err
+	<-ctx.Done()
+	stop()
+
+	timeout, delay := shutdownTimeout(), shutdownDelay()
+	slog.Info("Shutting down", "timeout", timeout, "delay", delay)
+	shuttingDown.Store(true)
+
+	// Keep serving while /readyz reports the shutdown, so load balancers stop sending
+	// requests before the listeners close
+	time.Sleep(delay)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		slog.Error("Error draining requests", "error", err)
+	}
+	if redirectSrv != nil {
+		_ = redirectSrv.Shutdown(drainCtx)
 	}
 
-	return presignedURL.String(), nil
+	// Jobs in progress get what is left of the drain timeout, the lease
+	// hands unfinished ones to another worker
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("Server stopped")
+	case <-drainCtx.Done():
+		slog.Warn("Server stopped before background work finished")
+	}
 }
 
-// Helper function to delete file from MinIO
-func deleteFileFromMinio(bucketName, objectName string) error {
-	ctx := context.Background()
-	log.Printf("[deleteFileFromMinio] Deleting file from MinIO - bucket: %s, object: %s", bucketName, objectName)
+// shutdownTimeout returns how long a shutdown waits for requests and jobs, from SHUTDOWN_TIMEOUT
+func shutdownTimeout() time.Duration {
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		slog.Warn("Invalid SHUTDOWN_TIMEOUT, using the default", "value", v, "default", defaultShutdownTimeout)
+	}
+	return defaultShutdownTimeout
+}
 
-	// Check if object exists before attempting deletion
-	_, err := minioClient.StatObject(ctx, bucketName, objectName, minio.StatObjectOptions{})
-	if err != nil {
-		log.Printf("[deleteFileFromMinio] Error checking object existence: %v", err)
-		return err
+// shutdownDelay returns how long a shutdown keeps serving after readiness turns off,
+// from SHUTDOWN_DELAY. Zero closes the listeners right away.
+func shutdownDelay() time.Duration {
+	if v := os.Getenv("SHUTDOWN_DELAY"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			return d
+		}
+		slog.Warn("Invalid SHUTDOWN_DELAY, using the default", "value", v, "default", defaultShutdownDelay)
 	}
+	return defaultShutdownDelay
+}
 
-	err = minioClient.RemoveObject(ctx, bucketName, objectName, minio.RemoveObjectOptions{
-		ForceDelete: true,
-	})
-	if err != nil {
-		log.Printf("[deleteFileFromMinio] Error during deletion: %v", err)
-		return err
+// storeNoteFile uploads the size bytes of an attachment read from r, encrypted with key
+// unless it is nil, and returns a download link for it
+func storeNoteFile(ctx context.Context, objectName string, r io.Reader, size int64, key *dataKey) (string, error) {
+	slog.DebugContext(ctx, "Uploading file", "bucket", noteFilesBucket, "object", objectName)
+	if err := blobs.EnsureBucket(ctx, noteFilesBucket); err != nil {
+		return "", err
 	}
 
-	// Verify deletion
-	_, err = minioClient.StatObject(ctx, bucketName, objectName, minio.StatObjectOptions{})
-	if err == nil {
-		return fmt.Errorf("object still exists after deletion attempt")
+	body, storedSize := r, size
+	var keyID *int64
+	if key != nil {
+		sealed, err := key.sealReader(r, objectName)
+		if err != nil {
+			return "", err
+		}
+		body, storedSize, keyID = sealed, sealedSize(size), &key.id
+	}
+	if err := blobs.Put(ctx, noteFilesBucket, objectName, body, storedSize); err != nil {
+		return "", err
 	}
+	uploadedBytes.Add(float64(size))
+
+	return blobObjectURL(ctx, noteFilesBucket, objectName, keyID, noteFileURLTTL)
+}
+
+// noteFileObjectName returns the storage object name of a note attachment
+func noteFileObjectName(noteID any, fileName, ext string) string {
+	return fmt.Sprintf("%v-%s.%s", noteID, fileName, ext)
+}
+
+// purgeBlobsPayload - represent stored objects to remove in the background
+type purgeBlobsPayload struct {
+	Bucket  string   `json:"bucket"`
+	Objects []string `json:"objects"`
+}
 
-	log.Printf("[deleteFileFromMinio] Successfully deleted object from MinIO")
+// handlePurgeBlobsJob removes objects from storage. Removing a missing object is not an error,
+// so retries after a partial failure are safe.
+func handlePurgeBlobsJob(ctx context.Context, _ *Job, p purgeBlobsPayload) error {
+	for _, objectName := range p.Objects {
+		if err := blobs.Remove(ctx, p.Bucket, objectName); err != nil {
+			return fmt.Errorf("removing %s: %w", objectName, err)
+		}
+	}
+	slog.InfoContext(ctx, "Purged blobs", "bucket", p.Bucket, "count", len(p.Objects))
 	return nil
 }
 
 // Toggle pin status of a note
 func togglePinNote(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
-	log.Printf("Toggling pin status for note ID: %s", id)
+	ctx := r.Context()
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	slog.DebugContext(ctx, "Toggling pin status", "note_id", id)
+
+	userID := userIDFromContext(ctx)
+	role, ok := authorizeNote(ctx, w, id, userID, roleEditor)
+	if !ok {
+		return
+	}
 
 	var body struct {
 		IsPinned bool `json:"isPinned"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		log.Printf("Error decoding toggle pin request: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := decodeJSON(w, r, &body); err != nil {
+		slog.WarnContext(ctx, "Error decoding toggle pin request", "error", err)
+		writeError(w, err)
 		return
 	}
 
 	// Toggle the pin status
-	_, err := db.Exec("UPDATE notes SET is_pin = $1 WHERE id = $2", body.IsPinned, id)
+	var version int64
+	err = db.QueryRowContext(ctx, "UPDATE notes SET is_pin = $1, version = version + 1 WHERE id = $2 RETURNING version", body.IsPinned, id).Scan(&version)
+	if err == sql.ErrNoRows {
+		writeError(w, notFoundError(codeNoteNotFound, "Note not found"))
+		return
+	}
 	if err != nil {
-		log.Printf("Error updating pin status: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Error updating pin status", "note_id", id, "error", err)
+		writeError(w, err)
 		return
 	}
-	log.Printf("Successfully toggled pin status to %v for note ID: %s", body.IsPinned, id)
-	w.WriteHeader(http.StatusOK)
+	publishNoteEvent(ctx, eventNotePinned, id, version, userID, nil)
+	slog.InfoContext(ctx, "Toggled pin status", "note_id", id, "pinned", body.IsPinned)
+
+	respondWithNote(w, r, http.StatusOK, id, role)
 }
 
-func getNotes(w http.ResponseWriter, _ *http.Request) {
-	log.Println("Fetching all notes")
-	// ... existing code ...
+func getNotes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := userIDFromContext(ctx)
+	slog.DebugContext(ctx, "Fetching notes")
 
-	// First get all notes
-	rows, err := db.Query("SELECT id, user_id, title, content, last_modified, is_pin FROM notes")
+	// First get all notes of the user and, on request, the notes shared with them
+	query := "SELECT " + noteColumns + ", 'owner' FROM notes WHERE user_id = $1"
+	if r.URL.Query().Get("shared") == "true" {
+		query += " UNION ALL SELECT " + noteColumns + ", role FROM notes JOIN note_shares ON note_shares.note_id = notes.id WHERE note_shares.grantee_user_id = $1"
+	}
+	rows, err := db.QueryContext(ctx, query, userID)
 	if err != nil {
-		log.Printf("Error querying notes: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Error querying notes", "error", err)
+		writeError(w, err)
 		return
 	}
 	defer func() { _ = rows.Close() }()
 
-	var notes []Note
+	notes := []Note{}
 	for rows.Next() {
-		var n Note
-		if err := rows.Scan(&n.ID, &n.UserID, &n.Title, &n.Content, &n.LastModified, &n.IsPinned); err != nil {
-			log.Printf("Error scanning note: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		var role string
+		n, err := scanNote(ctx, rows, &role)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error scanning note", "error", err)
+			writeError(w, err)
 			return
 		}
 
 		// Get files for this note
-		fileRows, err := db.Query("SELECT id, note_id, file_name, size, ext, file_url FROM note_files WHERE note_id = $1", n.ID)
-		if err != nil {
-			log.Printf("Error querying files for note %d: %v", n.ID, err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if n.Files, err = loadNoteFiles(ctx, n.ID); err != nil {
+			slog.ErrorContext(ctx, "Error querying note files", "note_id", n.ID, "error", err)
+			writeError(w, err)
 			return
 		}
-		defer func() { _ = fileRows.Close() }()
-
-		// Collect all files for this note
-		var files []File
-		for fileRows.Next() {
-			var f File
-			if err := fileRows.Scan(&f.ID, &f.NoteID, &f.FileName, &f.Size, &f.Extension, &f.URL); err != nil {
-				log.Printf("Error scanning file for note %d: %v", n.ID, err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			files = append(files, f)
+		if n.Items, err = loadNoteItems(ctx, n.ID); err != nil {
+			slog.ErrorContext(ctx, "Error querying note items", "note_id", n.ID, "error", err)
+			writeError(w, err)
+			return
 		}
-
-		n.Files = files
+		n.Role = role
 		notes = append(notes, n)
 	}
 
-	// ... existing code ...
-	err = json.NewEncoder(w).Encode(notes)
-	if err != nil {
-		log.Printf("Error encoding notes response: %v", err)
-	}
-	log.Printf("Successfully retrieved %d notes", len(notes))
+	writeJSON(ctx, w, http.StatusOK, notes)
+	slog.DebugContext(ctx, "Retrieved notes", "count", len(notes))
 }
 
 func getNoteByID(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
-	log.Printf("Fetching note with ID: %s", id)
-
-	var note Note
-	err := db.QueryRow("SELECT id, user_id, title, content, last_modified, is_pin FROM notes WHERE id = $1", id).Scan(&note.ID, &note.UserID, &note.Title, &note.Content, &note.LastModified, &note.IsPinned)
+	ctx := r.Context()
+	id, err := pathID(r, "id")
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Note not found", http.StatusNotFound)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
+	slog.DebugContext(ctx, "Fetching note", "note_id", id)
+
+	role, ok := authorizeNote(ctx, w, id, userIDFromContext(ctx), roleViewer)
+	if !ok {
+		return
+	}
+
+	respondWithNote(w, r, http.StatusOK, id, role)
+	slog.DebugContext(ctx, "Retrieved note", "note_id", id)
+}
 
-	// Get files for this note
-	fileRows, err := db.Query("SELECT id, note_id, file_name, size, ext, file_url FROM note_files WHERE note_id = $1", id)
+// respondWithNote writes the current state of a note, as seen by a user with the given role
+func respondWithNote(w http.ResponseWriter, r *http.Request, status int, id int, role string) {
+	ctx := r.Context()
+	note, err := scanNote(ctx, db.QueryRowContext(ctx, "SELECT "+noteColumns+" FROM notes WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		writeError(w, notFoundError(codeNoteNotFound, "Note not found"))
+		return
+	}
 	if err != nil {
-		log.Printf("Error querying files for note %s: %v", id, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Error querying note", "note_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+	if note.Files, err = loadNoteFiles(ctx, id); err != nil {
+		slog.ErrorContext(ctx, "Error querying note files", "note_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+	if note.Items, err = loadNoteItems(ctx, id); err != nil {
+		slog.ErrorContext(ctx, "Error querying note items", "note_id", id, "error", err)
+		writeError(w, err)
 		return
 	}
-	defer func() { _ = fileRows.Close() }()
+	note.Role = role
 
-	// Collect all files for this note
-	var files []File
-	for fileRows.Next() {
-		var f File
-		if err := fileRows.Scan(&f.ID, &f.NoteID, &f.FileName, &f.Size, &f.Extension, &f.URL); err != nil {
-			log.Printf("Error scanning file for note %s: %v", id, err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	writeJSON(ctx, w, status, note)
+}
+
+func createNote(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	slog.DebugContext(ctx, "Creating note")
+
+	// A note made from a template may come without a body
+	fromTemplate := r.URL.Query().Has("templateId")
+	var n Note
+	if !fromTemplate || r.ContentLength != 0 {
+		if err := decodeJSON(w, r, &n); err != nil {
+			slog.WarnContext(ctx, "Error decoding create note request", "error", err)
+			writeError(w, err)
 			return
 		}
-		files = append(files, f)
 	}
 
-	note.Files = files
+	// Notes always belong to the authenticated user, whatever the payload says
+	n.UserID = userIDFromContext(ctx)
 
-	err = json.NewEncoder(w).Encode(note)
-	if err != nil {
-		log.Printf("Error encoding note response: %v", err)
+	if fromTemplate {
+		if err := applyTemplate(r, &n); err != nil {
+			writeError(w, err)
+			return
+		}
 	}
-	log.Printf("Successfully retrieved note with ID: %s", id)
-}
 
-func createNote(w http.ResponseWriter, r *http.Request) {
-	log.Println("Creating new note")
-	var n Note
-	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
-		log.Printf("Error decoding create note request: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := validateNote(n); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	// Convert UserID to string before verifying
-	userIDStr := strconv.Itoa(n.UserID)
-	isVerified, err := VerifyTelegramAuth(userIDStr)
-	if err != nil || !isVerified {
-		log.Printf("User ID verification failed for user ID: %d", n.UserID)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	noteID, version, err := insertNote(ctx, db, n)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error creating note", "error", err)
+		writeError(w, err)
 		return
 	}
+	indexNoteItems(ctx, noteID)
+	publishNoteEvent(ctx, eventNoteCreated, noteID, version, n.UserID, []int{n.UserID})
+	slog.InfoContext(ctx, "Created note", "note_id", noteID)
+
+	w.Header().Set("Location", fmt.Sprintf(apiPrefix+"/notes/%d", noteID))
+	respondWithNote(w, r, http.StatusCreated, noteID, roleOwner)
+}
+
+// insertNote stores a new note and returns its ID and version.
+// A zero LastModified means the note is modified now.
+func insertNote(ctx context.Context, q querier, n Note) (int, int64, error) {
+	lastModified := n.LastModified
+	if lastModified.IsZero() {
+		lastModified = time.Now()
+	}
+
+	key, err := userDataKey(ctx, n.UserID)
+	if err != nil {
+		return 0, 0, err
+	}
+	// The note gets its ID first, the sealed title and content authenticate it
+	id, err := nextRowID(ctx, q, "notes")
+	if err != nil {
+		return 0, 0, err
+	}
+	title, content, keyID, err := sealNoteText(key, int(id), n.Title, n.Content)
+	if err != nil {
+		return 0, 0, err
+	}
+	encryption, err := encryptionColumn(n.Encryption)
+	if err != nil {
+		return 0, 0, err
+	}
 
 	// Use QueryRow with RETURNING clause to get the inserted ID
 	var noteID int
-	err = db.QueryRow(
-		"INSERT INTO notes (user_id, title, content, last_modified, is_pin) VALUES ($1, $2, $3, $4, $5) RETURNING id",
-		n.UserID, n.Title, n.Content, time.Now(), n.IsPinned,
-	).Scan(&noteID)
+	var version int64
+	err = q.QueryRowContext(ctx,
+		"INSERT INTO notes (id, user_id, title, content, last_modified, is_pin, remind_at, remind_recurrence, data_key_id, is_locked, encryption) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id, version",
+		id, n.UserID, title, content, lastModified, n.IsPinned, n.RemindAt, n.RemindRecurrence, keyID, n.IsLocked, encryption,
+	).Scan(&noteID, &version)
+	return noteID, version, err
+}
+
+func updateNote(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := pathID(r, "id")
 	if err != nil {
-		log.Printf("Error creating note: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
+	slog.DebugContext(ctx, "Updating note", "note_id", id)
 
-	// Return the created note ID in the response
-	w.Header().Set("Content-Type", "application/json")
-	response := map[string]int{"id": noteID}
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding response: %v", err)
+	var n Note
+	if err := decodeJSON(w, r, &n); err != nil {
+		slog.WarnContext(ctx, "Error decoding update note request", "error", err)
+		writeError(w, err)
 		return
 	}
 
-	log.Printf("Successfully created note with ID %d for user: %d", noteID, n.UserID)
-}
+	userID := userIDFromContext(ctx)
+	role, ok := authorizeNote(ctx, w, id, userID, roleEditor)
+	if !ok {
+		return
+	}
+	// Reminders are delivered to the owner, so only they can change them
+	if role != roleOwner {
+		n.RemindAt = nil
+	}
+	if err := validateNote(n); err != nil {
+		writeError(w, err)
+		return
+	}
 
-func updateNote(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
-	log.Printf("Updating note with ID: %s", id)
+	var keyID *int64
+	key, err := noteDataKey(ctx, id)
+	if err == nil {
+		n.Title, n.Content, keyID, err = sealNoteText(key, id, n.Title, n.Content)
+	}
+	if err == sql.ErrNoRows {
+		writeError(w, notFoundError(codeNoteNotFound, "Note not found"))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error encrypting note", "note_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
 
-	var n Note
-	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
-		log.Printf("Error decoding update note request: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	encryption, err := encryptionColumn(n.Encryption)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	_, err := db.Exec("UPDATE notes SET title=$1, content=$2, last_modified=$3, is_pin=$4 WHERE id=$5", n.Title, n.Content, time.Now(), n.IsPinned, id)
+	// Updates keep the lock state, lockNote changes it. A locked note gets new ciphertext
+	// and metadata on every save.
+	var version int64
+	err = db.QueryRowContext(ctx,
+		"UPDATE notes SET title=$1, content=$2, last_modified=$3, is_pin=$4, data_key_id=$5, encryption=$6, version=version+1 WHERE id=$7 AND is_locked=$8 RETURNING version",
+		n.Title, n.Content, time.Now(), n.IsPinned, keyID, encryption, id, n.IsLocked,
+	).Scan(&version)
+	if err == sql.ErrNoRows {
+		// Either the note is gone or its lock state differs from the update
+		var locked bool
+		if locked, err = noteIsLocked(ctx, id); err == nil {
+			writeError(w, lockStateError(locked))
+			return
+		}
+	}
+	if err == sql.ErrNoRows {
+		writeError(w, notFoundError(codeNoteNotFound, "Note not found"))
+		return
+	}
 	if err != nil {
-		log.Printf("Error updating note: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Error updating note", "note_id", id, "error", err)
+		writeError(w, err)
 		return
 	}
-	log.Printf("Successfully updated note with ID: %s", id)
+
+	indexNoteItems(ctx, id)
+
+	// Reminder is only touched when the client sends one, so older clients
+	// that don't know about reminders don't clear them on save
+	if n.RemindAt != nil {
+		if _, err := setNoteReminder(ctx, id, n.RemindAt, n.RemindRecurrence); err != nil {
+			slog.ErrorContext(ctx, "Error updating note reminder", "note_id", id, "error", err)
+			writeError(w, err)
+			return
+		}
+	}
+	publishNoteEvent(ctx, eventNoteUpdated, id, version, userID, nil)
+	slog.InfoContext(ctx, "Updated note", "note_id", id, "version", version)
+
+	respondWithNote(w, r, http.StatusOK, id, role)
 }
 
 func deleteNote(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
-	log.Printf("Deleting note with ID: %s", id)
+	ctx := r.Context()
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	slog.DebugContext(ctx, "Deleting note", "note_id", id)
 
-	// First, get all files associated with the note
-	rows, err := db.Query("SELECT id, file_name, ext FROM note_files WHERE note_id = $1", id)
+	userID := userIDFromContext(ctx)
+	if _, ok := authorizeNote(ctx, w, id, userID, roleOwner); !ok {
+		return
+	}
+
+	// Collect who to notify while the shares still exist
+	audience, err := noteAudience(ctx, id)
 	if err != nil {
-		log.Printf("Error querying note files: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Error querying note audience", "note_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+
+	version, err := removeNote(ctx, id, nil)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, notFoundError(codeNoteNotFound, "Note not found"))
 		return
 	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting note", "note_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+
+	publishNoteEvent(ctx, eventNoteDeleted, id, version+1, userID, audience)
+	slog.InfoContext(ctx, "Deleted note", "note_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeNote deletes a note and its file records from the database and queues the
+// removal of its files from storage. It returns the last version of the note. With a base
+// version, a note that changed since then is kept and sql.ErrNoRows is returned.
+func removeNote(ctx context.Context, id int, baseVersion *int64) (int64, error) {
+	// First, get all files associated with the note
+	rows, err := db.QueryContext(ctx, "SELECT id, file_name, ext FROM note_files WHERE note_id = $1", id)
+	if err != nil {
+		return 0, err
+	}
 	defer func() { _ = rows.Close() }()
 
-	// Delete each file from MinIO
+	var objectNames []string
 	for rows.Next() {
 		var fileID int
 		var fileName, ext string
 		if err := rows.Scan(&fileID, &fileName, &ext); err != nil {
-			log.Printf("Error scanning file row: %v", err)
+			slog.Error("Error scanning note file", "note_id", id, "error", err)
 			continue
 		}
-
-		objectName := fmt.Sprintf("%s-%s.%s", id, fileName, ext)
-		if err := deleteFileFromMinio(noteFilesBucket, objectName); err != nil {
-			log.Printf("Error deleting file from MinIO: %v", err)
-			// Continue with deletion even if MinIO deletion fails
-		}
+		objectNames = append(objectNames, noteFileObjectName(id, fileName, ext))
 	}
 
 	// Delete all files from database and then delete the note (using transaction)
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Printf("Error beginning transaction: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return 0, err
 	}
+	defer func() { _ = tx.Rollback() }()
 
 	// Delete files first (due to foreign key constraint)
-	_, err = tx.Exec("DELETE FROM note_files WHERE note_id = $1", id)
-	if err != nil {
-		err = tx.Rollback()
-		if err != nil {
-			log.Printf("Error rolling back transaction: %v", err)
-		}
-		log.Printf("Error deleting note files from database: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if _, err := tx.ExecContext(ctx, "DELETE FROM note_files WHERE note_id = $1", id); err != nil {
+		return 0, fmt.Errorf("deleting note files: %w", err)
 	}
 
 	// Then delete the note
-	_, err = tx.Exec("DELETE FROM notes WHERE id = $1", id)
-	if err != nil {
-		err = tx.Rollback()
-		if err != nil {
-			log.Printf("Error rolling back transaction: %v", err)
-		}
-		log.Printf("Error deleting note: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	query, args := "DELETE FROM notes WHERE id = $1 RETURNING version", []any{id}
+	if baseVersion != nil {
+		query, args = "DELETE FROM notes WHERE id = $1 AND version = $2 RETURNING version", []any{id, *baseVersion}
+	}
+	var version int64
+	if err := tx.QueryRowContext(ctx, query, args...).Scan(&version); err != nil {
+		return 0, err
 	}
 
 	if err := tx.Commit(); err != nil {
-		log.Printf("Error committing transaction: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return 0, err
+	}
+
+	// Files are removed in the background and retried if storage fails
+	if len(objectNames) > 0 {
+		payload := purgeBlobsPayload{Bucket: noteFilesBucket, Objects: objectNames}
+		if _, err := enqueueJob(context.WithoutCancel(ctx), jobTypePurgeBlobs, nil, payload); err != nil {
+			slog.Error("Error queueing removal of note files", "note_id", id, "error", err)
+		}
 	}
+	return version, nil
+}
 
-	log.Printf("Successfully deleted note and associated files for note ID: %s", id)
+// extendUploadDeadlines gives a large upload more time than the server timeouts allow.
+// The write deadline is moved too, it runs from the end of the request headers.
+func extendUploadDeadlines(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	deadline := time.Now().Add(uploadTimeout)
+	if err := rc.SetReadDeadline(deadline); err != nil {
+		slog.WarnContext(r.Context(), "Error extending read deadline", "error", err)
+	}
+	if err := rc.SetWriteDeadline(deadline.Add(defaultWriteTimeout)); err != nil {
+		slog.WarnContext(r.Context(), "Error extending write deadline", "error", err)
+	}
 }
 
 func uploadFile(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	noteID := vars["id"]
-	log.Printf("[uploadFile] Starting file upload for note ID: %s", noteID)
+	ctx := r.Context()
+	noteID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	slog.DebugContext(ctx, "Starting file upload", "note_id", noteID)
+
+	userID := userIDFromContext(ctx)
+	if _, ok := authorizeNote(ctx, w, noteID, userID, roleEditor); !ok {
+		return
+	}
+
+	extendUploadDeadlines(w, r)
 
 	// Parse multipart form with 32MB max memory
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		log.Printf("[uploadFile] Error parsing multipart form: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	_, span := tracer.Start(ctx, "parseMultipartForm")
+	err = r.ParseMultipartForm(32 << 20)
+	endSpan(span, err)
+	if err != nil {
+		slog.WarnContext(ctx, "Error parsing multipart form", "error", err)
+		writeError(w, invalidForm(err))
 		return
 	}
 
 	file, header, err := r.FormFile("file")
 	if err != nil {
-		log.Printf("[uploadFile] Error getting file from form: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		slog.WarnContext(ctx, "Error getting file from form", "error", err)
+		writeError(w, invalidForm(err))
 		return
 	}
 	defer func() { _ = file.Close() }()
 
-	log.Printf("[uploadFile] Received file: %s, size: %d bytes", header.Filename, header.Size)
+	slog.DebugContext(ctx, "Received file", "filename", header.Filename, "size", header.Size)
 
-	// Read file data
-	fileData := make([]byte, header.Size)
-	_, err = file.Read(fileData)
+	encryption, err := uploadEncryption(ctx, noteID, r.FormValue("encryption"))
 	if err != nil {
-		log.Printf("[uploadFile] Error reading file data: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	log.Printf("[uploadFile] Successfully read file data")
-
-	// Upload to MinIO
-	bucketName := noteFilesBucket
-	objectName := fmt.Sprintf("%s-%s", noteID, header.Filename)
-	log.Printf("[uploadFile] Attempting to upload file to MinIO bucket: %s, object: %s", bucketName, objectName)
-
-	downloadURL, err := uploadFileToMinio(bucketName, objectName, fileData)
+	// The file streams from the parsed form into storage, sealed on the way if the note has a key
+	fileInfo, err := saveNoteFile(ctx, noteID, header.Filename, file, header.Size, encryption)
 	if err != nil {
-		log.Printf("[uploadFile] Error uploading to MinIO: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Error saving file", "note_id", noteID, "error", err)
+		writeError(w, err)
 		return
 	}
 
-	log.Printf("[uploadFile] Download URL: %s", downloadURL)
+	if version, err := bumpNoteVersion(ctx, noteID); err != nil {
+		slog.ErrorContext(ctx, "Error bumping note version", "note_id", noteID, "error", err)
+	} else {
+		publishNoteEvent(ctx, eventAttachmentChanged, noteID, version, userID, nil)
+	}
 
-	log.Printf("[uploadFile] Successfully uploaded file to MinIO")
+	writeJSON(ctx, w, http.StatusCreated, fileInfo)
+	slog.InfoContext(ctx, "Uploaded file", "note_id", noteID, "file_id", fileInfo.ID, "size", fileInfo.Size)
+}
 
-	name, ext := getFileInfo(header.Filename)
+// saveNoteFile uploads the size bytes of an attachment read from r to storage and saves
+// its metadata. encryption is set for attachments of locked notes, which the client encrypted.
+func saveNoteFile(ctx context.Context, noteID int, filename string, r io.Reader, size int64, encryption *FileEncryption) (File, error) {
+	name, ext := getFileInfo(filename)
 
-	// Save file metadata to database with presigned URL
-	log.Printf("[uploadFile] Saving file metadata to database")
-	var fileID int
-	err = db.QueryRow(
-		"INSERT INTO note_files (note_id, file_name, size, ext, file_url) VALUES ($1, $2, $3, $4, $5) RETURNING id",
-		noteID, name, header.Size, ext, downloadURL,
-	).Scan(&fileID)
+	key, err := noteDataKey(ctx, noteID)
 	if err != nil {
-		log.Printf("[uploadFile] Error saving file metadata: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return File{}, fmt.Errorf("loading data key: %w", err)
+	}
+	var keyID *int64
+	if key != nil {
+		keyID = &key.id
 	}
 
-	log.Printf("[uploadFile] Successfully saved file metadata with ID: %d", fileID)
+	objectName := noteFileObjectName(noteID, name, ext)
+	downloadURL, err := storeNoteFile(ctx, objectName, r, size, key)
+	if err != nil {
+		return File{}, fmt.Errorf("uploading file: %w", err)
+	}
 
-	// Return the file information
-	fileInfo := File{
-		ID:        fileID,
-		NoteID:    parseInt(noteID),
-		FileName:  header.Filename,
-		Extension: ext,
-		Size:      int(header.Size),
-		URL:       downloadURL,
+	encryptionJSON, err := encryptionColumn(encryption)
+	if err != nil {
+		return File{}, err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(fileInfo); err != nil {
-		log.Printf("[uploadFile] Error encoding response: %v", err)
+	// Save file metadata to database with the download link
+	var fileID int
+	err = db.QueryRowContext(ctx,
+		"INSERT INTO note_files (note_id, file_name, size, ext, file_url, data_key_id, encryption) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+		noteID, name, size, ext, downloadURL, keyID, encryptionJSON,
+	).Scan(&fileID)
+	if err != nil {
+		return File{}, fmt.Errorf("saving file metadata: %w", err)
 	}
-	log.Printf("[uploadFile] Successfully completed file upload process for %s (ID: %d) in note ID: %s", header.Filename, fileID, noteID)
+
+	// Return the file information
+	return File{
+		ID:         fileID,
+		NoteID:     noteID,
+		FileName:   filename,
+		Extension:  ext,
+		Size:       int(size),
+		URL:        downloadURL,
+		Encryption: encryption,
+		KeyID:      keyID,
+	}, nil
 }
 
 func getFileInfo(filename string) (string, string) {
@@ -546,69 +930,71 @@ func getFileInfo(filename string) (string, string) {
 }
 
 func deleteFile(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	noteID := vars["id"]
-	log.Printf("[deleteFile] Starting file deletion process for note ID: %s", noteID)
+	ctx := r.Context()
+	noteID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	slog.DebugContext(ctx, "Starting file deletion", "note_id", noteID)
+
+	userID := userIDFromContext(ctx)
+	if _, ok := authorizeNote(ctx, w, noteID, userID, roleEditor); !ok {
+		return
+	}
 
 	// Create a struct to hold the request body
 	var requestBody struct {
 		FileID int `json:"attachmentId"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
-		log.Printf("[deleteFile] Error decoding request body: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := decodeJSON(w, r, &requestBody); err != nil {
+		slog.WarnContext(ctx, "Error decoding delete file request", "error", err)
+		writeError(w, err)
 		return
 	}
 
 	fileID := requestBody.FileID
-	log.Printf("[deleteFile] Attempting to delete file ID: %d from note ID: %s", fileID, noteID)
-
 	// Get file information from database
 	var fileName, ext string
-	log.Printf("[deleteFile] Querying database for file information")
-	err := db.QueryRow("SELECT file_name, ext FROM note_files WHERE id = $1 AND note_id = $2", fileID, noteID).Scan(&fileName, &ext)
+	err = db.QueryRowContext(ctx, "SELECT file_name, ext FROM note_files WHERE id = $1 AND note_id = $2", fileID, noteID).Scan(&fileName, &ext)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			log.Printf("[deleteFile] File not found - ID: %d, Note ID: %s", fileID, noteID)
-			http.Error(w, "File not found", http.StatusNotFound)
+			writeError(w, notFoundError(codeFileNotFound, "File not found"))
 			return
 		}
-		log.Printf("[deleteFile] Database query error: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Error querying file", "note_id", noteID, "file_id", fileID, "error", err)
+		writeError(w, err)
 		return
 	}
-	log.Printf("[deleteFile] Found file with name: %s", fileName)
 
-	// Delete from MinIO
-	bucketName := noteFilesBucket
-	objectName := fmt.Sprintf("%s-%s.%s", noteID, fileName, ext)
-	log.Printf("[deleteFile] Attempting to delete from MinIO - bucket: %s, object: %s", bucketName, objectName)
-	if err := deleteFileFromMinio(bucketName, objectName); err != nil {
-		log.Printf("[deleteFile] Failed to delete from MinIO: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	objectName := noteFileObjectName(noteID, fileName, ext)
+	if err := blobs.Remove(ctx, noteFilesBucket, objectName); err != nil {
+		slog.ErrorContext(ctx, "Error deleting file from storage", "note_id", noteID, "file_id", fileID, "error", err)
+		writeError(w, err)
 		return
 	}
-	log.Printf("[deleteFile] Successfully deleted file from MinIO storage")
 
 	// Delete from database
-	log.Printf("[deleteFile] Attempting to delete file metadata from database")
-	result, err := db.Exec("DELETE FROM note_files WHERE id = $1 AND note_id = $2", fileID, noteID)
+	result, err := db.ExecContext(ctx, "DELETE FROM note_files WHERE id = $1 AND note_id = $2", fileID, noteID)
 	if err != nil {
-		log.Printf("[deleteFile] Failed to delete file metadata from database: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		slog.ErrorContext(ctx, "Error deleting file metadata", "note_id", noteID, "file_id", fileID, "error", err)
+		writeError(w, err)
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	log.Printf("[deleteFile] Database deletion complete - rows affected: %d", rowsAffected)
+	// A concurrent request may have deleted it first
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		writeError(w, notFoundError(codeFileNotFound, "File not found"))
+		return
+	}
 
-	log.Printf("[deleteFile] Successfully completed deletion of file ID %d from note ID: %s", fileID, noteID)
-	w.WriteHeader(http.StatusOK)
-}
+	if version, err := bumpNoteVersion(ctx, noteID); err != nil {
+		slog.ErrorContext(ctx, "Error bumping note version", "note_id", noteID, "error", err)
+	} else {
+		publishNoteEvent(ctx, eventAttachmentChanged, noteID, version, userID, nil)
+	}
 
-// Helper function to parse string to int
-func parseInt(s string) int {
-	i, _ := strconv.Atoi(s)
-	return i
+	slog.InfoContext(ctx, "Deleted file", "note_id", noteID, "file_id", fileID)
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace   = "note_be"
+	defaultMetricsAddr = ":9090"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, by route template and status.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to serve HTTP requests, by route template and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	storageOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Latency of blob storage operations, by backend.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "operation"})
+
+	storageOperationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_operation_errors_total",
+		Help:      "Blob storage operations that failed, by backend.",
+	}, []string{"backend", "operation"})
+
+	uploadedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploaded_bytes_total",
+		Help:      "Bytes of attachments uploaded to blob storage.",
+	})
+
+	jobsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "jobs_processed_total",
+		Help:      "Background job runs, by job type and outcome: succeeded, retried or dead.",
+	}, []string{"type", "outcome"})
+
+	deprecatedAPIRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "deprecated_api_requests_total",
+		Help:      "Requests served through the unversioned API paths.",
+	})
+
+	rateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Requests rejected with 429, by route class.",
+	}, []string{"class"})
+)
+
+// observeHTTPRequest records a served request, called by the access log middleware
+func observeHTTPRequest(method, route string, status int, elapsed time.Duration) {
+	code := strconv.Itoa(status)
+	httpRequestsTotal.WithLabelValues(method, route, code).Inc()
+	httpRequestDuration.WithLabelValues(method, route, code).Observe(elapsed.Seconds())
+}
+
+// observeStorage records the latency and outcome of a blob storage operation started at start
+func observeStorage(backend, operation string, start time.Time, err error) {
+	storageOperationDuration.WithLabelValues(backend, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		storageOperationErrors.WithLabelValues(backend, operation).Inc()
+	}
+}
+
+// jobQueueCollector reports the number of jobs in each status when scraped
+type jobQueueCollector struct {
+	desc *prometheus.Desc
+}
+
+func newJobQueueCollector() *jobQueueCollector {
+	return &jobQueueCollector{
+		desc: prometheus.NewDesc(metricsNamespace+"_jobs", "Background jobs in the queue, by status.", []string{"status"}, nil),
+	}
+}
+
+func (c *jobQueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *jobQueueCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT status, count(*) FROM jobs GROUP BY status")
+	if err != nil {
+		slog.Error("Error counting jobs", "error", err)
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	defer func() { _ = rows.Close() }()
+
+	counts := map[string]float64{jobQueued: 0, jobRunning: 0, jobSucceeded: 0, jobDead: 0}
+	for rows.Next() {
+		var status string
+		var n float64
+		if err := rows.Scan(&status, &n); err != nil {
+			ch <- prometheus.NewInvalidMetric(c.desc, err)
+			return
+		}
+		counts[status] = n
+	}
+	for status, n := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, n, status)
+	}
+}
+
+// serveMetrics exposes /metrics on the admin address from METRICS_ADDR, kept off the public port.
+// It also registers the collectors that need the database.
+func serveMetrics() {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "notes"), newJobQueueCollector())
+
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		addr = defaultMetricsAddr
+	}
+
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           adminMux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		slog.Info("Metrics server started", "addr", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics server stopped", "error", err)
+		}
+	}()
+}
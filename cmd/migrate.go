@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TG-Note-App/note-be/migrations"
+	"github.com/pressly/goose/v3"
+	"github.com/pressly/goose/v3/lock"
+)
+
+// newMigrationProvider returns a goose provider for the embedded migrations. The session
+// locker holds a Postgres advisory lock while migrating, so replicas starting together
+// apply each migration once.
+func newMigrationProvider() (*goose.Provider, error) {
+	locker, err := lock.NewPostgresSessionLocker()
+	if err != nil {
+		return nil, err
+	}
+	return goose.NewProvider(goose.DialectPostgres, db, migrations.FS, goose.WithSessionLocker(locker))
+}
+
+// migrateOnStartup applies pending migrations. It fails when the database was migrated
+// by a newer binary, running against a schema we don't know could corrupt data.
+func migrateOnStartup(ctx context.Context) error {
+	provider, err := newMigrationProvider()
+	if err != nil {
+		return err
+	}
+
+	if err := checkSchemaVersion(ctx, provider); err != nil {
+		return err
+	}
+
+	results, err := provider.Up(ctx)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		slog.Info("Applied migration", "migration", res.Source.Path, "duration", res.Duration.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// checkSchemaVersion fails when the database version is newer than the newest embedded migration
+func checkSchemaVersion(ctx context.Context, provider *goose.Provider) error {
+	current, err := provider.GetDBVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	var latest int64
+	for _, src := range provider.ListSources() {
+		latest = max(latest, src.Version)
+	}
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d), refusing to start", current, latest)
+	}
+	return nil
+}
+
+// runMigrate is the "migrate" subcommand: note-be migrate up|down|status
+func runMigrate(args []string) {
+	if len(args) != 1 {
+		fatal("Invalid migrate command", errors.New("usage: note-be migrate up|down|status"))
+	}
+
+	ctx := context.Background()
+	provider, err := newMigrationProvider()
+	if err != nil {
+		fatal("Error loading migrations", err)
+	}
+
+	switch args[0] {
+	case "up":
+		results, err := provider.Up(ctx)
+		for _, res := range results {
+			slog.Info("Applied migration", "result", res.String())
+		}
+		if err != nil {
+			fatal("Error applying migrations", err)
+		}
+		if len(results) == 0 {
+			slog.Info("No migrations to apply")
+		}
+	case "down":
+		res, err := provider.Down(ctx)
+		if res != nil {
+			slog.Info("Rolled back migration", "result", res.String())
+		}
+		if err != nil {
+			fatal("Error rolling back migration", err)
+		}
+	case "status":
+		statuses, err := provider.Status(ctx)
+		if err != nil {
+			fatal("Error reading migration status", err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "VERSION\tSTATE\tAPPLIED AT\tMIGRATION")
+		for _, st := range statuses {
+			appliedAt := "-"
+			if !st.AppliedAt.IsZero() {
+				appliedAt = st.AppliedAt.Format(time.RFC3339)
+			}
+			_, _ = fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", st.Source.Version, st.State, appliedAt, st.Source.Path)
+		}
+		_ = tw.Flush()
+	default:
+		fatal("Invalid migrate command", fmt.Errorf("unknown command %q, expected up, down or status", args[0]))
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/TG-Note-App/note-be/api"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/gorilla/mux"
+)
+
+// Largest response body checked against the spec, bigger ones are not validated
+const maxValidatedResponseSize = 4 << 20
+
+// loadAPISpec parses and checks the embedded OpenAPI document
+func loadAPISpec(ctx context.Context) (*openapi3.T, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(api.Spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.Validate(ctx); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// serveAPISpec serves the OpenAPI document as JSON
+func serveAPISpec(doc *openapi3.T) (http.HandlerFunc, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(data); err != nil {
+			slog.WarnContext(r.Context(), "Error writing OpenAPI document", "error", err)
+		}
+	}, nil
+}
+
+// validateAPI checks requests against the OpenAPI document and rejects those that don't
+// match it. With OPENAPI_VALIDATE_RESPONSES=true it also checks JSON responses and logs
+// the ones that drift from the document. Requests for paths outside the document,
+// like the frontend files, pass through.
+func validateAPI(doc *openapi3.T) (mux.MiddlewareFunc, error) {
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+	validateResponses := os.Getenv("OPENAPI_VALIDATE_RESPONSES") == "true"
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route, pathParams, err := router.FindRoute(r)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// The body is read in full to validate it, so it is capped like the largest JSON
+			// body a handler accepts. Uploads are left to the handlers.
+			input := &openapi3filter.RequestValidationInput{
+				Request:    r,
+				PathParams: pathParams,
+				Route:      route,
+				Options: &openapi3filter.Options{
+					// requireAuth authenticates the request
+					AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+					ExcludeRequestBody: isMultipart(r),
+				},
+			}
+			if !input.Options.ExcludeRequestBody && r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, maxSyncBodySize)
+			}
+			if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+				slog.WarnContext(r.Context(), "Request does not match the API spec", "error", err)
+				writeError(w, requestValidationError(err))
+				return
+			}
+
+			if !validateResponses || !hasJSONSuccess(route.Operation) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			rec := &bodyRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			validateResponse(r.Context(), input, rec)
+		})
+	}, nil
+}
+
+// requestValidationError turns a validation failure into the API error returned to the client
+func requestValidationError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return err
+	}
+
+	var reqErr *openapi3filter.RequestError
+	if !errors.As(err, &reqErr) {
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, err.Error())
+	}
+
+	switch {
+	case reqErr.Parameter != nil && reqErr.Parameter.In == openapi3.ParameterInPath:
+		return newAPIError(http.StatusBadRequest, codeInvalidID, reqErr.Error())
+	case reqErr.Parameter != nil:
+		return newAPIError(http.StatusBadRequest, codeInvalidRequest, reqErr.Error())
+	}
+
+	var schemaErr *openapi3.SchemaError
+	if errors.As(reqErr.Err, &schemaErr) {
+		return validationError(FieldError{
+			Field:   strings.Join(schemaErr.JSONPointer(), "."),
+			Message: schemaErr.Reason,
+		})
+	}
+	return newAPIError(http.StatusBadRequest, codeInvalidJSON, reqErr.Error())
+}
+
+// validateResponse checks a recorded response against the document. It can only be logged,
+// the response has already been sent.
+func validateResponse(ctx context.Context, input *openapi3filter.RequestValidationInput, rec *bodyRecorder) {
+	mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if rec.truncated || (mediaType != "application/json" && rec.status != http.StatusNoContent) {
+		return
+	}
+
+	err := openapi3filter.ValidateResponse(ctx, &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 rec.status,
+		Header:                 rec.Header(),
+		Body:                   io.NopCloser(bytes.NewReader(rec.body.Bytes())),
+		Options:                &openapi3filter.Options{IncludeResponseStatus: true},
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Response does not match the API spec", "status", rec.status, "error", err)
+	}
+}
+
+// hasJSONSuccess reports whether the operation answers with JSON on success,
+// streams and file downloads are not recorded
+func hasJSONSuccess(op *openapi3.Operation) bool {
+	for code, resp := range op.Responses.Map() {
+		if strings.HasPrefix(code, "2") && resp.Value != nil && resp.Value.Content.Get("application/json") != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func isMultipart(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
+
+// bodyRecorder passes a response through while keeping a copy of it for validation
+type bodyRecorder struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (b *bodyRecorder) WriteHeader(status int) {
+	b.status = status
+	b.ResponseWriter.WriteHeader(status)
+}
+
+func (b *bodyRecorder) Write(p []byte) (int, error) {
+	if !b.truncated {
+		if b.body.Len()+len(p) > maxValidatedResponseSize {
+			b.truncated = true
+			b.body.Reset()
+		} else {
+			b.body.Write(p)
+		}
+	}
+	return b.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (b *bodyRecorder) Unwrap() http.ResponseWriter {
+	return b.ResponseWriter
+}
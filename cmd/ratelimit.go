@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route classes with their own rate limit
+const (
+	rateReads   = "reads"
+	rateWrites  = "writes"
+	rateUploads = "uploads"
+)
+
+// Default limits of the route classes, overridden by RATE_LIMIT_READS, RATE_LIMIT_WRITES
+// and RATE_LIMIT_UPLOADS as "<requests>/<period>", like "60/1m", or "off"
+var defaultRateLimits = map[string]rateLimit{
+	rateReads:   {requests: 300, period: time.Minute},
+	rateWrites:  {requests: 60, period: time.Minute},
+	rateUploads: {requests: 10, period: time.Minute},
+}
+
+// Idle buckets are dropped from the in-memory store at most this often
+const rateLimitSweepInterval = time.Minute
+
+// rateLimit allows bursts of up to requests, refilled evenly over period
+type rateLimit struct {
+	requests int
+	period   time.Duration
+}
+
+func (l rateLimit) perSecond() float64 {
+	return float64(l.requests) / l.period.Seconds()
+}
+
+func parseRateLimit(v string) (rateLimit, bool, error) {
+	if v == "off" {
+		return rateLimit{}, false, nil
+	}
+	requests, period, found := strings.Cut(v, "/")
+	if !found {
+		return rateLimit{}, false, fmt.Errorf("want <requests>/<period>, got %q", v)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n <= 0 {
+		return rateLimit{}, false, fmt.Errorf("invalid request count %q", requests)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return rateLimit{}, false, fmt.Errorf("invalid period %q", period)
+	}
+	return rateLimit{requests: n, period: d}, true, nil
+}
+
+// rateLimitStore keeps the token buckets. The in-memory store limits every replica on
+// its own, a shared store can implement the interface to limit across replicas.
+type rateLimitStore interface {
+	// Take removes a token from the bucket of key. When the bucket is empty it reports
+	// how long until the next token is available.
+	Take(ctx context.Context, key string, limit rateLimit) (ok bool, retryAfter time.Duration, err error)
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	// period refills the bucket completely, an idle bucket is dropped after it
+	period time.Duration
+}
+
+// memoryRateLimitStore keeps the buckets of this process in a map
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*tokenBucket{}, lastSweep: time.Now()}
+}
+
+func (s *memoryRateLimitStore) Take(_ context.Context, key string, limit rateLimit) (bool, time.Duration, error) {
+	now := time.Now()
+	rate := limit.perSecond()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= rateLimitSweepInterval {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.requests), updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.requests), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+	b.period = limit.period
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second)), nil
+	}
+	b.tokens--
+	return true, 0, nil
+}
+
+// sweep drops buckets idle for longer than their period, they would be full again anyway
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if now.Sub(b.updated) > b.period {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+// rateLimiter limits requests per authenticated user, or per client IP for anonymous requests
+type rateLimiter struct {
+	store   rateLimitStore
+	limits  map[string]rateLimit
+	proxies trustedProxies
+}
+
+// newRateLimiter reads the limits of the route classes and TRUSTED_PROXIES from the environment
+func newRateLimiter(store rateLimitStore) (*rateLimiter, error) {
+	limits := map[string]rateLimit{}
+	for class, limit := range defaultRateLimits {
+		name := "RATE_LIMIT_" + strings.ToUpper(class)
+		if v := os.Getenv(name); v != "" {
+			l, enabled, err := parseRateLimit(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			if !enabled {
+				slog.Info("Rate limit disabled", "class", class)
+				continue
+			}
+			limit = l
+		}
+		limits[class] = limit
+	}
+
+	proxies, err := parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+	return &rateLimiter{store: store, limits: limits, proxies: proxies}, nil
+}
+
+// limit rejects requests over the limit of the route class with 429 and Retry-After.
+// It goes inside requireAuth so that authenticated requests count against the user.
+func (l *rateLimiter) limit(class string, next http.HandlerFunc) http.HandlerFunc {
+	limit, enabled := l.limits[class]
+	if !enabled {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		key := class + ":ip:" + l.proxies.clientKey(r)
+		if userID := userIDFromContext(ctx); userID != 0 {
+			key = class + ":user:" + strconv.Itoa(userID)
+		}
+
+		ok, retryAfter, err := l.store.Take(ctx, key, limit)
+		if err != nil {
+			// A broken store must not take the API down with it
+			slog.ErrorContext(ctx, "Error checking rate limit", "class", class, "error", err)
+			next(w, r)
+			return
+		}
+		if !ok {
+			rateLimitedRequests.WithLabelValues(class).Inc()
+			slog.WarnContext(ctx, "Rate limited request", "class", class, "key", key, "retry_after", retryAfter)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, newAPIError(http.StatusTooManyRequests, codeRateLimited, "Too many requests, retry later"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// trustedProxies are the reverse proxies whose X-Forwarded-For is believed
+type trustedProxies []netip.Prefix
+
+// parseTrustedProxies parses a comma-separated list of IPs and CIDR ranges
+func parseTrustedProxies(v string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+func (p trustedProxies) trusts(addr netip.Addr) bool {
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only followed through
+// trusted proxies, read from the right, as anything left of them is set by the client.
+func (p trustedProxies) clientIP(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0 && p.trusts(addr); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+	}
+	return addr, true
+}
+
+// clientKey identifies the client for rate limiting. IPv6 clients usually hold a
+// whole /64, so they are limited by that prefix.
+func (p trustedProxies) clientKey(r *http.Request) string {
+	addr, ok := p.clientIP(r)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return prefix.String()
+	}
+	return addr.String()
+}
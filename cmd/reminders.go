@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	reminderPollInterval = 30 * time.Second
+	reminderBatchSize    = 50
+	reminderMaxAttempts  = 5
+	reminderBaseBackoff  = 30 * time.Second
+	reminderMaxBackoff   = time.Hour
+	// A claimed batch has this long to be sent before another replica may take it over,
+	// well above reminderBatchSize times the timeout of telegramHTTPClient
+	reminderClaimLease = 15 * time.Minute
+
+	telegramAPIURL = "https://api.telegram.org"
+)
+
+// Supported reminder recurrences, empty string means a one-off reminder
+const (
+	recurrenceNone    = ""
+	recurrenceDaily   = "daily"
+	recurrenceWeekly  = "weekly"
+	recurrenceMonthly = "monthly"
+	recurrenceYearly  = "yearly"
+)
+
+// Reminder - represent reminder settings of a note
+type Reminder struct {
+	RemindAt   *time.Time `json:"remindAt"`
+	Recurrence string     `json:"recurrence"`
+}
+
+var telegramHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+func validRecurrence(recurrence string) bool {
+	switch recurrence {
+	case recurrenceNone, recurrenceDaily, recurrenceWeekly, recurrenceMonthly, recurrenceYearly:
+		return true
+	}
+	return false
+}
+
+// nextOccurrence returns the first occurrence of a recurring reminder after the given moment
+func nextOccurrence(remindAt time.Time, recurrence string, after time.Time) (time.Time, bool) {
+	step := func(t time.Time) time.Time {
+		switch recurrence {
+		case recurrenceDaily:
+			return t.AddDate(0, 0, 1)
+		case recurrenceWeekly:
+			return t.AddDate(0, 0, 7)
+		case recurrenceMonthly:
+			return t.AddDate(0, 1, 0)
+		case recurrenceYearly:
+			return t.AddDate(1, 0, 0)
+		}
+		return t
+	}
+
+	if recurrence == recurrenceNone {
+		return time.Time{}, false
+	}
+
+	next := remindAt
+	for !next.After(after) {
+		next = step(next)
+	}
+	return next, true
+}
+
+// reminderBackoff returns the delay before the given (1-based) retry attempt
+func reminderBackoff(attempt int) time.Duration {
+	backoff := reminderBaseBackoff
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+		if backoff >= reminderMaxBackoff {
+			return reminderMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// setNoteReminder replaces the reminder of a note and resets its delivery state.
+// It returns the number of updated notes.
+func setNoteReminder(ctx context.Context, noteID int, remindAt *time.Time, recurrence string) (int64, error) {
+	result, err := db.ExecContext(ctx,
+		"UPDATE notes SET remind_at = $1, remind_recurrence = $2, remind_attempts = 0, remind_retry_at = NULL, remind_claimed_until = NULL WHERE id = $3",
+		remindAt, recurrence, noteID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Set or clear the reminder of a note
+func setReminder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	slog.DebugContext(ctx, "Setting reminder", "note_id", id)
+
+	// Reminders are delivered to the owner, so only they can change them
+	if _, ok := authorizeNote(ctx, w, id, userIDFromContext(ctx), roleOwner); !ok {
+		return
+	}
+
+	var reminder Reminder
+	if err := decodeJSON(w, r, &reminder); err != nil {
+		slog.WarnContext(ctx, "Error decoding reminder request", "error", err)
+		writeError(w, err)
+		return
+	}
+
+	if !validRecurrence(reminder.Recurrence) {
+		writeError(w, validationError(FieldError{Field: "recurrence", Message: invalidRecurrenceField.Message}))
+		return
+	}
+	// A recurrence without a first occurrence means nothing, drop it
+	if reminder.RemindAt == nil {
+		reminder.Recurrence = recurrenceNone
+	}
+
+	rowsAffected, err := setNoteReminder(ctx, id, reminder.RemindAt, reminder.Recurrence)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating reminder", "note_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+	if rowsAffected == 0 {
+		writeError(w, notFoundError(codeNoteNotFound, "Note not found"))
+		return
+	}
+
+	writeJSON(ctx, w, http.StatusOK, reminder)
+	slog.InfoContext(ctx, "Set reminder", "note_id", id)
+}
+
+// runReminderScheduler polls due reminders and delivers them until ctx is done
+func runReminderScheduler(ctx context.Context) {
+	ticker := time.NewTicker(reminderPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Drain everything that is due before waiting for the next tick
+		for {
+			n, err := deliverDueReminders(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "Error delivering reminders", "error", err)
+				break
+			}
+			if n < reminderBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type dueReminder struct {
+	noteID     int
+	userID     int
+	title      string
+	keyID      *int64
+	remindAt   time.Time
+	recurrence string
+	attempts   int
+}
+
+// deliverDueReminders sends one batch of due reminders and returns how many were processed.
+// The batch is claimed with a lease in a single statement, SKIP LOCKED keeps several server
+// replicas from claiming the same reminder. Messages are sent with no transaction open,
+// so a slow Bot API never holds locks on notes.
+func deliverDueReminders(ctx context.Context) (int, error) {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE notes SET remind_claimed_until = now() + $2 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM notes
+			WHERE remind_at IS NOT NULL AND COALESCE(remind_retry_at, remind_at) <= now()
+			  AND (remind_claimed_until IS NULL OR remind_claimed_until < now())
+			ORDER BY COALESCE(remind_retry_at, remind_at)
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, user_id, title, data_key_id, remind_at, remind_recurrence, remind_attempts`,
+		reminderBatchSize, reminderClaimLease.Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	var due []dueReminder
+	for rows.Next() {
+		var d dueReminder
+		if err := rows.Scan(&d.noteID, &d.userID, &d.title, &d.keyID, &d.remindAt, &d.recurrence, &d.attempts); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		due = append(due, d)
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+
+	// A reminder that fails is retried later on its own, the rest of the batch goes on
+	for _, d := range due {
+		if err := deliverReminder(ctx, d); err != nil {
+			slog.ErrorContext(ctx, "Error recording reminder delivery", "note_id", d.noteID, "error", err)
+			postponeReminder(ctx, d)
+		}
+	}
+
+	return len(due), nil
+}
+
+// reminderText returns the message of a reminder, decrypting the note title
+func reminderText(ctx context.Context, d dueReminder) (string, error) {
+	title := d.title
+	if d.keyID != nil {
+		key, err := dataKeyByID(ctx, *d.keyID)
+		if err != nil {
+			return "", fmt.Errorf("note %d: %w", d.noteID, err)
+		}
+		if title, err = key.openField("notes.title", int64(d.noteID), title); err != nil {
+			return "", fmt.Errorf("note %d: %w", d.noteID, err)
+		}
+	}
+	return "⏰ Reminder: " + title, nil
+}
+
+// deliverReminder sends a single claimed reminder, then records the attempt and schedules
+// what comes next. A reminder that can't be decrypted counts as a failed attempt.
+func deliverReminder(ctx context.Context, d dueReminder) error {
+	attempt := d.attempts + 1
+	text, sendErr := reminderText(ctx, d)
+	if sendErr == nil {
+		sendErr = sendTelegramMessage(ctx, d.userID, text)
+	}
+
+	errText := ""
+	if sendErr != nil {
+		errText = sendErr.Error()
+		slog.WarnContext(ctx, "Failed to deliver reminder", "note_id", d.noteID, "attempt", attempt, "error", sendErr)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO reminder_deliveries (note_id, remind_at, attempt, success, error) VALUES ($1, $2, $3, $4, $5)",
+		d.noteID, d.remindAt, attempt, sendErr == nil, errText,
+	)
+	if err != nil {
+		return err
+	}
+
+	// The owner may have changed the reminder while it was being sent, which resets it.
+	// The new one stays as it is then.
+	if sendErr != nil && attempt < reminderMaxAttempts {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE notes SET remind_attempts = $1, remind_retry_at = $2, remind_claimed_until = NULL WHERE id = $3 AND remind_at = $4",
+			attempt, time.Now().Add(reminderBackoff(attempt)), d.noteID, d.remindAt,
+		)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	// Delivered or out of retries: move on to the next occurrence, if any
+	var next *time.Time
+	if t, ok := nextOccurrence(d.remindAt, d.recurrence, time.Now()); ok {
+		next = &t
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE notes SET remind_at = $1, remind_attempts = 0, remind_retry_at = NULL, remind_claimed_until = NULL WHERE id = $2 AND remind_at = $3",
+		next, d.noteID, d.remindAt,
+	)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if sendErr == nil {
+		slog.InfoContext(ctx, "Delivered reminder", "note_id", d.noteID)
+	}
+	return nil
+}
+
+// postponeReminder counts a failed attempt of a reminder whose delivery couldn't be
+// recorded and releases its claim, so it waits out the backoff instead of holding the
+// claim until the lease runs out and then coming first in every batch
+func postponeReminder(ctx context.Context, d dueReminder) {
+	attempt := d.attempts + 1
+	_, err := db.ExecContext(ctx,
+		"UPDATE notes SET remind_attempts = $1, remind_retry_at = $2, remind_claimed_until = NULL WHERE id = $3 AND remind_at = $4",
+		attempt, time.Now().Add(reminderBackoff(attempt)), d.noteID, d.remindAt,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error postponing reminder", "note_id", d.noteID, "error", err)
+	}
+}
+
+// sendTelegramMessage sends a text message to a user through the Bot API.
+// For private chats the chat ID is the Telegram user ID.
+func sendTelegramMessage(ctx context.Context, chatID int, text string) error {
+	payload, err := json.Marshal(map[string]any{
+		"chat_id": chatID,
+		"text":    text,
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/bot%s/sendMessage", telegramAPIURL, os.Getenv("TG_BOT_TOKEN"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := telegramHTTPClient.Do(req)
+	if err != nil {
+		// The error embeds the request URL, which contains the bot token
+		return fmt.Errorf("telegram request failed")
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("telegram response: %w", err)
+	}
+	if !result.OK {
+		return fmt.Errorf("telegram: %s", result.Description)
+	}
+	return nil
+}
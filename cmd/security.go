@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// telegramWebOrigins are the Telegram web clients that open the Mini App in an iframe
+var telegramWebOrigins = []string{
+	"https://web.telegram.org",
+	"https://webk.telegram.org",
+	"https://webz.telegram.org",
+}
+
+const (
+	corsAllowedMethods = "GET, POST, PUT, PATCH, DELETE"
+	corsAllowedHeaders = "Content-Type, Authorization, X-Request-ID"
+	corsExposedHeaders = "X-Request-ID, Location, Deprecation, Link"
+
+	defaultCORSMaxAge = 10 * time.Minute
+	hstsMaxAge        = 2 * 365 * 24 * time.Hour
+)
+
+// corsPolicy decides which cross-origin requests the browser may make
+type corsPolicy struct {
+	origins     map[string]bool
+	anyOrigin   bool
+	credentials bool
+	maxAge      time.Duration
+}
+
+// loadCORSPolicy reads the policy from the environment:
+// CORS_ALLOWED_ORIGINS is a comma-separated list of origins or "*" and defaults to the
+// Telegram web clients, CORS_ALLOW_CREDENTIALS=true lets the browser send cookies and
+// CORS_MAX_AGE is how long preflight answers are cached.
+func loadCORSPolicy() (*corsPolicy, error) {
+	policy := &corsPolicy{
+		origins:     map[string]bool{},
+		credentials: os.Getenv("CORS_ALLOW_CREDENTIALS") == "true",
+		maxAge:      defaultCORSMaxAge,
+	}
+
+	origins := telegramWebOrigins
+	if v := os.Getenv("CORS_ALLOWED_ORIGINS"); v != "" {
+		origins = strings.Split(v, ",")
+	}
+	for _, origin := range origins {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		switch {
+		case origin == "":
+			continue
+		case origin == "*":
+			policy.anyOrigin = true
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+			return nil, errors.New("invalid origin in CORS_ALLOWED_ORIGINS: " + origin)
+		}
+		policy.origins[strings.ToLower(origin)] = true
+	}
+	// Browsers refuse credentials with a wildcard, and echoing any origin would hand them to every site
+	if policy.anyOrigin && policy.credentials {
+		return nil, errors.New("CORS_ALLOW_CREDENTIALS can't be used with CORS_ALLOWED_ORIGINS=*")
+	}
+
+	if v := os.Getenv("CORS_MAX_AGE"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			policy.maxAge = d
+		} else {
+			slog.Warn("Invalid CORS_MAX_AGE, using the default", "value", v, "default", defaultCORSMaxAge)
+		}
+	}
+	return policy, nil
+}
+
+func (p *corsPolicy) allows(origin string) bool {
+	return p.anyOrigin || p.origins[strings.ToLower(origin)]
+}
+
+// middleware adds CORS headers for allowed origins and answers preflight requests.
+// Requests from other origins get no CORS headers, so the browser keeps their responses from the page.
+func (p *corsPolicy) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != ""
+
+		// The answer depends on the origin, caches must not share it between origins
+		if !p.anyOrigin {
+			w.Header().Add("Vary", "Origin")
+		}
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if origin == "" || !p.allows(origin) {
+			if preflight {
+				slog.WarnContext(r.Context(), "Rejected CORS preflight", "origin", origin)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if p.anyOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if p.credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+		w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+		if p.maxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// securityHeaders sets the browser hardening headers on every response.
+// CONTENT_SECURITY_POLICY replaces the default policy, HSTS_ENABLED=true sends HSTS
+// when TLS is terminated in front of the server.
+func securityHeaders(next http.Handler) http.Handler {
+	csp := os.Getenv("CONTENT_SECURITY_POLICY")
+	if csp == "" {
+		csp = defaultContentSecurityPolicy(storageOrigins())
+	}
+	hstsBehindProxy := os.Getenv("HSTS_ENABLED") == "true"
+	hsts := "max-age=" + strconv.Itoa(int(hstsMaxAge.Seconds())) + "; includeSubDomains"
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Security-Policy", csp)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		if r.TLS != nil || hstsBehindProxy {
+			h.Set("Strict-Transport-Security", hsts)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// defaultContentSecurityPolicy allows the frontend's own files, the Telegram WebApp script
+// and attachments from the storage origins, and lets only the Telegram web clients embed
+// the app. X-Frame-Options is left out on purpose, it can't express that list.
+func defaultContentSecurityPolicy(storage []string) string {
+	files := strings.Join(append([]string{"'self'"}, storage...), " ")
+	return strings.Join([]string{
+		"default-src 'self'",
+		"script-src 'self' https://telegram.org",
+		"style-src 'self' 'unsafe-inline'",
+		"img-src " + files + " data: blob: https:",
+		"media-src " + files + " blob:",
+		"font-src 'self' data:",
+		"connect-src 'self'",
+		"object-src 'none'",
+		"base-uri 'self'",
+		"form-action 'self'",
+		"frame-ancestors 'self' " + strings.Join(telegramWebOrigins, " "),
+	}, "; ")
+}
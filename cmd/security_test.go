@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCORSMiddleware(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.example.com")
+	t.Setenv("CORS_ALLOW_CREDENTIALS", "")
+	policy, err := loadCORSPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := policy.middleware(next)
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		preflight   bool
+		wantStatus  int
+		wantAllowed string
+	}{
+		{name: "allowed preflight", method: "OPTIONS", origin: "https://app.example.com", preflight: true, wantStatus: http.StatusNoContent, wantAllowed: "https://app.example.com"},
+		{name: "origin case is ignored", method: "OPTIONS", origin: "https://APP.example.com", preflight: true, wantStatus: http.StatusNoContent, wantAllowed: "https://APP.example.com"},
+		{name: "disallowed preflight", method: "OPTIONS", origin: "https://evil.example.com", preflight: true, wantStatus: http.StatusForbidden},
+		{name: "allowed request", method: "GET", origin: "https://app.example.com", wantStatus: http.StatusOK, wantAllowed: "https://app.example.com"},
+		{name: "disallowed request", method: "GET", origin: "https://evil.example.com", wantStatus: http.StatusOK},
+		{name: "same origin", method: "GET", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/api/v1/notes", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", "PUT")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllowed {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantAllowed)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want none", got)
+			}
+			if !strings.Contains(strings.Join(w.Header().Values("Vary"), ","), "Origin") {
+				t.Errorf("Vary = %q, want Origin", w.Header().Values("Vary"))
+			}
+		})
+	}
+}
+
+func TestLoadCORSPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     string
+		credentials string
+		wantErr     bool
+	}{
+		{name: "telegram clients by default"},
+		{name: "list", origins: "https://a.example.com, https://b.example.com/", credentials: "true"},
+		{name: "any origin", origins: "*"},
+		{name: "any origin with credentials", origins: "*", credentials: "true", wantErr: true},
+		{name: "origin with a path", origins: "https://a.example.com/app", wantErr: true},
+		{name: "not an origin", origins: "a.example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CORS_ALLOWED_ORIGINS", tt.origins)
+			t.Setenv("CORS_ALLOW_CREDENTIALS", tt.credentials)
+			_, err := loadCORSPolicy()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadCORSPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDefaultContentSecurityPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantImages string
+		wantMedia  string
+	}{
+		{
+			name:       "compose minio",
+			env:        map[string]string{"MINIO_ENDPOINT": "minio:9000"},
+			wantImages: "img-src 'self' http://minio:9000 http://*.minio:9000 data: blob: https:",
+			wantMedia:  "media-src 'self' http://minio:9000 http://*.minio:9000 blob:",
+		},
+		{
+			name:       "path style over tls",
+			env:        map[string]string{"MINIO_ENDPOINT": "files.example.com", "MINIO_USE_SSL": "true", "MINIO_PATH_STYLE": "true"},
+			wantImages: "img-src 'self' https://files.example.com data: blob: https:",
+			wantMedia:  "media-src 'self' https://files.example.com blob:",
+		},
+		{
+			name:       "ip endpoint",
+			env:        map[string]string{"MINIO_ENDPOINT": "127.0.0.1:9000"},
+			wantImages: "img-src 'self' http://127.0.0.1:9000 data: blob: https:",
+			wantMedia:  "media-src 'self' http://127.0.0.1:9000 blob:",
+		},
+		{
+			name:       "served by the server",
+			env:        map[string]string{"STORAGE_BACKEND": "fs", "MINIO_ENDPOINT": "minio:9000"},
+			wantImages: "img-src 'self' data: blob: https:",
+			wantMedia:  "media-src 'self' blob:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"STORAGE_BACKEND", "MINIO_ENDPOINT", "MINIO_USE_SSL", "MINIO_PATH_STYLE"} {
+				t.Setenv(name, tt.env[name])
+			}
+			csp := strings.Split(defaultContentSecurityPolicy(storageOrigins()), "; ")
+			if !slices.Contains(csp, tt.wantImages) {
+				t.Errorf("policy %q has no %q", csp, tt.wantImages)
+			}
+			if !slices.Contains(csp, tt.wantMedia) {
+				t.Errorf("policy %q has no %q", csp, tt.wantMedia)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+//go:generate go run ../internal/apigen -spec ../api/openapi.yaml -out api_gen.go
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gorilla/mux"
+)
+
+// noteServer serves the operations of the API spec
+type noteServer struct {
+	spec http.HandlerFunc
+}
+
+// newNoteServer serves the given OpenAPI document at getOpenAPI
+func newNoteServer(doc *openapi3.T) (*noteServer, error) {
+	spec, err := serveAPISpec(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &noteServer{spec: spec}, nil
+}
+
+func (s *noteServer) Healthz(w http.ResponseWriter, r *http.Request)     { healthz(w, r) }
+func (s *noteServer) Readyz(w http.ResponseWriter, r *http.Request)      { readyz(w, r) }
+func (s *noteServer) GetOpenAPI(w http.ResponseWriter, r *http.Request)  { s.spec(w, r) }
+func (s *noteServer) GetNotes(w http.ResponseWriter, r *http.Request)    { getNotes(w, r) }
+func (s *noteServer) CreateNote(w http.ResponseWriter, r *http.Request)  { createNote(w, r) }
+func (s *noteServer) GetNoteByID(w http.ResponseWriter, r *http.Request) { getNoteByID(w, r) }
+func (s *noteServer) UpdateNote(w http.ResponseWriter, r *http.Request)  { updateNote(w, r) }
+func (s *noteServer) DeleteNote(w http.ResponseWriter, r *http.Request)  { deleteNote(w, r) }
+func (s *noteServer) TogglePinNote(w http.ResponseWriter, r *http.Request) {
+	togglePinNote(w, r)
+}
+func (s *noteServer) LockNote(w http.ResponseWriter, r *http.Request)      { lockNote(w, r) }
+func (s *noteServer) PatchNoteItem(w http.ResponseWriter, r *http.Request) { patchNoteItem(w, r) }
+func (s *noteServer) GetOpenTasks(w http.ResponseWriter, r *http.Request)  { getOpenTasks(w, r) }
+func (s *noteServer) UploadFile(w http.ResponseWriter, r *http.Request)    { uploadFile(w, r) }
+func (s *noteServer) DeleteFile(w http.ResponseWriter, r *http.Request)    { deleteFile(w, r) }
+func (s *noteServer) SetReminder(w http.ResponseWriter, r *http.Request)   { setReminder(w, r) }
+func (s *noteServer) GetNoteShares(w http.ResponseWriter, r *http.Request) { getNoteShares(w, r) }
+func (s *noteServer) ShareNote(w http.ResponseWriter, r *http.Request)     { shareNote(w, r) }
+func (s *noteServer) RevokeShare(w http.ResponseWriter, r *http.Request)   { revokeShare(w, r) }
+func (s *noteServer) GetShareLinks(w http.ResponseWriter, r *http.Request) { getShareLinks(w, r) }
+func (s *noteServer) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	createShareLink(w, r)
+}
+func (s *noteServer) RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	revokeShareLink(w, r)
+}
+func (s *noteServer) ViewSharedNote(w http.ResponseWriter, r *http.Request) { viewSharedNote(w, r) }
+func (s *noteServer) ViewSharedNoteWithPassword(w http.ResponseWriter, r *http.Request) {
+	viewSharedNote(w, r)
+}
+func (s *noteServer) DownloadBlob(w http.ResponseWriter, r *http.Request)   { serveBlob(w, r) }
+func (s *noteServer) HeadBlob(w http.ResponseWriter, r *http.Request)       { serveBlob(w, r) }
+func (s *noteServer) GetTemplates(w http.ResponseWriter, r *http.Request)   { getTemplates(w, r) }
+func (s *noteServer) CreateTemplate(w http.ResponseWriter, r *http.Request) { createTemplate(w, r) }
+func (s *noteServer) GetTemplate(w http.ResponseWriter, r *http.Request)    { getTemplate(w, r) }
+func (s *noteServer) UpdateTemplate(w http.ResponseWriter, r *http.Request) { updateTemplate(w, r) }
+func (s *noteServer) DeleteTemplate(w http.ResponseWriter, r *http.Request) { deleteTemplate(w, r) }
+func (s *noteServer) GetSettings(w http.ResponseWriter, r *http.Request)    { getSettings(w, r) }
+func (s *noteServer) UpdateSettings(w http.ResponseWriter, r *http.Request) { updateSettings(w, r) }
+func (s *noteServer) SyncNotes(w http.ResponseWriter, r *http.Request)      { syncNotes(w, r) }
+func (s *noteServer) ExportNotes(w http.ResponseWriter, r *http.Request)    { exportNotes(w, r) }
+func (s *noteServer) CreateImport(w http.ResponseWriter, r *http.Request)   { createImport(w, r) }
+func (s *noteServer) GetImport(w http.ResponseWriter, r *http.Request)      { getImport(w, r) }
+func (s *noteServer) GetJob(w http.ResponseWriter, r *http.Request)         { getJob(w, r) }
+func (s *noteServer) StreamEvents(w http.ResponseWriter, r *http.Request)   { streamEvents(w, r) }
+func (s *noteServer) StreamEventsWS(w http.ResponseWriter, r *http.Request) { streamEventsWS(w, r) }
+
+// newRouter serves every operation of the API spec with s, with the rate limit class and
+// authentication the spec gives it. Other API paths are 404, everything else goes to frontend.
+func newRouter(doc *openapi3.T, limiter *rateLimiter, s apiServer, frontend http.Handler) (*mux.Router, error) {
+	validateRequests, err := validateAPI(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	r := mux.NewRouter()
+	r.Use(recordRoute, validateRequests)
+
+	api := r.PathPrefix(apiPrefix).Subrouter()
+	api.NotFoundHandler = http.HandlerFunc(apiNotFound)
+	api.MethodNotAllowedHandler = http.HandlerFunc(apiMethodNotAllowed)
+
+	for _, op := range apiOperations(s) {
+		h := op.handler
+		if op.rateClass != "" {
+			if _, ok := defaultRateLimits[op.rateClass]; !ok {
+				return nil, fmt.Errorf("%s: unknown rate limit class %q", op.operationID, op.rateClass)
+			}
+			h = limiter.limit(op.rateClass, h)
+		}
+		if op.auth {
+			h = requireAuth(h)
+		}
+		if op.queryAuth {
+			h = allowQueryAuth(h)
+		}
+
+		if path, ok := strings.CutPrefix(op.path, apiPrefix); ok {
+			api.HandleFunc(path, h).Methods(op.method).Name(op.operationID)
+		} else {
+			r.HandleFunc(op.path, h).Methods(op.method).Name(op.operationID)
+		}
+	}
+
+	// Other API versions don't exist, everything else is the frontend
+	r.PathPrefix("/api/").HandlerFunc(apiNotFound)
+	r.PathPrefix("/").Handler(frontend)
+	return r, nil
+}
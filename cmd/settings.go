@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Settings - represent the preferences of a user
+type Settings struct {
+	// Timezone is an IANA name like Europe/Berlin, empty for UTC
+	Timezone string `json:"timezone"`
+}
+
+// userSettings returns the settings of the user, the defaults if they never changed any
+func userSettings(ctx context.Context, userID int) (Settings, error) {
+	var s Settings
+	err := db.QueryRowContext(ctx, "SELECT timezone FROM user_settings WHERE user_id = $1", userID).Scan(&s.Timezone)
+	if err == sql.ErrNoRows {
+		return Settings{}, nil
+	}
+	return s, err
+}
+
+// userLocation returns the timezone of the user, UTC unless they set one
+func userLocation(ctx context.Context, userID int) (*time.Location, error) {
+	s, err := userSettings(ctx, userID)
+	if err != nil || s.Timezone == "" {
+		return time.UTC, err
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		// Zone names are checked when saved, tzdata may have dropped one since
+		slog.WarnContext(ctx, "Unknown saved timezone, using UTC", "timezone", s.Timezone)
+		return time.UTC, nil
+	}
+	return loc, nil
+}
+
+// loadTimezone parses an IANA timezone name of a client
+func loadTimezone(field, name string) (*time.Location, *FieldError) {
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "Local" {
+		return nil, &FieldError{Field: field, Message: "Timezone must be an IANA name like Europe/Berlin"}
+	}
+	return loc, nil
+}
+
+func getSettings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	s, err := userSettings(ctx, userIDFromContext(ctx))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error querying settings", "error", err)
+		writeError(w, err)
+		return
+	}
+	writeJSON(ctx, w, http.StatusOK, s)
+}
+
+func updateSettings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var s Settings
+	if err := decodeJSON(w, r, &s); err != nil {
+		slog.WarnContext(ctx, "Error decoding settings", "error", err)
+		writeError(w, err)
+		return
+	}
+	if s.Timezone != "" {
+		if _, field := loadTimezone("timezone", s.Timezone); field != nil {
+			writeError(w, validationError(*field))
+			return
+		}
+	}
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO user_settings (user_id, timezone) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET timezone = EXCLUDED.timezone, updated_at = CURRENT_TIMESTAMP`,
+		userIDFromContext(ctx), s.Timezone,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error saving settings", "error", err)
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(ctx, w, http.StatusOK, s)
+	slog.InfoContext(ctx, "Updated settings", "timezone", s.Timezone)
+}
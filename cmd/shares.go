@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Access roles on a note, from the weakest to the strongest
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleOwner  = "owner"
+)
+
+var roleRanks = map[string]int{
+	roleViewer: 1,
+	roleEditor: 2,
+	roleOwner:  3,
+}
+
+// Share - represent access to a note granted to another user
+type Share struct {
+	NoteID        int       `json:"noteId"`
+	GranteeUserID int       `json:"userId"`
+	Role          string    `json:"role"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// noteRole returns the role of the user on the note, or an empty string when the user has no access
+func noteRole(ctx context.Context, noteID int, userID int) (string, error) {
+	var role string
+	err := db.QueryRowContext(ctx, `
+		SELECT 'owner' FROM notes WHERE id = $1 AND user_id = $2
+		UNION ALL
+		SELECT role FROM note_shares WHERE note_id = $1 AND grantee_user_id = $2
+		LIMIT 1`, noteID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// authorizeNote checks that the user holds at least the required role on the note
+// and writes an error response otherwise. Notes the user can't see are reported as not found.
+func authorizeNote(ctx context.Context, w http.ResponseWriter, noteID int, userID int, required string) (string, bool) {
+	role, err := noteRole(ctx, noteID, userID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error checking note access", "note_id", noteID, "error", err)
+		writeError(w, err)
+		return "", false
+	}
+	if role == "" {
+		writeError(w, notFoundError(codeNoteNotFound, "Note not found"))
+		return "", false
+	}
+	if roleRanks[role] < roleRanks[required] {
+		writeError(w, newAPIError(http.StatusForbidden, codeForbidden, "Your role on this note does not allow this"))
+		return "", false
+	}
+	return role, true
+}
+
+// Share a note with another user or change the role of an existing share
+func shareNote(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	noteID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	userID := userIDFromContext(ctx)
+	slog.DebugContext(ctx, "Sharing note", "note_id", noteID)
+
+	if _, ok := authorizeNote(ctx, w, noteID, userID, roleOwner); !ok {
+		return
+	}
+
+	var share Share
+	if err := decodeJSON(w, r, &share); err != nil {
+		slog.WarnContext(ctx, "Error decoding share request", "error", err)
+		writeError(w, err)
+		return
+	}
+	var fields []FieldError
+	if share.Role != roleViewer && share.Role != roleEditor {
+		fields = append(fields, FieldError{Field: "role", Message: "Role must be viewer or editor"})
+	}
+	if share.GranteeUserID <= 0 || share.GranteeUserID == userID {
+		fields = append(fields, FieldError{Field: "userId", Message: "User ID must be another Telegram user"})
+	}
+	if len(fields) > 0 {
+		writeError(w, validationError(fields...))
+		return
+	}
+
+	// xmax is zero for a freshly inserted row, so it tells a new share from a role change
+	var created bool
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO note_shares (note_id, grantee_user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (note_id, grantee_user_id) DO UPDATE SET role = EXCLUDED.role
+		RETURNING note_id, created_at, xmax = 0`,
+		noteID, share.GranteeUserID, share.Role,
+	).Scan(&share.NoteID, &share.CreatedAt, &created)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error saving share", "note_id", noteID, "error", err)
+		writeError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		w.Header().Set("Location", fmt.Sprintf(apiPrefix+"/notes/%d/shares/%d", noteID, share.GranteeUserID))
+	}
+	writeJSON(ctx, w, status, share)
+	slog.InfoContext(ctx, "Shared note", "note_id", noteID, "grantee_id", share.GranteeUserID, "role", share.Role)
+}
+
+// List users a note is shared with
+func getNoteShares(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	noteID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	userID := userIDFromContext(ctx)
+
+	if _, ok := authorizeNote(ctx, w, noteID, userID, roleOwner); !ok {
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT note_id, grantee_user_id, role, created_at FROM note_shares WHERE note_id = $1 ORDER BY created_at", noteID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error querying shares", "note_id", noteID, "error", err)
+		writeError(w, err)
+		return
+	}
+	defer func() { _ = rows.Close() }()
+
+	shares := []Share{}
+	for rows.Next() {
+		var s Share
+		if err := rows.Scan(&s.NoteID, &s.GranteeUserID, &s.Role, &s.CreatedAt); err != nil {
+			slog.ErrorContext(ctx, "Error scanning share", "error", err)
+			writeError(w, err)
+			return
+		}
+		shares = append(shares, s)
+	}
+
+	writeJSON(ctx, w, http.StatusOK, shares)
+}
+
+// Revoke a share. The owner can revoke any share, a grantee can leave a shared note.
+func revokeShare(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	noteID, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	granteeID, err := pathID(r, "userId")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	userID := userIDFromContext(ctx)
+	slog.DebugContext(ctx, "Revoking share", "note_id", noteID, "grantee_id", granteeID)
+
+	required := roleOwner
+	if granteeID == userID {
+		required = roleViewer
+	}
+	if _, ok := authorizeNote(ctx, w, noteID, userID, required); !ok {
+		return
+	}
+
+	result, err := db.ExecContext(ctx, "DELETE FROM note_shares WHERE note_id = $1 AND grantee_user_id = $2", noteID, granteeID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting share", "note_id", noteID, "grantee_id", granteeID, "error", err)
+		writeError(w, err)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		writeError(w, notFoundError(codeShareNotFound, "Share not found"))
+		return
+	}
+
+	slog.InfoContext(ctx, "Revoked share", "note_id", noteID, "grantee_id", granteeID)
+	w.WriteHeader(http.StatusNoContent)
+}
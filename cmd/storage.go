@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Storage backends, chosen by STORAGE_BACKEND
+const (
+	storageS3     = "s3"
+	storageFS     = "fs"
+	storageMemory = "memory"
+)
+
+var (
+	// errBlobNotFound is returned for objects that don't exist
+	errBlobNotFound = errors.New("blob not found")
+
+	// blobLinks signs the download links answered by serveBlob. Backends that can't presign
+	// links use it for every object, the others only for encrypted attachments.
+	blobLinks *blobURLSigner
+)
+
+// blobStore keeps attachments and import uploads. Objects are grouped in buckets
+// and addressed by name, like in S3.
+type blobStore interface {
+	// EnsureBucket creates the bucket if it doesn't exist yet
+	EnsureBucket(ctx context.Context, bucket string) error
+	BucketExists(ctx context.Context, bucket string) (bool, error)
+	Put(ctx context.Context, bucket, name string, r io.Reader, size int64) error
+	// Get opens an object, or returns errBlobNotFound
+	Get(ctx context.Context, bucket, name string) (io.ReadCloser, blobInfo, error)
+	// Remove deletes an object. Removing a missing object is not an error, so retries are safe.
+	Remove(ctx context.Context, bucket, name string) error
+	// URL returns a link that downloads the object without authentication until ttl passes
+	URL(ctx context.Context, bucket, name string, ttl time.Duration) (string, error)
+}
+
+// blobInfo - represent the metadata of a stored object
+type blobInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// openBlobStore opens the backend chosen by STORAGE_BACKEND: s3 (the default) for MinIO
+// or any S3-compatible service, fs for a local directory, or memory, which keeps objects
+// until the process exits and suits tests
+func openBlobStore() (blobStore, error) {
+	backend := storageBackend()
+	var store blobStore
+	var err error
+	switch backend {
+	case storageS3:
+		store, err = newS3BlobStore()
+	case storageFS:
+		store, err = newFSBlobStore(os.Getenv("STORAGE_DIR"))
+	case storageMemory:
+		slog.Warn("Keeping files in memory, they are lost when the server stops")
+		store, err = newMemoryBlobStore()
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q, expected s3, fs or memory", backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if signer, ok := store.(blobSigner); ok {
+		blobLinks = signer.urlSigner()
+	} else if blobLinks, err = loadBlobLinks(); err != nil {
+		return nil, err
+	}
+
+	slog.Info("Opened blob storage", "backend", backend)
+	return instrumentedBlobStore{store: store, backend: backend}, nil
+}
+
+// storageBackend returns the backend chosen by STORAGE_BACKEND
+func storageBackend() string {
+	backend := os.Getenv("STORAGE_BACKEND")
+	if backend == "" || backend == "minio" {
+		return storageS3
+	}
+	return backend
+}
+
+// storageOrigins returns the origins attachment links point to besides the server itself
+func storageOrigins() []string {
+	if storageBackend() != storageS3 {
+		return nil
+	}
+	return s3Origins()
+}
+
+// loadBlobLinks returns the signer of links to encrypted attachments, which the server
+// decrypts on download. Links are saved with the files, so with encryption on it requires
+// STORAGE_URL_SECRET: a secret made up at startup would break them on every restart and
+// differ between replicas.
+func loadBlobLinks() (*blobURLSigner, error) {
+	if secret := os.Getenv("STORAGE_URL_SECRET"); secret != "" {
+		return newBlobURLSigner([]byte(secret)), nil
+	}
+	if masterKeys != nil {
+		return nil, errors.New("STORAGE_URL_SECRET must be set when ENCRYPTION_KEYS is")
+	}
+	// Without encryption no link points to the server, the secret is never used
+	secret, err := randomURLSecret()
+	if err != nil {
+		return nil, err
+	}
+	return newBlobURLSigner(secret), nil
+}
+
+// instrumentedBlobStore traces the calls of a backend and records them in the storage metrics
+type instrumentedBlobStore struct {
+	store   blobStore
+	backend string
+}
+
+func (s instrumentedBlobStore) EnsureBucket(ctx context.Context, bucket string) error {
+	ctx, end := startStorageOp(ctx, s.backend, "EnsureBucket", bucket, "")
+	err := s.store.EnsureBucket(ctx, bucket)
+	end(err)
+	return err
+}
+
+func (s instrumentedBlobStore) BucketExists(ctx context.Context, bucket string) (bool, error) {
+	ctx, end := startStorageOp(ctx, s.backend, "BucketExists", bucket, "")
+	exists, err := s.store.BucketExists(ctx, bucket)
+	end(err)
+	return exists, err
+}
+
+func (s instrumentedBlobStore) Put(ctx context.Context, bucket, name string, r io.Reader, size int64) error {
+	ctx, end := startStorageOp(ctx, s.backend, "Put", bucket, name)
+	err := s.store.Put(ctx, bucket, name, r, size)
+	end(err)
+	return err
+}
+
+func (s instrumentedBlobStore) Get(ctx context.Context, bucket, name string) (io.ReadCloser, blobInfo, error) {
+	ctx, end := startStorageOp(ctx, s.backend, "Get", bucket, name)
+	rc, info, err := s.store.Get(ctx, bucket, name)
+	// A missing object is an answer, not a failure of the backend
+	if errors.Is(err, errBlobNotFound) {
+		end(nil)
+	} else {
+		end(err)
+	}
+	return rc, info, err
+}
+
+func (s instrumentedBlobStore) Remove(ctx context.Context, bucket, name string) error {
+	ctx, end := startStorageOp(ctx, s.backend, "Remove", bucket, name)
+	err := s.store.Remove(ctx, bucket, name)
+	end(err)
+	return err
+}
+
+func (s instrumentedBlobStore) URL(ctx context.Context, bucket, name string, ttl time.Duration) (string, error) {
+	ctx, end := startStorageOp(ctx, s.backend, "URL", bucket, name)
+	u, err := s.store.URL(ctx, bucket, name, ttl)
+	end(err)
+	return u, err
+}
+
+// blobURLSigner makes download links for backends that can't presign them. The links
+// point at serveBlob and carry an HMAC of the object and the expiry. Object names go in
+// the path base64-encoded, as the router would clean up slashes and dots in them. Links to
+// encrypted attachments also carry the ID of the data key to decrypt them with.
+type blobURLSigner struct {
+	secret []byte
+}
+
+func newBlobURLSigner(secret []byte) *blobURLSigner {
+	return &blobURLSigner{secret: secret}
+}
+
+// randomURLSecret returns a fresh secret for signing download links
+func randomURLSecret() ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func (s *blobURLSigner) sign(bucket, name, key string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", bucket, name, expires)
+	if key != "" {
+		fmt.Fprintf(mac, "\n%s", key)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// url returns a link to the object, keyID is nil for objects stored in plaintext
+func (s *blobURLSigner) url(bucket, name string, keyID *int64, ttl time.Duration) string {
+	expires := time.Now().Add(ttl).Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	if keyID != nil {
+		q.Set("key", strconv.FormatInt(*keyID, 10))
+	}
+	q.Set("signature", s.sign(bucket, name, q.Get("key"), expires))
+	return "/blobs/" + url.PathEscape(bucket) + "/" + base64.RawURLEncoding.EncodeToString([]byte(name)) + "?" + q.Encode()
+}
+
+func (s *blobURLSigner) verify(bucket, name string, q url.Values) bool {
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	signature, err := hex.DecodeString(q.Get("signature"))
+	if err != nil {
+		return false
+	}
+	expected, _ := hex.DecodeString(s.sign(bucket, name, q.Get("key"), expires))
+	return hmac.Equal(signature, expected)
+}
+
+// blobSigner is implemented by the backends whose links serveBlob answers
+type blobSigner interface {
+	urlSigner() *blobURLSigner
+}
+
+// blobObjectURL returns a download link for an object, encrypted ones are linked to
+// serveBlob as the backend would hand out the ciphertext
+func blobObjectURL(ctx context.Context, bucket, name string, keyID *int64, ttl time.Duration) (string, error) {
+	if keyID == nil {
+		return blobs.URL(ctx, bucket, name, ttl)
+	}
+	return blobLinks.url(bucket, name, keyID, ttl), nil
+}
+
+// serveBlob downloads an object through a link made by blobURLSigner, decrypting it when
+// the link names a data key.
+// Uploaded files are untrusted, the sandbox keeps an HTML attachment from running scripts on our origin.
+func serveBlob(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	bucket := mux.Vars(r)["bucket"]
+	key, err := base64.RawURLEncoding.DecodeString(mux.Vars(r)["key"])
+	name := string(key)
+
+	if err != nil || blobLinks == nil || !blobLinks.verify(bucket, name, r.URL.Query()) {
+		writeError(w, newAPIError(http.StatusForbidden, codeForbidden, "Invalid or expired download link"))
+		return
+	}
+
+	var dk *dataKey
+	if v := r.URL.Query().Get("key"); v != "" {
+		keyID, _ := strconv.ParseInt(v, 10, 64)
+		if dk, err = dataKeyByID(ctx, keyID); err != nil {
+			slog.ErrorContext(ctx, "Error loading data key", "bucket", bucket, "object", name, "error", err)
+			writeError(w, err)
+			return
+		}
+	}
+
+	rc, info, err := blobs.Get(ctx, bucket, name)
+	if errors.Is(err, errBlobNotFound) {
+		writeError(w, notFoundError(codeFileNotFound, "File not found"))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error opening blob", "bucket", bucket, "object", name, "error", err)
+		writeError(w, err)
+		return
+	}
+	defer func() { _ = rc.Close() }()
+
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	var body io.Reader = rc
+	size := info.Size
+	if dk != nil {
+		body = dk.openReader(rc, name)
+		size = openedSize(info.Size)
+	} else if rs, ok := rc.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, info.ModTime, rs)
+		return
+	}
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		slog.WarnContext(ctx, "Error writing blob", "bucket", bucket, "object", name, "error", err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultStorageDir = "./data/blobs"
+	// urlSecretFile keeps the link signing secret, so links stay valid across restarts
+	urlSecretFile = ".url-secret"
+)
+
+// fsBlobStore keeps objects as files under a directory. Files are named after the hash of
+// the object name, which any name fits in, and spread over two levels of subdirectories
+// so no directory grows too large: <dir>/<bucket>/ab/cd/abcd...
+type fsBlobStore struct {
+	dir  string
+	urls *blobURLSigner
+}
+
+// newFSBlobStore opens the store at dir, ./data/blobs by default. Download links are
+// signed with STORAGE_URL_SECRET, or a secret generated once and kept in the directory.
+func newFSBlobStore(dir string) (*fsBlobStore, error) {
+	if dir == "" {
+		dir = defaultStorageDir
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	secret := []byte(os.Getenv("STORAGE_URL_SECRET"))
+	if len(secret) == 0 {
+		var err error
+		if secret, err = loadURLSecret(filepath.Join(dir, urlSecretFile)); err != nil {
+			return nil, err
+		}
+	}
+
+	slog.Info("Storing files on disk", "dir", dir)
+	return &fsBlobStore{dir: dir, urls: newBlobURLSigner(secret)}, nil
+}
+
+// loadURLSecret reads the signing secret from path, creating it on first use
+func loadURLSecret(path string) ([]byte, error) {
+	secret, err := os.ReadFile(path)
+	if err == nil && len(secret) > 0 {
+		return secret, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if secret, err = randomURLSecret(); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, secret); err != nil {
+		return nil, fmt.Errorf("saving URL secret: %w", err)
+	}
+	return secret, nil
+}
+
+func (s *fsBlobStore) path(bucket, name string) string {
+	sum := sha256.Sum256([]byte(name))
+	h := hex.EncodeToString(sum[:])
+	return filepath.Join(s.dir, bucket, h[:2], h[2:4], h)
+}
+
+func (s *fsBlobStore) EnsureBucket(_ context.Context, bucket string) error {
+	return os.MkdirAll(filepath.Join(s.dir, bucket), 0o750)
+}
+
+func (s *fsBlobStore) BucketExists(_ context.Context, bucket string) (bool, error) {
+	info, err := os.Stat(filepath.Join(s.dir, bucket))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+// Put writes the object to a temporary file and renames it into place,
+// readers never see a partial file
+func (s *fsBlobStore) Put(_ context.Context, bucket, name string, r io.Reader, size int64) error {
+	path := s.path(bucket, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	written, err := io.Copy(tmp, r)
+	if err == nil && size >= 0 && written != size {
+		err = fmt.Errorf("wrote %d bytes, expected %d", written, size)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *fsBlobStore) Get(_ context.Context, bucket, name string) (io.ReadCloser, blobInfo, error) {
+	f, err := os.Open(s.path(bucket, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, blobInfo{}, errBlobNotFound
+	}
+	if err != nil {
+		return nil, blobInfo{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, blobInfo{}, err
+	}
+	return f, blobInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *fsBlobStore) Remove(_ context.Context, bucket, name string) error {
+	err := os.Remove(s.path(bucket, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *fsBlobStore) URL(_ context.Context, bucket, name string, ttl time.Duration) (string, error) {
+	return s.urls.url(bucket, name, nil, ttl), nil
+}
+
+func (s *fsBlobStore) urlSigner() *blobURLSigner {
+	return s.urls
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it into place
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// memoryBlobStore keeps objects in memory until the process exits, for tests and demos
+type memoryBlobStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string]memoryBlob
+	urls    *blobURLSigner
+}
+
+type memoryBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemoryBlobStore() (*memoryBlobStore, error) {
+	secret, err := randomURLSecret()
+	if err != nil {
+		return nil, err
+	}
+	return &memoryBlobStore{buckets: map[string]map[string]memoryBlob{}, urls: newBlobURLSigner(secret)}, nil
+}
+
+func (s *memoryBlobStore) EnsureBucket(_ context.Context, bucket string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = map[string]memoryBlob{}
+	}
+	return nil
+}
+
+func (s *memoryBlobStore) BucketExists(_ context.Context, bucket string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.buckets[bucket] != nil, nil
+}
+
+func (s *memoryBlobStore) Put(_ context.Context, bucket, name string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && int64(len(data)) != size {
+		return fmt.Errorf("read %d bytes, expected %d", len(data), size)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = map[string]memoryBlob{}
+	}
+	s.buckets[bucket][name] = memoryBlob{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (s *memoryBlobStore) Get(_ context.Context, bucket, name string) (io.ReadCloser, blobInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	blob, ok := s.buckets[bucket][name]
+	if !ok {
+		return nil, blobInfo{}, errBlobNotFound
+	}
+	// Objects are replaced, never changed in place, so the data can be shared with the reader
+	return readSeekNopCloser{bytes.NewReader(blob.data)}, blobInfo{Size: int64(len(blob.data)), ModTime: blob.modTime}, nil
+}
+
+func (s *memoryBlobStore) Remove(_ context.Context, bucket, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.buckets[bucket], name)
+	return nil
+}
+
+func (s *memoryBlobStore) URL(_ context.Context, bucket, name string, ttl time.Duration) (string, error) {
+	return s.urls.url(bucket, name, nil, ttl), nil
+}
+
+func (s *memoryBlobStore) urlSigner() *blobURLSigner {
+	return s.urls
+}
+
+type readSeekNopCloser struct {
+	*bytes.Reader
+}
+
+func (readSeekNopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3BlobStore keeps objects in MinIO or another S3-compatible service
+type s3BlobStore struct {
+	client *minio.Client
+	region string
+}
+
+// newS3BlobStore connects to MINIO_ENDPOINT. MINIO_USE_SSL=true connects over HTTPS,
+// MINIO_REGION sets the region of new buckets and MINIO_PATH_STYLE=true or false forces
+// path-style or virtual-host-style bucket addressing, the client picks one otherwise.
+func newS3BlobStore() (*s3BlobStore, error) {
+	region := os.Getenv("MINIO_REGION")
+	client, err := minio.New(os.Getenv("MINIO_ENDPOINT"), &minio.Options{
+		Creds:        credentials.NewStaticV4(os.Getenv("MINIO_ACCESS_KEY"), os.Getenv("MINIO_SECRET_KEY"), ""),
+		Secure:       os.Getenv("MINIO_USE_SSL") == "true",
+		Region:       region,
+		BucketLookup: s3BucketLookup(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3BlobStore{client: client, region: region}, nil
+}
+
+// s3BucketLookup returns the bucket addressing forced by MINIO_PATH_STYLE
+func s3BucketLookup() minio.BucketLookupType {
+	lookup := minio.BucketLookupAuto
+	switch os.Getenv("MINIO_PATH_STYLE") {
+	case "true":
+		lookup = minio.BucketLookupPath
+	case "false":
+		lookup = minio.BucketLookupDNS
+	}
+	return lookup
+}
+
+// s3Origins returns the origins of presigned links: the endpoint, and its subdomains unless
+// path-style addressing is forced, since virtual-host-style links put the bucket there.
+// Buckets are never subdomains of an IP address.
+func s3Origins() []string {
+	endpoint := os.Getenv("MINIO_ENDPOINT")
+	if endpoint == "" {
+		return nil
+	}
+	scheme := "http://"
+	if os.Getenv("MINIO_USE_SSL") == "true" {
+		scheme = "https://"
+	}
+
+	origins := []string{scheme + endpoint}
+	host := endpoint
+	if h, _, err := net.SplitHostPort(endpoint); err == nil {
+		host = h
+	}
+	if s3BucketLookup() != minio.BucketLookupPath && net.ParseIP(strings.Trim(host, "[]")) == nil {
+		origins = append(origins, scheme+"*."+endpoint)
+	}
+	return origins
+}
+
+func (s *s3BlobStore) EnsureBucket(ctx context.Context, bucket string) error {
+	exists, err := s.client.BucketExists(ctx, bucket)
+	if err != nil || exists {
+		return err
+	}
+	return s.client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: s.region})
+}
+
+func (s *s3BlobStore) BucketExists(ctx context.Context, bucket string) (bool, error) {
+	return s.client.BucketExists(ctx, bucket)
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, bucket, name string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, bucket, name, r, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, bucket, name string) (io.ReadCloser, blobInfo, error) {
+	obj, err := s.client.GetObject(ctx, bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, blobInfo{}, err
+	}
+	// The object is only requested on first use, Stat tells a missing one right away
+	info, err := obj.Stat()
+	if err != nil {
+		_ = obj.Close()
+		if isS3NotFound(err) {
+			return nil, blobInfo{}, errBlobNotFound
+		}
+		return nil, blobInfo{}, err
+	}
+	return obj, blobInfo{Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *s3BlobStore) Remove(ctx context.Context, bucket, name string) error {
+	err := s.client.RemoveObject(ctx, bucket, name, minio.RemoveObjectOptions{})
+	if isS3NotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *s3BlobStore) URL(ctx context.Context, bucket, name string, ttl time.Duration) (string, error) {
+	u, err := s.client.PresignedGetObject(ctx, bucket, name, ttl, make(url.Values))
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func isS3NotFound(err error) bool {
+	return err != nil && minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBlobStores runs every backend that needs no server through the same checks
+func TestBlobStores(t *testing.T) {
+	backends := map[string]func(t *testing.T) blobStore{
+		storageFS: func(t *testing.T) blobStore {
+			store, err := newFSBlobStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+		storageMemory: func(t *testing.T) blobStore {
+			store, err := newMemoryBlobStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+	}
+
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			testBlobStore(t, open(t))
+		})
+	}
+}
+
+func testBlobStore(t *testing.T, store blobStore) {
+	ctx := context.Background()
+	const bucket = "notes-files"
+	// Object names hold user IDs, slashes and the original file name
+	name := "279058397/1/Groceries list (2).txt"
+
+	exists, err := store.BucketExists(ctx, bucket)
+	if err != nil || exists {
+		t.Fatalf("BucketExists() before EnsureBucket = %v, %v, want false", exists, err)
+	}
+	for range 2 {
+		if err := store.EnsureBucket(ctx, bucket); err != nil {
+			t.Fatalf("EnsureBucket() error = %v", err)
+		}
+	}
+	if exists, err := store.BucketExists(ctx, bucket); err != nil || !exists {
+		t.Fatalf("BucketExists() = %v, %v, want true", exists, err)
+	}
+
+	if _, _, err := store.Get(ctx, bucket, name); !errors.Is(err, errBlobNotFound) {
+		t.Fatalf("Get() of a missing object error = %v, want errBlobNotFound", err)
+	}
+
+	for _, data := range []string{"milk, bread", "milk, bread, eggs"} {
+		if err := store.Put(ctx, bucket, name, strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+		rc, info, err := store.Get(ctx, bucket, name)
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		got, err := io.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil || string(got) != data {
+			t.Errorf("Get() = %q, %v, want %q", got, err, data)
+		}
+		if info.Size != int64(len(data)) || info.ModTime.IsZero() {
+			t.Errorf("Get() info = %+v, want size %d and a modification time", info, len(data))
+		}
+	}
+
+	link, err := store.URL(ctx, bucket, name, time.Hour)
+	if err != nil {
+		t.Fatalf("URL() error = %v", err)
+	}
+	u, err := url.Parse(link)
+	if err != nil || u.Query().Get("signature") == "" {
+		t.Errorf("URL() = %q, want a signed link", link)
+	}
+	if signer, ok := store.(blobSigner); ok && !signer.urlSigner().verify(bucket, name, u.Query()) {
+		t.Errorf("URL() = %q does not verify", link)
+	}
+
+	// Removing twice is fine, retries depend on it
+	for range 2 {
+		if err := store.Remove(ctx, bucket, name); err != nil {
+			t.Fatalf("Remove() error = %v", err)
+		}
+	}
+	if _, _, err := store.Get(ctx, bucket, name); !errors.Is(err, errBlobNotFound) {
+		t.Fatalf("Get() after Remove() error = %v, want errBlobNotFound", err)
+	}
+	if _, _, err := store.Get(ctx, "other-bucket", name); !errors.Is(err, errBlobNotFound) {
+		t.Errorf("Get() from a missing bucket error = %v, want errBlobNotFound", err)
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// syncLockKey is the advisory lock taken around change sequence numbers, see next_change_seq()
+	syncLockKey = 7301
+
+	maxSyncChanges  = 500
+	maxSyncBodySize = 10 << 20
+)
+
+// Sync change operations
+const (
+	syncOpCreate = "create"
+	syncOpUpdate = "update"
+	syncOpDelete = "delete"
+)
+
+// Sync result statuses
+const (
+	syncApplied   = "applied"
+	syncConflict  = "conflict"
+	syncNotFound  = "not_found"
+	syncForbidden = "forbidden"
+	syncInvalid   = "invalid"
+)
+
+// SyncChange - represent a change made by a client while offline
+type SyncChange struct {
+	Op string `json:"op"`
+	// ClientID identifies notes created offline, it makes creates idempotent
+	ClientID string `json:"clientId,omitempty"`
+	ID       int    `json:"id,omitempty"`
+	// BaseVersion is the version of the note the client changed
+	BaseVersion int64 `json:"baseVersion,omitempty"`
+	Note        *Note `json:"note,omitempty"`
+}
+
+// SyncResult - represent the outcome of a client change
+type SyncResult struct {
+	Op       string `json:"op"`
+	ClientID string `json:"clientId,omitempty"`
+	ID       int    `json:"id,omitempty"`
+	Status   string `json:"status"`
+	Version  int64  `json:"version,omitempty"`
+	// Note is the server copy of the note when the change conflicts with it
+	Note *Note `json:"note,omitempty"`
+}
+
+// SyncRequest - represent a sync request
+type SyncRequest struct {
+	Cursor  int64        `json:"cursor"`
+	Changes []SyncChange `json:"changes"`
+}
+
+// SyncResponse - represent changes the client has to apply locally
+type SyncResponse struct {
+	Results []SyncResult `json:"results"`
+	Notes   []Note       `json:"notes"`
+	Deleted []int        `json:"deleted"`
+	Cursor  int64        `json:"cursor"`
+}
+
+// Apply offline changes of the client and return the server changes since its cursor
+func syncNotes(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := userIDFromContext(ctx)
+	slog.DebugContext(ctx, "Syncing notes")
+
+	var req SyncRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSyncBodySize)).Decode(&req); err != nil {
+		slog.WarnContext(ctx, "Error decoding sync request", "error", err)
+		writeError(w, invalidJSON(err))
+		return
+	}
+	if len(req.Changes) > maxSyncChanges {
+		writeError(w, newAPIError(http.StatusRequestEntityTooLarge, codePayloadTooLarge,
+			"Too many changes in one sync, send at most "+strconv.Itoa(maxSyncChanges)))
+		return
+	}
+
+	resp := SyncResponse{Results: make([]SyncResult, 0, len(req.Changes)), Notes: []Note{}, Deleted: []int{}}
+	for _, change := range req.Changes {
+		result, err := applySyncChange(ctx, userID, change)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error applying change", "op", change.Op, "error", err)
+			writeError(w, err)
+			return
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	cursor, err := syncHighWaterMark(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading change sequence", "error", err)
+		writeError(w, err)
+		return
+	}
+	resp.Cursor = cursor
+
+	if resp.Notes, err = changedNotes(ctx, userID, req.Cursor, cursor); err != nil {
+		slog.ErrorContext(ctx, "Error querying changed notes", "error", err)
+		writeError(w, err)
+		return
+	}
+	if resp.Deleted, err = deletedNotes(ctx, userID, req.Cursor, cursor); err != nil {
+		slog.ErrorContext(ctx, "Error querying deleted notes", "error", err)
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(ctx, w, http.StatusOK, resp)
+	slog.InfoContext(ctx, "Synced notes",
+		"changes", len(resp.Results), "notes", len(resp.Notes), "deleted", len(resp.Deleted))
+}
+
+// syncHighWaterMark returns the latest change sequence number such that every change
+// numbered at or below it is committed. Writers hold the shared lock until they commit.
+func syncHighWaterMark(ctx context.Context) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", syncLockKey); err != nil {
+		return 0, err
+	}
+	var cursor int64
+	if err := tx.QueryRowContext(ctx, "SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM change_seq").Scan(&cursor); err != nil {
+		return 0, err
+	}
+	return cursor, tx.Commit()
+}
+
+func applySyncChange(ctx context.Context, userID int, change SyncChange) (SyncResult, error) {
+	result := SyncResult{Op: change.Op, ClientID: change.ClientID, ID: change.ID}
+
+	switch change.Op {
+	case syncOpCreate:
+		if change.ClientID == "" || change.Note == nil || validateNote(*change.Note) != nil {
+			result.Status = syncInvalid
+			return result, nil
+		}
+		return syncCreate(ctx, userID, change, result)
+	case syncOpUpdate:
+		if change.ID == 0 || change.Note == nil || validateNote(*change.Note) != nil {
+			result.Status = syncInvalid
+			return result, nil
+		}
+		return syncUpdate(ctx, userID, change, result)
+	case syncOpDelete:
+		if change.ID == 0 {
+			result.Status = syncInvalid
+			return result, nil
+		}
+		return syncDelete(ctx, userID, change, result)
+	}
+
+	result.Status = syncInvalid
+	return result, nil
+}
+
+// syncCreate inserts a note created offline. Replaying the same client ID returns the note created the first time.
+func syncCreate(ctx context.Context, userID int, change SyncChange, result SyncResult) (SyncResult, error) {
+	n := change.Note
+	key, err := userDataKey(ctx, userID)
+	if err != nil {
+		return result, err
+	}
+	// The note gets its ID first, the sealed title and content authenticate it
+	id, err := nextRowID(ctx, db, "notes")
+	if err != nil {
+		return result, err
+	}
+	title, content, keyID, err := sealNoteText(key, int(id), n.Title, n.Content)
+	if err != nil {
+		return result, err
+	}
+	encryption, err := encryptionColumn(n.Encryption)
+	if err != nil {
+		return result, err
+	}
+
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO notes (id, user_id, title, content, last_modified, is_pin, client_id, data_key_id, is_locked, encryption)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (user_id, client_id) WHERE client_id IS NOT NULL DO NOTHING
+		RETURNING id, version`,
+		id, userID, title, content, time.Now(), n.IsPinned, change.ClientID, keyID, n.IsLocked, encryption,
+	).Scan(&result.ID, &result.Version)
+	if err == sql.ErrNoRows {
+		err = db.QueryRowContext(ctx, "SELECT id, version FROM notes WHERE user_id = $1 AND client_id = $2", userID, change.ClientID).
+			Scan(&result.ID, &result.Version)
+		if err != nil {
+			return result, err
+		}
+		result.Status = syncApplied
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	indexNoteItems(ctx, result.ID)
+	publishNoteEvent(ctx, eventNoteCreated, result.ID, result.Version, userID, []int{userID})
+	result.Status = syncApplied
+	return result, nil
+}
+
+// syncUpdate applies an offline edit only if nobody changed the note since the client's base version
+func syncUpdate(ctx context.Context, userID int, change SyncChange, result SyncResult) (SyncResult, error) {
+	id := change.ID
+	role, err := noteRole(ctx, id, userID)
+	if err != nil {
+		return result, err
+	}
+	switch {
+	case role == "":
+		result.Status = syncNotFound
+		return result, nil
+	case roleRanks[role] < roleRanks[roleEditor]:
+		result.Status = syncForbidden
+		return result, nil
+	}
+
+	n := change.Note
+	key, err := noteDataKey(ctx, id)
+	if err == sql.ErrNoRows {
+		result.Status = syncNotFound
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	title, content, keyID, err := sealNoteText(key, id, n.Title, n.Content)
+	if err != nil {
+		return result, err
+	}
+	encryption, err := encryptionColumn(n.Encryption)
+	if err != nil {
+		return result, err
+	}
+
+	// An edit made before the note was locked or unlocked elsewhere conflicts with it
+	err = db.QueryRowContext(ctx, `
+		UPDATE notes SET title = $1, content = $2, is_pin = $3, last_modified = $4, data_key_id = $5, encryption = $6, version = version + 1
+		WHERE id = $7 AND version = $8 AND is_locked = $9 RETURNING version`,
+		title, content, n.IsPinned, time.Now(), keyID, encryption, id, change.BaseVersion, n.IsLocked,
+	).Scan(&result.Version)
+	if err == sql.ErrNoRows {
+		return syncConflictResult(ctx, id, result)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	indexNoteItems(ctx, id)
+	publishNoteEvent(ctx, eventNoteUpdated, change.ID, result.Version, userID, nil)
+	result.Status = syncApplied
+	return result, nil
+}
+
+// syncDelete deletes a note unless it changed since the client's base version
+func syncDelete(ctx context.Context, userID int, change SyncChange, result SyncResult) (SyncResult, error) {
+	id := change.ID
+	role, err := noteRole(ctx, id, userID)
+	if err != nil {
+		return result, err
+	}
+	switch {
+	case role == "":
+		result.Status = syncNotFound
+		return result, nil
+	case role != roleOwner:
+		result.Status = syncForbidden
+		return result, nil
+	}
+
+	audience, err := noteAudience(ctx, id)
+	if err != nil {
+		return result, err
+	}
+	// An edit that lands after the role check still conflicts with the delete
+	version, err := removeNote(ctx, id, &change.BaseVersion)
+	if err == sql.ErrNoRows {
+		return syncConflictResult(ctx, id, result)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	publishNoteEvent(ctx, eventNoteDeleted, change.ID, version+1, userID, audience)
+	result.Status = syncApplied
+	result.Version = version + 1
+	return result, nil
+}
+
+// syncConflictResult reports a conflict along with the current server copy of the note
+func syncConflictResult(ctx context.Context, id int, result SyncResult) (SyncResult, error) {
+	note, err := scanNote(ctx, db.QueryRowContext(ctx, "SELECT "+noteColumns+" FROM notes WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		result.Status = syncNotFound
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	if note.Files, err = loadNoteFiles(ctx, note.ID); err != nil {
+		return result, err
+	}
+	if note.Items, err = loadNoteItems(ctx, note.ID); err != nil {
+		return result, err
+	}
+
+	result.Status = syncConflict
+	result.Version = note.Version
+	result.Note = &note
+	return result, nil
+}
+
+// changedNotes returns the notes visible to the user that changed within (from, to]
+func changedNotes(ctx context.Context, userID int, from, to int64) ([]Note, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+noteColumns+`, 'owner' FROM notes
+		WHERE user_id = $1 AND change_seq > $2 AND change_seq <= $3
+		UNION ALL
+		SELECT `+noteColumns+`, role FROM notes JOIN note_shares ON note_shares.note_id = notes.id
+		WHERE note_shares.grantee_user_id = $1 AND notes.change_seq > $2 AND notes.change_seq <= $3`,
+		userID, from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	notes := []Note{}
+	for rows.Next() {
+		var role string
+		n, err := scanNote(ctx, rows, &role)
+		if err != nil {
+			return nil, err
+		}
+		n.Role = role
+		notes = append(notes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range notes {
+		if notes[i].Files, err = loadNoteFiles(ctx, notes[i].ID); err != nil {
+			return nil, err
+		}
+		if notes[i].Items, err = loadNoteItems(ctx, notes[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return notes, nil
+}
+
+// deletedNotes returns the IDs of notes that disappeared for the user within (from, to]
+func deletedNotes(ctx context.Context, userID int, from, to int64) ([]int, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT note_id FROM note_tombstones WHERE user_id = $1 AND change_seq > $2 AND change_seq <= $3",
+		userID, from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	deleted := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, id)
+	}
+	return deleted, rows.Err()
+}
+
+// loadNoteFiles returns the attachments of a note
+func loadNoteFiles(ctx context.Context, noteID int) ([]File, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, note_id, file_name, size, ext, file_url, data_key_id, encryption FROM note_files WHERE note_id = $1", noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var files []File
+	for rows.Next() {
+		var f File
+		var encryption []byte
+		if err := rows.Scan(&f.ID, &f.NoteID, &f.FileName, &f.Size, &f.Extension, &f.URL, &f.KeyID, &encryption); err != nil {
+			return nil, err
+		}
+		if encryption != nil {
+			if err := json.Unmarshal(encryption, &f.Encryption); err != nil {
+				return nil, fmt.Errorf("file %d: decoding encryption: %w", f.ID, err)
+			}
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
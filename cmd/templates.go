@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	// Placeholders are expanded in any timezone, the runtime image has no zoneinfo
+	_ "time/tzdata"
+)
+
+const maxTemplateNameLength = 100
+
+// templatePlaceholder matches {{name}} in templates, spaces inside the braces are allowed
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*([a-zA-Z]+)\s*\}\}`)
+
+// templateValues expand the placeholders of a template at a given time
+var templateValues = map[string]func(time.Time) string{
+	"date":    func(t time.Time) string { return t.Format("2006-01-02") },
+	"time":    func(t time.Time) string { return t.Format("15:04") },
+	"weekday": func(t time.Time) string { return t.Weekday().String() },
+}
+
+// Template - represent a template of new notes. Built-in templates are shared by every user
+// and can't be changed.
+type Template struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	BuiltIn   bool      `json:"builtIn"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+const templateColumns = "id, name, title, content, user_id IS NULL, created_at, updated_at"
+
+func scanTemplate(row rowScanner) (Template, error) {
+	var t Template
+	err := row.Scan(&t.ID, &t.Name, &t.Title, &t.Content, &t.BuiltIn, &t.CreatedAt, &t.UpdatedAt)
+	return t, err
+}
+
+// expandTemplate replaces the placeholders of s with their values at now.
+// Unknown placeholders are left as they are.
+func expandTemplate(s string, now time.Time) string {
+	return templatePlaceholder.ReplaceAllStringFunc(s, func(match string) string {
+		name := templatePlaceholder.FindStringSubmatch(match)[1]
+		if value, ok := templateValues[name]; ok {
+			return value(now)
+		}
+		return match
+	})
+}
+
+// validateTemplate checks a template sent by a client and reports every invalid field at once
+func validateTemplate(t Template) error {
+	var fields []FieldError
+	if strings.TrimSpace(t.Name) == "" || utf8.RuneCountInString(t.Name) > maxTemplateNameLength {
+		fields = append(fields, FieldError{Field: "name", Message: fmt.Sprintf("Name is required and must be at most %d characters", maxTemplateNameLength)})
+	}
+	if utf8.RuneCountInString(t.Title) > maxTitleLength {
+		fields = append(fields, FieldError{Field: "title", Message: fmt.Sprintf("Title must be at most %d characters", maxTitleLength)})
+	}
+	if utf8.RuneCountInString(t.Content) > maxContentLength {
+		fields = append(fields, FieldError{Field: "content", Message: fmt.Sprintf("Content must be at most %d characters", maxContentLength)})
+	}
+	for _, f := range []struct{ field, value string }{{"title", t.Title}, {"content", t.Content}} {
+		for _, m := range templatePlaceholder.FindAllStringSubmatch(f.value, -1) {
+			if _, ok := templateValues[m[1]]; !ok {
+				fields = append(fields, FieldError{Field: f.field, Message: fmt.Sprintf("Unknown placeholder %s, use {{date}}, {{time}} or {{weekday}}", m[0])})
+				break
+			}
+		}
+	}
+
+	if len(fields) > 0 {
+		return validationError(fields...)
+	}
+	return nil
+}
+
+// visibleTemplate returns a built-in template or one of the user's, or sql.ErrNoRows
+func visibleTemplate(ctx context.Context, id, userID int) (Template, error) {
+	return scanTemplate(db.QueryRowContext(ctx,
+		"SELECT "+templateColumns+" FROM templates WHERE id = $1 AND (user_id IS NULL OR user_id = $2)", id, userID,
+	))
+}
+
+// applyTemplate fills the title and content a new note leaves empty from the template
+// given by the templateId query parameter. Placeholders are expanded in the timezone given
+// by the timezone parameter, an IANA name like Europe/Berlin, else in the timezone of the
+// user's settings, else in UTC.
+func applyTemplate(r *http.Request, n *Note) error {
+	ctx := r.Context()
+	q := r.URL.Query()
+	id, err := strconv.Atoi(q.Get("templateId"))
+	if err != nil || id <= 0 {
+		return newAPIError(http.StatusBadRequest, codeInvalidID, fmt.Sprintf("Invalid templateId %q, expected a positive integer", q.Get("templateId")))
+	}
+
+	var fields []FieldError
+	var loc *time.Location
+	if tz := q.Get("timezone"); tz != "" {
+		var field *FieldError
+		if loc, field = loadTimezone("timezone", tz); field != nil {
+			fields = append(fields, *field)
+		}
+	}
+	// The server can't encrypt the template for the client
+	if n.IsLocked {
+		fields = append(fields, FieldError{Field: "isLocked", Message: "Locked notes can't be created from a template"})
+	}
+	if len(fields) > 0 {
+		return validationError(fields...)
+	}
+
+	t, err := visibleTemplate(ctx, id, n.UserID)
+	if err == sql.ErrNoRows {
+		return notFoundError(codeTemplateNotFound, "Template not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	if loc == nil {
+		if loc, err = userLocation(ctx, n.UserID); err != nil {
+			return err
+		}
+	}
+	now := time.Now().In(loc)
+	if n.Title == "" {
+		n.Title = expandTemplate(t.Title, now)
+	}
+	if n.Content == "" {
+		n.Content = expandTemplate(t.Content, now)
+	}
+	slog.DebugContext(ctx, "Applied template", "template_id", id, "timezone", loc.String())
+	return nil
+}
+
+// List the built-in templates and the user's own
+func getTemplates(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rows, err := db.QueryContext(ctx,
+		"SELECT "+templateColumns+" FROM templates WHERE user_id IS NULL OR user_id = $1 ORDER BY user_id NULLS FIRST, name, id",
+		userIDFromContext(ctx),
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error querying templates", "error", err)
+		writeError(w, err)
+		return
+	}
+	defer func() { _ = rows.Close() }()
+
+	templates := []Template{}
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error scanning template", "error", err)
+			writeError(w, err)
+			return
+		}
+		templates = append(templates, t)
+	}
+	if err := rows.Err(); err != nil {
+		slog.ErrorContext(ctx, "Error querying templates", "error", err)
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(ctx, w, http.StatusOK, templates)
+}
+
+func getTemplate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	t, err := visibleTemplate(ctx, id, userIDFromContext(ctx))
+	if err == sql.ErrNoRows {
+		writeError(w, notFoundError(codeTemplateNotFound, "Template not found"))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error querying template", "template_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(ctx, w, http.StatusOK, t)
+}
+
+func createTemplate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var t Template
+	if err := decodeJSON(w, r, &t); err != nil {
+		slog.WarnContext(ctx, "Error decoding create template request", "error", err)
+		writeError(w, err)
+		return
+	}
+	if err := validateTemplate(t); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	t, err := scanTemplate(db.QueryRowContext(ctx,
+		"INSERT INTO templates (user_id, name, title, content) VALUES ($1, $2, $3, $4) RETURNING "+templateColumns,
+		userIDFromContext(ctx), t.Name, t.Title, t.Content,
+	))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error creating template", "error", err)
+		writeError(w, err)
+		return
+	}
+	slog.InfoContext(ctx, "Created template", "template_id", t.ID)
+
+	w.Header().Set("Location", fmt.Sprintf(apiPrefix+"/templates/%d", t.ID))
+	writeJSON(ctx, w, http.StatusCreated, t)
+}
+
+func updateTemplate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var t Template
+	if err := decodeJSON(w, r, &t); err != nil {
+		slog.WarnContext(ctx, "Error decoding update template request", "error", err)
+		writeError(w, err)
+		return
+	}
+	if err := validateTemplate(t); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	t, err = scanTemplate(db.QueryRowContext(ctx,
+		"UPDATE templates SET name = $1, title = $2, content = $3, updated_at = now() WHERE id = $4 AND user_id = $5 RETURNING "+templateColumns,
+		t.Name, t.Title, t.Content, id, userIDFromContext(ctx),
+	))
+	if err == sql.ErrNoRows {
+		writeError(w, templateNotOwned(ctx, id))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating template", "template_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+	slog.InfoContext(ctx, "Updated template", "template_id", id)
+
+	writeJSON(ctx, w, http.StatusOK, t)
+}
+
+func deleteTemplate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id, err := pathID(r, "id")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	result, err := db.ExecContext(ctx, "DELETE FROM templates WHERE id = $1 AND user_id = $2", id, userIDFromContext(ctx))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting template", "template_id", id, "error", err)
+		writeError(w, err)
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		writeError(w, templateNotOwned(ctx, id))
+		return
+	}
+	slog.InfoContext(ctx, "Deleted template", "template_id", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// templateNotOwned explains why the user couldn't change a template: it is built in,
+// or it doesn't exist as far as they can tell
+func templateNotOwned(ctx context.Context, id int) error {
+	t, err := visibleTemplate(ctx, id, userIDFromContext(ctx))
+	if err == nil && t.BuiltIn {
+		return newAPIError(http.StatusForbidden, codeForbidden, "Built-in templates can't be changed")
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	return notFoundError(codeTemplateNotFound, "Template not found")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	// A Friday evening in UTC is already Saturday in Tokyo
+	now := time.Date(2026, 10, 16, 22, 5, 0, 0, time.UTC)
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		s    string
+		now  time.Time
+		want string
+	}{
+		{name: "no placeholders", s: "Groceries", now: now, want: "Groceries"},
+		{name: "date", s: "Meeting {{date}}", now: now, want: "Meeting 2026-10-16"},
+		{name: "all", s: "{{weekday}}, {{date}} {{time}}", now: now, want: "Friday, 2026-10-16 22:05"},
+		{name: "spaces inside braces", s: "{{ date }}", now: now, want: "2026-10-16"},
+		{name: "repeated", s: "{{date}}/{{date}}", now: now, want: "2026-10-16/2026-10-16"},
+		{name: "unknown is kept", s: "{{author}} {{date}}", now: now, want: "{{author}} 2026-10-16"},
+		{name: "timezone", s: "{{weekday}}, {{date}} {{time}}", now: now.In(tokyo), want: "Saturday, 2026-10-17 07:05"},
+		{name: "single braces", s: "{date}", now: now, want: "{date}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expandTemplate(tt.s, tt.now); got != tt.want {
+				t.Errorf("expandTemplate(%q) = %q, want %q", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	tests := []struct {
+		name       string
+		template   Template
+		wantFields []string
+	}{
+		{name: "valid", template: Template{Name: "Standup", Title: "Standup {{date}}", Content: "- [ ] {{weekday}}"}},
+		{name: "missing name", template: Template{Name: "  "}, wantFields: []string{"name"}},
+		{name: "long name", template: Template{Name: strings.Repeat("n", maxTemplateNameLength+1)}, wantFields: []string{"name"}},
+		{name: "long title", template: Template{Name: "a", Title: strings.Repeat("t", maxTitleLength+1)}, wantFields: []string{"title"}},
+		{
+			name:       "unknown placeholders",
+			template:   Template{Name: "a", Title: "{{author}}", Content: "{{date}} {{mood}} {{ weather }}"},
+			wantFields: []string{"title", "content"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTemplate(tt.template)
+			if tt.wantFields == nil {
+				if err != nil {
+					t.Fatalf("validateTemplate() error = %v", err)
+				}
+				return
+			}
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("validateTemplate() error = %v, want a validation error", err)
+			}
+			var fields []string
+			for _, f := range apiErr.Details.([]FieldError) {
+				fields = append(fields, f.Field)
+			}
+			if !slices.Equal(fields, tt.wantFields) {
+				t.Errorf("invalid fields = %v, want %v", fields, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestLoadTimezone(t *testing.T) {
+	for _, name := range []string{"Europe/Berlin", "UTC", "America/Argentina/Buenos_Aires"} {
+		if loc, field := loadTimezone("timezone", name); field != nil || loc.String() != name {
+			t.Errorf("loadTimezone(%q) = %v, %v", name, loc, field)
+		}
+	}
+	for _, name := range []string{"Mars/Olympus_Mons", "Local", "../../etc/passwd"} {
+		if _, field := loadTimezone("timezone", name); field == nil || field.Field != "timezone" {
+			t.Errorf("loadTimezone(%q) accepted an invalid timezone", name)
+		}
+	}
+}
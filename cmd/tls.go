@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Listen addresses, overridden by HTTP_ADDR and HTTPS_ADDR. With TLS enabled the plain
+// HTTP listener only redirects to HTTPS, HTTP_ADDR=off turns it off.
+const (
+	defaultHTTPAddr         = ":8080"
+	defaultHTTPSAddr        = ":8443"
+	defaultAutocertCacheDir = "./autocert"
+)
+
+// serverTLS is the TLS setup of the server, nil when it serves plain HTTP
+type serverTLS struct {
+	config *tls.Config
+	addr   string
+	// redirectAddr is the plain HTTP listener, empty when it is turned off
+	redirectAddr string
+	// certs reloads the certificate files on SIGHUP, nil with automatic certificates
+	certs *certReloader
+	acme  *autocert.Manager
+}
+
+// httpAddr returns the address of the plain HTTP listener
+func httpAddr() string {
+	if v := os.Getenv("HTTP_ADDR"); v != "" {
+		return v
+	}
+	return defaultHTTPAddr
+}
+
+// loadServerTLS reads the TLS setup from the environment. TLS_CERT_FILE and TLS_KEY_FILE
+// serve a certificate from files. TLS_AUTOCERT_DOMAINS gets certificates over ACME instead,
+// from Let's Encrypt or the directory at TLS_ACME_DIRECTORY_URL.
+func loadServerTLS() (*serverTLS, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	domains := os.Getenv("TLS_AUTOCERT_DOMAINS")
+
+	t := &serverTLS{addr: os.Getenv("HTTPS_ADDR"), redirectAddr: httpAddr()}
+	if t.addr == "" {
+		t.addr = defaultHTTPSAddr
+	}
+	if t.redirectAddr == "off" {
+		t.redirectAddr = ""
+	}
+
+	switch {
+	case certFile == "" && keyFile == "" && domains == "":
+		return nil, nil
+	case domains != "" && (certFile != "" || keyFile != ""):
+		return nil, errors.New("set either TLS_CERT_FILE and TLS_KEY_FILE or TLS_AUTOCERT_DOMAINS")
+	case domains != "":
+		m, err := newAutocertManager(strings.Split(domains, ","))
+		if err != nil {
+			return nil, err
+		}
+		t.acme = m
+		t.config = m.TLSConfig()
+	default:
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+		certs, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.certs = certs
+		t.config = &tls.Config{
+			GetCertificate: certs.getCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+	}
+	t.config.MinVersion = tls.VersionTLS12
+	return t, nil
+}
+
+// newAutocertManager gets certificates for the domains over ACME and caches them in
+// TLS_AUTOCERT_CACHE_DIR. TLS_ACME_CA_FILE trusts the CA of a test directory like Pebble.
+func newAutocertManager(domains []string) (*autocert.Manager, error) {
+	for i := range domains {
+		domains[i] = strings.TrimSpace(domains[i])
+	}
+	cacheDir := os.Getenv("TLS_AUTOCERT_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = defaultAutocertCacheDir
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      os.Getenv("TLS_ACME_EMAIL"),
+	}
+
+	if directoryURL := os.Getenv("TLS_ACME_DIRECTORY_URL"); directoryURL != "" {
+		client := &acme.Client{DirectoryURL: directoryURL}
+		if caFile := os.Getenv("TLS_ACME_CA_FILE"); caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading TLS_ACME_CA_FILE: %w", err)
+			}
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(pem) {
+				return nil, errors.New("no certificates in TLS_ACME_CA_FILE")
+			}
+			client.HTTPClient = &http.Client{
+				Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+				Timeout:   30 * time.Second,
+			}
+		}
+		m.Client = client
+	}
+
+	slog.Info("Using automatic TLS certificates", "domains", domains, "cache_dir", cacheDir)
+	return m, nil
+}
+
+// redirectHandler serves the plain HTTP listener: ACME HTTP challenges, the probes, which
+// orchestrators call over plain HTTP, and a redirect to HTTPS for everything else
+func (t *serverTLS) redirectHandler(probes http.Handler) http.Handler {
+	_, httpsPort, _ := net.SplitHostPort(t.addr)
+
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			probes.ServeHTTP(w, r)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		// 308 keeps the method and body of API calls
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+	if t.acme != nil {
+		h = t.acme.HTTPHandler(h)
+	}
+	return h
+}
+
+// certReloader serves a certificate from files and reloads them on SIGHUP,
+// so a renewed certificate is picked up without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	slog.Info("Loaded TLS certificate", "file", c.certFile, "subject", leaf.Subject.CommonName, "expires", leaf.NotAfter)
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// reloadOnSIGHUP reloads the certificate on every SIGHUP until ctx is done.
+// A certificate that fails to load leaves the current one in place.
+func (c *certReloader) reloadOnSIGHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := c.reload(); err != nil {
+				slog.Error("Error reloading TLS certificate, keeping the current one", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/XSAM/otelsql"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const defaultServiceName = "note-be"
+
+var tracer = otel.Tracer("github.com/TG-Note-App/note-be")
+
+// initTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set. The exporter reads the other standard
+// OTEL_* variables itself. Without an endpoint, spans are no-ops and nothing is sent,
+// but W3C trace context is still propagated. The returned function flushes pending spans.
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// openDB opens the Postgres pool with a span for every query
+func openDB(dsn string) (*sql.DB, error) {
+	return otelsql.Open("postgres", dsn,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{OmitConnResetSession: true, OmitRows: true}),
+	)
+}
+
+// traceHTTP starts a span for every request, continuing the trace of the caller.
+// recordRoute renames it after the mux route once the request is matched.
+func traceHTTP(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "HTTP request")
+}
+
+// nameRouteSpan names the request span after the route template, like "GET /notes/{id}"
+func nameRouteSpan(r *http.Request, route string) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetName(r.Method + " " + route)
+	span.SetAttributes(semconv.HTTPRoute(route))
+}
+
+// startStorageOp starts the span of a blob storage call. The returned function ends it
+// and records the call in the storage metrics.
+func startStorageOp(ctx context.Context, backend, operation, bucket, object string) (context.Context, func(error)) {
+	start := time.Now()
+	attrs := []attribute.KeyValue{
+		attribute.String("storage.backend", backend),
+		attribute.String("storage.bucket", bucket),
+	}
+	if object != "" {
+		attrs = append(attrs, attribute.String("storage.object", object))
+	}
+	ctx, span := tracer.Start(ctx, "storage."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+
+	return ctx, func(err error) {
+		observeStorage(backend, operation, start, err)
+		endSpan(span, err)
+	}
+}
+
+// endSpan records err, if any, on the span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Note payload limits, in characters
+const (
+	maxTitleLength   = 200
+	maxContentLength = 100_000
+	// Locked notes hold base64 ciphertext, which is longer than the text it encrypts
+	maxLockedContentLength = 600_000
+)
+
+// validateNote checks a note sent by a client and reports every invalid field at once
+func validateNote(n Note) error {
+	var fields []FieldError
+	if strings.TrimSpace(n.Title) == "" && strings.TrimSpace(n.Content) == "" {
+		fields = append(fields, FieldError{Field: "title", Message: "A note needs a title or content"})
+	}
+	if utf8.RuneCountInString(n.Title) > maxTitleLength {
+		fields = append(fields, FieldError{Field: "title", Message: fmt.Sprintf("Title must be at most %d characters", maxTitleLength)})
+	}
+	switch {
+	case n.IsLocked && n.Encryption == nil:
+		fields = append(fields, FieldError{Field: "encryption", Message: "Locked notes need encryption metadata"})
+	case n.IsLocked:
+		fields = append(fields, validateNoteEncryption(n.Encryption)...)
+	case n.Encryption != nil:
+		fields = append(fields, FieldError{Field: "encryption", Message: "Only locked notes have encryption metadata"})
+	}
+	if n.IsLocked {
+		if _, ok := decodedLen(n.Content); !ok || len(n.Content) > maxLockedContentLength {
+			fields = append(fields, FieldError{Field: "content", Message: fmt.Sprintf("Content of a locked note must be base64 ciphertext of at most %d characters", maxLockedContentLength)})
+		}
+	} else if utf8.RuneCountInString(n.Content) > maxContentLength {
+		fields = append(fields, FieldError{Field: "content", Message: fmt.Sprintf("Content must be at most %d characters", maxContentLength)})
+	}
+	if !validRecurrence(n.RemindRecurrence) {
+		fields = append(fields, invalidRecurrenceField)
+	}
+
+	if len(fields) > 0 {
+		return validationError(fields...)
+	}
+	return nil
+}
+
+var invalidRecurrenceField = FieldError{
+	Field:   "remindRecurrence",
+	Message: "Recurrence must be empty, daily, weekly, monthly or yearly",
+}
@@ -4,17 +4,27 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/url"
+	"os"
 	"sort"
 	"strings"
 )
 
-// #nosec G101
-const botToken = "ТВОЙ_BOT_TOKEN"
-
 // VerifyTelegramAuth verifies the Telegram auth hash
 func VerifyTelegramAuth(initData string) (bool, error) {
+	return verifyInitData(initData, os.Getenv("TG_BOT_TOKEN"))
+}
+
+// verifyInitData checks the hash of Mini App init data signed for the bot with the given token.
+// See https://core.telegram.org/bots/webapps#validating-data-received-via-the-mini-app
+func verifyInitData(initData, botToken string) (bool, error) {
+	// Without a token the key would be public and anyone could sign init data
+	if botToken == "" {
+		return false, errors.New("bot token is not set")
+	}
+
 	dataMap, err := parseInitData(initData)
 	if err != nil {
 		return false, err
@@ -34,13 +44,17 @@ func VerifyTelegramAuth(initData string) (bool, error) {
 	sort.Strings(dataStrings)
 	dataCheckString := strings.Join(dataStrings, "\n")
 
-	// Создаём HMAC-SHA256
-	secretKey := sha256.Sum256([]byte(botToken))
-	h := hmac.New(sha256.New, secretKey[:])
+	// The secret key is HMAC-SHA256 of the bot token keyed with "WebAppData"
+	secret := hmac.New(sha256.New, []byte("WebAppData"))
+	secret.Write([]byte(botToken))
+	h := hmac.New(sha256.New, secret.Sum(nil))
 	h.Write([]byte(dataCheckString))
-	expectedHash := hex.EncodeToString(h.Sum(nil))
 
-	return hash == expectedHash, nil
+	got, err := hex.DecodeString(hash)
+	if err != nil {
+		return false, nil
+	}
+	return hmac.Equal(got, h.Sum(nil)), nil
 }
 
 func parseInitData(initData string) (map[string]string, error) {
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBotToken = "123456:test-bot-token"
+
+// signInitData signs init data the way Telegram does for a Mini App of the bot
+func signInitData(values url.Values, botToken string) string {
+	secret := hmac.New(sha256.New, []byte("WebAppData"))
+	secret.Write([]byte(botToken))
+	return signInitDataWithKey(values, secret.Sum(nil))
+}
+
+func signInitDataWithKey(values url.Values, key []byte) string {
+	var pairs []string
+	for name := range values {
+		pairs = append(pairs, name+"="+values.Get(name))
+	}
+	sort.Strings(pairs)
+
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(strings.Join(pairs, "\n")))
+
+	signed := url.Values{}
+	for name := range values {
+		signed.Set(name, values.Get(name))
+	}
+	signed.Set("hash", hex.EncodeToString(h.Sum(nil)))
+	return signed.Encode()
+}
+
+func testInitData() url.Values {
+	return url.Values{
+		"auth_date": {"1760000000"},
+		"query_id":  {"AAHdF6IQAAAAAN0XohDhrOrc"},
+		"user":      {`{"id":279058397,"first_name":"Vladislav","username":"vdkfrost"}`},
+	}
+}
+
+func TestVerifyInitData(t *testing.T) {
+	valid := signInitData(testInitData(), testBotToken)
+
+	tests := []struct {
+		name     string
+		initData string
+		botToken string
+		want     bool
+		wantErr  bool
+	}{
+		{name: "valid", initData: valid, botToken: testBotToken, want: true},
+		{name: "other bot", initData: valid, botToken: "654321:other-bot-token"},
+		{name: "no bot token", initData: valid, botToken: "", wantErr: true},
+		{
+			name:     "signed without a bot token",
+			initData: signInitData(testInitData(), ""),
+			botToken: "",
+			wantErr:  true,
+		},
+		{
+			name:     "tampered user",
+			initData: strings.Replace(valid, "279058397", "279058398", 1),
+			botToken: testBotToken,
+		},
+		{
+			name: "sha256 of the token as key",
+			initData: func() string {
+				key := sha256.Sum256([]byte(testBotToken))
+				return signInitDataWithKey(testInitData(), key[:])
+			}(),
+			botToken: testBotToken,
+		},
+		{
+			name:     "missing hash",
+			initData: url.Values{"auth_date": {"1760000000"}}.Encode(),
+			botToken: testBotToken,
+			wantErr:  true,
+		},
+		{
+			name:     "hash not hex",
+			initData: url.Values{"auth_date": {"1760000000"}, "hash": {"zz"}}.Encode(),
+			botToken: testBotToken,
+		},
+		{name: "invalid query", initData: "a=%zz", botToken: testBotToken, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyInitData(tt.initData, tt.botToken)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyInitData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("verifyInitData() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	t.Setenv("TG_BOT_TOKEN", testBotToken)
+
+	fresh := testInitData()
+	fresh.Set("auth_date", strconv.FormatInt(time.Now().Unix(), 10))
+	noUser := testInitData()
+	noUser.Set("auth_date", strconv.FormatInt(time.Now().Unix(), 10))
+	noUser.Del("user")
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{name: "valid", header: authScheme + signInitData(fresh, testBotToken), want: 279058397},
+		{name: "expired", header: authScheme + signInitData(testInitData(), testBotToken)},
+		{name: "no user", header: authScheme + signInitData(noUser, testBotToken)},
+		{name: "wrong scheme", header: "Bearer " + signInitData(fresh, testBotToken)},
+		{name: "missing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/notes", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			got, err := authenticate(r)
+			if (err == nil) != (tt.want != 0) {
+				t.Fatalf("authenticate() error = %v, want user %d", err, tt.want)
+			}
+			if got != tt.want {
+				t.Errorf("authenticate() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// apiPrefix is the path prefix of the current API version
+const apiPrefix = "/api/v1"
+
+// Error codes of requests that match no API route
+const (
+	codeRouteNotFound    = "route_not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+)
+
+// legacyAPIPrefixes are the unversioned paths the API was served under before /api/v1
+var legacyAPIPrefixes = []string{"/openapi.json", "/notes", "/sync", "/export", "/import", "/imports", "/jobs", "/events"}
+
+// legacyAPIAlias serves the unversioned API paths as deprecated aliases of /api/v1.
+// The request is rewritten, so routing, validation and metrics only know the versioned
+// routes. Page loads of the same paths are client-side routes of the frontend and are left alone.
+func legacyAPIAlias(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLegacyAPIPath(r.URL.Path) || acceptsHTML(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		successor := apiPrefix + r.URL.Path
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		deprecatedAPIRequests.Inc()
+
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = successor
+		if r.URL.RawPath != "" {
+			r2.URL.RawPath = apiPrefix + r.URL.RawPath
+		}
+		next.ServeHTTP(w, r2)
+	})
+}
+
+func isLegacyAPIPath(p string) bool {
+	for _, prefix := range legacyAPIPrefixes {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsHTML reports whether the request is a browser page load rather than an API call
+func acceptsHTML(r *http.Request) bool {
+	if r.Header.Get("Sec-Fetch-Mode") == "navigate" {
+		return true
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == "text/html" {
+			return true
+		}
+	}
+	return false
+}
+
+// Unknown paths under /api never fall through to the frontend
+func apiNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, notFoundError(codeRouteNotFound, "No API route for "+r.URL.Path))
+}
+
+func apiMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, newAPIError(http.StatusMethodNotAllowed, codeMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path))
+}
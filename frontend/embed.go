@@ -0,0 +1,15 @@
+//go:build embedfrontend
+
+// Package frontend holds the built frontend when the binary is built with the
+// embedfrontend tag. The build needs frontend/dist in place.
+package frontend
+
+import "embed"
+
+// Embedded reports whether Dist holds the frontend
+const Embedded = true
+
+// Dist contains the built frontend under dist/
+//
+//go:embed all:dist
+var Dist embed.FS
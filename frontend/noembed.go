@@ -0,0 +1,13 @@
+//go:build !embedfrontend
+
+// Package frontend holds the built frontend when the binary is built with the
+// embedfrontend tag. Without it the frontend is served from disk.
+package frontend
+
+import "embed"
+
+// Embedded reports whether Dist holds the frontend
+const Embedded = false
+
+// Dist is empty, the binary was built without the frontend
+var Dist embed.FS
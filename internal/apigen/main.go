@@ -0,0 +1,154 @@
+// Command apigen generates the server interface and the route table of the API from its
+// OpenAPI document, so every documented operation has a handler and is served at the
+// documented path and method. It runs with go generate in cmd/.
+//
+// Operations may set x-rate-class to the rate limit class of the route. Operations with
+// an empty security requirement are public, and a query parameter named initData lets
+// clients that can't set headers authenticate.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// operation - represent a documented operation as the generated code needs it
+type operation struct {
+	Method      string
+	Path        string
+	OperationID string
+	Handler     string
+	Summary     string
+	RateClass   string
+	Auth        bool
+	QueryAuth   bool
+}
+
+// methodOrder keeps the operations of a path in a stable order
+var methodOrder = map[string]int{
+	http.MethodGet: 0, http.MethodHead: 1, http.MethodPost: 2, http.MethodPut: 3,
+	http.MethodPatch: 4, http.MethodDelete: 5,
+}
+
+func main() {
+	specPath := flag.String("spec", "api/openapi.yaml", "OpenAPI document to read")
+	out := flag.String("out", "api_gen.go", "Go file to write")
+	pkg := flag.String("package", "main", "package of the generated file")
+	flag.Parse()
+
+	doc, err := openapi3.NewLoader().LoadFromFile(*specPath)
+	if err != nil {
+		log.Fatalf("loading %s: %v", *specPath, err)
+	}
+	ops, err := operations(doc)
+	if err != nil {
+		log.Fatalf("reading %s: %v", *specPath, err)
+	}
+
+	var buf bytes.Buffer
+	err = fileTemplate.Execute(&buf, map[string]any{
+		"Package":    *pkg,
+		"Spec":       *specPath,
+		"Operations": ops,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatalf("formatting generated code: %v", err)
+	}
+	if err := os.WriteFile(*out, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// operations lists the operations of the document, sorted by path and method
+func operations(doc *openapi3.T) ([]operation, error) {
+	var ops []operation
+	for path, item := range doc.Paths.Map() {
+		for method, op := range item.Operations() {
+			if op.OperationID == "" {
+				return nil, fmt.Errorf("%s %s has no operationId", method, path)
+			}
+
+			o := operation{
+				Method:      method,
+				Path:        path,
+				OperationID: op.OperationID,
+				Handler:     strings.ToUpper(op.OperationID[:1]) + op.OperationID[1:],
+				Summary:     op.Summary,
+				Auth:        len(doc.Security) > 0,
+			}
+			if op.Security != nil {
+				o.Auth = len(*op.Security) > 0
+			}
+			if class, ok := op.Extensions["x-rate-class"]; ok {
+				if o.RateClass, ok = class.(string); !ok {
+					return nil, fmt.Errorf("%s %s: x-rate-class must be a string", method, path)
+				}
+			}
+			for _, p := range append(item.Parameters, op.Parameters...) {
+				if p.Value != nil && p.Value.In == openapi3.ParameterInQuery && p.Value.Name == "initData" {
+					o.QueryAuth = true
+				}
+			}
+			ops = append(ops, o)
+		}
+	}
+
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].Path != ops[j].Path {
+			return ops[i].Path < ops[j].Path
+		}
+		return methodOrder[ops[i].Method] < methodOrder[ops[j].Method]
+	})
+	return ops, nil
+}
+
+var fileTemplate = template.Must(template.New("api").Parse(`// Code generated by apigen from {{.Spec}}. DO NOT EDIT.
+
+package {{.Package}}
+
+import "net/http"
+
+// apiServer has a handler for every operation of the API spec
+type apiServer interface {
+{{- range .Operations}}
+	// {{.Handler}} - {{.Method}} {{.Path}}{{if .Summary}}: {{.Summary}}{{end}}
+	{{.Handler}}(w http.ResponseWriter, r *http.Request)
+{{- end}}
+}
+
+// apiOperation - represent an operation of the API spec and how it is served
+type apiOperation struct {
+	method      string
+	path        string
+	operationID string
+	// rateClass is the rate limit class of the route, empty for none
+	rateClass string
+	// auth requires Telegram init data, queryAuth also accepts it in the initData parameter
+	auth      bool
+	queryAuth bool
+	handler   http.HandlerFunc
+}
+
+// apiOperations returns the operations of the API spec served by s
+func apiOperations(s apiServer) []apiOperation {
+	return []apiOperation{
+{{- range .Operations}}
+		{method: "{{.Method}}", path: "{{.Path}}", operationID: "{{.OperationID}}", rateClass: "{{.RateClass}}", auth: {{.Auth}}, queryAuth: {{.QueryAuth}}, handler: s.{{.Handler}}},
+{{- end}}
+	}
+}
+`))
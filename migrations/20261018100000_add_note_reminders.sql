@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE notes ADD COLUMN remind_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE notes ADD COLUMN remind_recurrence TEXT NOT NULL DEFAULT '';
+ALTER TABLE notes ADD COLUMN remind_attempts INT NOT NULL DEFAULT 0;
+ALTER TABLE notes ADD COLUMN remind_retry_at TIMESTAMP WITH TIME ZONE;
+CREATE INDEX notes_remind_due_idx ON notes (COALESCE(remind_retry_at, remind_at)) WHERE remind_at IS NOT NULL;
+
+CREATE TABLE reminder_deliveries (
+    id INT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    note_id INTEGER NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+    remind_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    attempt INT NOT NULL,
+    success BOOLEAN NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    attempted_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE reminder_deliveries;
+DROP INDEX notes_remind_due_idx;
+ALTER TABLE notes DROP COLUMN remind_retry_at;
+ALTER TABLE notes DROP COLUMN remind_attempts;
+ALTER TABLE notes DROP COLUMN remind_recurrence;
+ALTER TABLE notes DROP COLUMN remind_at;
+-- +goose StatementEnd
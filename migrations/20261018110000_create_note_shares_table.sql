@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE note_shares (
+    note_id INTEGER NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+    grantee_user_id INT NOT NULL,
+    role TEXT NOT NULL CHECK (role IN ('viewer', 'editor')),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (note_id, grantee_user_id)
+);
+CREATE INDEX note_shares_grantee_idx ON note_shares (grantee_user_id);
+CREATE INDEX notes_user_id_idx ON notes (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX notes_user_id_idx;
+DROP TABLE note_shares;
+-- +goose StatementEnd
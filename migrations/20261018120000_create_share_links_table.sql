@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE share_links (
+    id INT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    note_id INTEGER NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+    token_hash TEXT NOT NULL UNIQUE,
+    password_hash TEXT,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    max_views INT,
+    view_count INT NOT NULL DEFAULT 0,
+    created_by INT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX share_links_note_id_idx ON share_links (note_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE share_links;
+-- +goose StatementEnd
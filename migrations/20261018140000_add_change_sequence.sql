@@ -0,0 +1,115 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE SEQUENCE change_seq;
+
+-- Writers take a shared advisory lock before drawing a sequence number and keep it
+-- until commit. A sync request briefly takes the exclusive lock to read a high-water
+-- mark, so every change at or below it is guaranteed to be committed.
+CREATE FUNCTION next_change_seq() RETURNS BIGINT AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock_shared(7301);
+    RETURN nextval('change_seq');
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION assign_change_seq() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.change_seq := next_change_seq();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE notes ADD COLUMN change_seq BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE notes ADD COLUMN client_id TEXT;
+ALTER TABLE note_files ADD COLUMN change_seq BIGINT NOT NULL DEFAULT 0;
+UPDATE notes SET change_seq = nextval('change_seq');
+UPDATE note_files SET change_seq = nextval('change_seq');
+CREATE INDEX notes_change_seq_idx ON notes (change_seq);
+CREATE INDEX note_files_change_seq_idx ON note_files (change_seq);
+CREATE UNIQUE INDEX notes_user_client_id_idx ON notes (user_id, client_id) WHERE client_id IS NOT NULL;
+
+CREATE TRIGGER notes_change_seq BEFORE INSERT OR UPDATE ON notes
+    FOR EACH ROW EXECUTE FUNCTION assign_change_seq();
+CREATE TRIGGER note_files_change_seq BEFORE INSERT OR UPDATE ON note_files
+    FOR EACH ROW EXECUTE FUNCTION assign_change_seq();
+
+-- Tombstones tell each user which notes disappeared for them
+CREATE TABLE note_tombstones (
+    note_id INTEGER NOT NULL,
+    user_id INT NOT NULL,
+    change_seq BIGINT NOT NULL,
+    deleted_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (note_id, user_id)
+);
+CREATE INDEX note_tombstones_user_seq_idx ON note_tombstones (user_id, change_seq);
+
+CREATE FUNCTION record_note_tombstones() RETURNS TRIGGER AS $$
+DECLARE
+    seq BIGINT := next_change_seq();
+BEGIN
+    INSERT INTO note_tombstones (note_id, user_id, change_seq)
+    SELECT OLD.id, OLD.user_id, seq
+    UNION
+    SELECT OLD.id, grantee_user_id, seq FROM note_shares WHERE note_id = OLD.id
+    ON CONFLICT (note_id, user_id) DO UPDATE SET change_seq = EXCLUDED.change_seq, deleted_at = CURRENT_TIMESTAMP;
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+-- BEFORE so the shares are still there, they go away with the cascade
+CREATE TRIGGER notes_tombstone BEFORE DELETE ON notes
+    FOR EACH ROW EXECUTE FUNCTION record_note_tombstones();
+
+-- Granting access makes the note show up for the grantee, revoking removes it
+CREATE FUNCTION sync_note_share() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        INSERT INTO note_tombstones (note_id, user_id, change_seq)
+        SELECT OLD.note_id, OLD.grantee_user_id, next_change_seq()
+        WHERE EXISTS (SELECT 1 FROM notes WHERE id = OLD.note_id)
+        ON CONFLICT (note_id, user_id) DO UPDATE SET change_seq = EXCLUDED.change_seq, deleted_at = CURRENT_TIMESTAMP;
+        RETURN OLD;
+    END IF;
+    DELETE FROM note_tombstones WHERE note_id = NEW.note_id AND user_id = NEW.grantee_user_id;
+    UPDATE notes SET change_seq = next_change_seq() WHERE id = NEW.note_id;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER note_shares_sync AFTER INSERT OR UPDATE OR DELETE ON note_shares
+    FOR EACH ROW EXECUTE FUNCTION sync_note_share();
+
+-- Attachments are synced as part of their note
+CREATE FUNCTION touch_note_of_file() RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE notes SET change_seq = next_change_seq()
+    WHERE id = CASE WHEN TG_OP = 'DELETE' THEN OLD.note_id ELSE NEW.note_id END;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER note_files_touch_note AFTER INSERT OR UPDATE OR DELETE ON note_files
+    FOR EACH ROW EXECUTE FUNCTION touch_note_of_file();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER note_files_touch_note ON note_files;
+DROP FUNCTION touch_note_of_file();
+DROP TRIGGER note_shares_sync ON note_shares;
+DROP FUNCTION sync_note_share();
+DROP TRIGGER notes_tombstone ON notes;
+DROP FUNCTION record_note_tombstones();
+DROP TABLE note_tombstones;
+DROP TRIGGER note_files_change_seq ON note_files;
+DROP TRIGGER notes_change_seq ON notes;
+DROP INDEX notes_user_client_id_idx;
+DROP INDEX note_files_change_seq_idx;
+DROP INDEX notes_change_seq_idx;
+ALTER TABLE note_files DROP COLUMN change_seq;
+ALTER TABLE notes DROP COLUMN client_id;
+ALTER TABLE notes DROP COLUMN change_seq;
+DROP FUNCTION assign_change_seq();
+DROP FUNCTION next_change_seq();
+DROP SEQUENCE change_seq;
+-- +goose StatementEnd
@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE jobs (
+    id BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    type TEXT NOT NULL,
+    payload JSONB NOT NULL DEFAULT '{}',
+    user_id INT,
+    status TEXT NOT NULL DEFAULT 'queued' CHECK (status IN ('queued', 'running', 'succeeded', 'dead')),
+    attempts INT NOT NULL DEFAULT 0,
+    max_attempts INT NOT NULL DEFAULT 5,
+    run_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until TIMESTAMP WITH TIME ZONE,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX jobs_queued_idx ON jobs (run_at) WHERE status = 'queued';
+CREATE INDEX jobs_running_idx ON jobs (locked_until) WHERE status = 'running';
+
+ALTER TABLE imports ADD COLUMN job_id BIGINT REFERENCES jobs(id) ON DELETE SET NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE imports DROP COLUMN job_id;
+DROP TABLE jobs;
+-- +goose StatementEnd
@@ -0,0 +1,47 @@
+-- +goose Up
+-- +goose StatementBegin
+-- note_files.id was created as SERIAL, use an identity column like every other table
+ALTER TABLE note_files ALTER COLUMN id DROP DEFAULT;
+DROP SEQUENCE note_files_id_seq;
+ALTER TABLE note_files ALTER COLUMN id ADD GENERATED BY DEFAULT AS IDENTITY;
+SELECT setval(pg_get_serial_sequence('note_files', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM note_files;
+
+-- Telegram user IDs don't fit in INT
+ALTER TABLE notes ALTER COLUMN user_id TYPE BIGINT;
+ALTER TABLE note_shares ALTER COLUMN grantee_user_id TYPE BIGINT;
+ALTER TABLE share_links ALTER COLUMN created_by TYPE BIGINT;
+ALTER TABLE note_tombstones ALTER COLUMN user_id TYPE BIGINT;
+ALTER TABLE imports ALTER COLUMN user_id TYPE BIGINT;
+ALTER TABLE import_sources ALTER COLUMN user_id TYPE BIGINT;
+ALTER TABLE jobs ALTER COLUMN user_id TYPE BIGINT;
+
+-- Columns read into non-nullable fields
+UPDATE notes SET is_pin = FALSE WHERE is_pin IS NULL;
+ALTER TABLE notes ALTER COLUMN is_pin SET NOT NULL;
+UPDATE note_files SET ext = '' WHERE ext IS NULL;
+ALTER TABLE note_files ALTER COLUMN ext SET DEFAULT '';
+ALTER TABLE note_files ALTER COLUMN ext SET NOT NULL;
+UPDATE note_files SET uploaded_at = CURRENT_TIMESTAMP WHERE uploaded_at IS NULL;
+ALTER TABLE note_files ALTER COLUMN uploaded_at SET NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE note_files ALTER COLUMN uploaded_at DROP NOT NULL;
+ALTER TABLE note_files ALTER COLUMN ext DROP NOT NULL;
+ALTER TABLE note_files ALTER COLUMN ext DROP DEFAULT;
+ALTER TABLE notes ALTER COLUMN is_pin DROP NOT NULL;
+
+ALTER TABLE jobs ALTER COLUMN user_id TYPE INT;
+ALTER TABLE import_sources ALTER COLUMN user_id TYPE INT;
+ALTER TABLE imports ALTER COLUMN user_id TYPE INT;
+ALTER TABLE note_tombstones ALTER COLUMN user_id TYPE INT;
+ALTER TABLE share_links ALTER COLUMN created_by TYPE INT;
+ALTER TABLE note_shares ALTER COLUMN grantee_user_id TYPE INT;
+ALTER TABLE notes ALTER COLUMN user_id TYPE INT;
+
+ALTER TABLE note_files ALTER COLUMN id DROP IDENTITY;
+CREATE SEQUENCE note_files_id_seq OWNED BY note_files.id;
+ALTER TABLE note_files ALTER COLUMN id SET DEFAULT nextval('note_files_id_seq');
+SELECT setval('note_files_id_seq', COALESCE(MAX(id), 0) + 1, false) FROM note_files;
+-- +goose StatementEnd
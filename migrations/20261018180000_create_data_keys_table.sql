@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Data keys encrypt the notes and attachments of a user, they are stored wrapped by a master key
+CREATE TABLE data_keys (
+    id BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    user_id BIGINT NOT NULL UNIQUE,
+    master_key_id TEXT NOT NULL,
+    wrapped_key BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    rewrapped_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX data_keys_master_key_id_idx ON data_keys (master_key_id);
+
+-- The data key that sealed the row, NULL for plaintext rows
+ALTER TABLE notes ADD COLUMN data_key_id BIGINT REFERENCES data_keys(id);
+ALTER TABLE note_files ADD COLUMN data_key_id BIGINT REFERENCES data_keys(id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE note_files DROP COLUMN data_key_id;
+ALTER TABLE notes DROP COLUMN data_key_id;
+DROP TABLE data_keys;
+-- +goose StatementEnd
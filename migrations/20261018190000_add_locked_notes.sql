@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Locked notes are encrypted by the client, the server only stores the ciphertext
+-- and the metadata the client needs to decrypt it
+ALTER TABLE notes ADD COLUMN is_locked BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE notes ADD COLUMN encryption JSONB;
+ALTER TABLE notes ADD CONSTRAINT notes_locked_encryption_check CHECK (is_locked = (encryption IS NOT NULL));
+
+-- Attachments of locked notes are uploaded as ciphertext too
+ALTER TABLE note_files ADD COLUMN encryption JSONB;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE note_files DROP COLUMN encryption;
+ALTER TABLE notes DROP CONSTRAINT notes_locked_encryption_check;
+ALTER TABLE notes DROP COLUMN encryption;
+ALTER TABLE notes DROP COLUMN is_locked;
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Templates of new notes. Built-in templates have no user and are shown to everyone.
+CREATE TABLE templates (
+    id INT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    user_id BIGINT,
+    name TEXT NOT NULL,
+    title TEXT NOT NULL DEFAULT '',
+    content TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX templates_user_id_idx ON templates (user_id);
+
+INSERT INTO templates (name, title, content) VALUES
+    ('Meeting notes', 'Meeting {{date}}', E'Date: {{weekday}}, {{date}} {{time}}\nAttendees:\n- \n\nAgenda:\n1. \n\nNotes:\n\nAction items:\n- [ ] '),
+    ('Shopping list', 'Shopping {{date}}', E'- [ ] \n- [ ] \n- [ ] '),
+    ('Journal entry', '{{weekday}}, {{date}}', E'How I feel:\n\nWhat happened today:\n\nGrateful for:\n- ');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE templates;
+-- +goose StatementEnd
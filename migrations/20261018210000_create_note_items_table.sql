@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Checklist items parsed from the "- [ ]" lines of notes. The content stays the source of
+-- truth, rows are kept in step with it so items get stable IDs and can be queried across notes.
+CREATE TABLE note_items (
+    id BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    note_id INTEGER NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    text TEXT NOT NULL,
+    checked BOOLEAN NOT NULL DEFAULT false,
+    due_date DATE,
+    -- The data key that sealed text, NULL when it is plaintext
+    data_key_id BIGINT REFERENCES data_keys(id)
+);
+CREATE INDEX note_items_note_id_idx ON note_items (note_id, position);
+CREATE INDEX note_items_open_idx ON note_items (due_date) WHERE NOT checked;
+
+-- Index the checklists of existing notes in the background
+INSERT INTO jobs (type, payload) VALUES ('index-note-items', '{"afterId": 0}');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM jobs WHERE type = 'index-note-items';
+DROP TABLE note_items;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- A scheduler claims due reminders for a while and sends them outside any transaction,
+-- so a slow Bot API doesn't hold row locks. An expired claim is picked up again.
+ALTER TABLE notes ADD COLUMN remind_claimed_until TIMESTAMP WITH TIME ZONE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE notes DROP COLUMN remind_claimed_until;
+-- +goose StatementEnd
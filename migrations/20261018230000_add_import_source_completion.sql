@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- A source note is recorded when its note is created and completed once all of its
+-- attachments are saved, so a retried import resumes it. Existing rows are complete.
+ALTER TABLE import_sources ADD COLUMN complete BOOLEAN NOT NULL DEFAULT true;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE import_sources DROP COLUMN complete;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Preferences of a user. Users have no row until they change a setting, an empty
+-- timezone means UTC.
+CREATE TABLE user_settings (
+    user_id BIGINT PRIMARY KEY,
+    timezone TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE user_settings;
+-- +goose StatementEnd
@@ -0,0 +1,9 @@
+// Package migrations holds the SQL migrations of the database schema, embedded in the binary.
+package migrations
+
+import "embed"
+
+// FS contains the goose SQL migrations
+//
+//go:embed *.sql
+var FS embed.FS
@@ -1,9 +1,12 @@
 #!/bin/bash
 
-BASE_URL="http://localhost:8080"
+BASE_URL="http://localhost:8080/api/v1"
+# Telegram Mini App init data of the test user (window.Telegram.WebApp.initData)
+AUTH="Authorization: tma $INIT_DATA"
 
 echo "Creating a new note..."
 curl -X POST $BASE_URL/notes \
+  -H "$AUTH" \
   -H "Content-Type: application/json" \
   -d '{
     "title": "Test Note",
@@ -11,13 +14,14 @@ curl -X POST $BASE_URL/notes \
   }' | json_pp
 
 echo -e "\nGetting all notes..."
-curl $BASE_URL/notes | json_pp
+curl -H "$AUTH" $BASE_URL/notes | json_pp
 
 echo -e "\nGetting note with ID 1..."
-curl $BASE_URL/notes/1 | json_pp
+curl -H "$AUTH" $BASE_URL/notes/1 | json_pp
 
 echo -e "\nUpdating note with ID 1..."
 curl -X PUT $BASE_URL/notes/1 \
+  -H "$AUTH" \
   -H "Content-Type: application/json" \
   -d '{
     "title": "Updated Note",
@@ -25,4 +29,4 @@ curl -X PUT $BASE_URL/notes/1 \
   }' | json_pp
 
 echo -e "\nDeleting note with ID 1..."
-curl -X DELETE $BASE_URL/notes/1
+curl -X DELETE -H "$AUTH" $BASE_URL/notes/1